@@ -0,0 +1,188 @@
+package stack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// If set, GetSharedResources caches its results as files in this directory,
+// and reads them back rather than looking up the base stack again. Entries
+// are kept per account and region, since the same stack name can exist in
+// each.
+var SharedResourcesCacheDir = ""
+
+// How long a cached SharedResources entry is used before the base stack is
+// looked up again, so that changes to the base stack are picked up. If zero,
+// entries are used until they're busted.
+var SharedResourcesCacheTTL = time.Hour
+
+// Return the cache file for a stack's SharedResources, in the client's account
+// and region.
+func (c *Client) sharedResourcesCachePath(stackName string) (string, error) {
+	reg, err := c.awsRegion()
+	if err != nil {
+		return "", err
+	}
+
+	account, err := c.accountID()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(SharedResourcesCacheDir, account, reg.Name,
+		url.QueryEscape(stackName)+".json"), nil
+}
+
+// Return the account ID of the client's credentials. It's looked up once, and
+// remembered for the life of the client.
+func (c *Client) accountID() (string, error) {
+	c.accountMu.Lock()
+	defer c.accountMu.Unlock()
+
+	if c.account != "" {
+		return c.account, nil
+	}
+
+	identity, err := c.GetCallerIdentity()
+	if err != nil {
+		return "", err
+	}
+
+	c.account = identity.Account
+	return c.account, nil
+}
+
+// Read a stack's SharedResources from the cache, returning false if they
+// aren't cached, or were cached longer ago than the SharedResourcesCacheTTL.
+func readSharedResourcesCache(path string) (SharedResources, bool) {
+	shared := SharedResources{}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return shared, false
+	}
+
+	if SharedResourcesCacheTTL > 0 && time.Since(info.ModTime()) >= SharedResourcesCacheTTL {
+		log.Debugf("expired SharedResources cache %s", path)
+		return shared, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return shared, false
+	}
+
+	if err := json.Unmarshal(data, &shared); err != nil {
+		log.Debugf("invalid SharedResources cache %s: %s", path, err)
+		return shared, false
+	}
+	return shared, true
+}
+
+func writeSharedResourcesCache(path string, shared SharedResources) error {
+	data, err := json.Marshal(shared)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Remove a stack's cached SharedResources, so the next GetSharedResources
+// looks up the base stack again.
+func (c *Client) BustSharedResourcesCache(stackName string) error {
+	if SharedResourcesCacheDir == "" {
+		return nil
+	}
+
+	path, err := c.sharedResourcesCachePath(stackName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type describeCacheEntry struct {
+	resp    DescribeStacksResponse
+	fetched time.Time
+}
+
+// Describe stacks, reusing a response from within the DescribeStacksCacheTTL.
+// Errors aren't cached.
+func (c *Client) describeStacksCached(name string) (DescribeStacksResponse, error) {
+	reg, err := c.awsRegion()
+	if err != nil {
+		return DescribeStacksResponse{}, err
+	}
+	key := reg.Name + "/" + name
+
+	c.describeMu.Lock()
+	entry, ok := c.describeCache[key]
+	c.describeMu.Unlock()
+
+	if ok && time.Since(entry.fetched) < c.DescribeStacksCacheTTL {
+		return entry.resp, nil
+	}
+
+	resp, err := c.describeStacks(name)
+	if err != nil {
+		return resp, err
+	}
+
+	c.describeMu.Lock()
+	if c.describeCache == nil {
+		c.describeCache = make(map[string]describeCacheEntry)
+	}
+	c.describeCache[key] = describeCacheEntry{resp: resp, fetched: time.Now()}
+	c.describeMu.Unlock()
+
+	return resp, nil
+}
+
+// Drop the cached descriptions which include a stack, after a call which
+// changes it. The stack may be given by name or ID, and is dropped however it
+// was described: by name, by its StackId, or in the list of all stacks.
+func (c *Client) forgetDescribeStacks(name string) {
+	reg, err := c.awsRegion()
+	if err != nil {
+		return
+	}
+	prefix := reg.Name + "/"
+
+	c.describeMu.Lock()
+	defer c.describeMu.Unlock()
+	for key, entry := range c.describeCache {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if key == prefix+name || entry.includes(name) {
+			delete(c.describeCache, key)
+		}
+	}
+}
+
+// Check if a cached response describes the stack, by name or ID
+func (e describeCacheEntry) includes(name string) bool {
+	for _, stack := range e.resp.Stacks {
+		if stack.matches(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,348 @@
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSharedResourcesCacheNoEcho(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	SharedResourcesCacheDir = dir
+	defer func() { SharedResourcesCacheDir = "" }()
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+	s.Handle("GetCallerIdentity", func(url.Values) (int, string) {
+		return http.StatusOK, callerIdentityXML("123456789012")
+	})
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>base</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>galaxy-key</ParameterValue></member>
+          <member><ParameterKey>DBPassword</ParameterKey><ParameterValue>****</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	if _, err := GetSharedResources("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "123456789012", testRegion, "base.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(data), "galaxy-key") {
+		t.Errorf("expected KeyName in the cache file, got %s", data)
+	}
+	if strings.Contains(string(data), "DBPassword") || strings.Contains(string(data), NoEchoMask) {
+		t.Errorf("expected no NoEcho parameter in the cache file, got %s", data)
+	}
+}
+
+func TestSharedResourcesCacheRegions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	SharedResourcesCacheDir = dir
+	defer func() { SharedResourcesCacheDir = "" }()
+
+	east := newTestServer(t)
+	defer east.Close()
+	west := newRegionTestServer(t, "galaxy-test-2")
+	defer west.Close()
+
+	for _, s := range []*testServer{east, west} {
+		handleSharedResources(s, "base")
+		s.Handle("GetCallerIdentity", func(url.Values) (int, string) {
+			return http.StatusOK, callerIdentityXML("123456789012")
+		})
+	}
+
+	// the same stack name in the second region has a different key
+	west.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>base</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>west-key</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	clients := map[string]*Client{
+		"galaxy-key": NewClient(testRegion),
+		"west-key":   NewClient("galaxy-test-2"),
+	}
+
+	// fill the cache, then read each region back from it
+	for i := 0; i < 2; i++ {
+		for key, client := range clients {
+			shared, err := client.GetSharedResources("base")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if shared.Parameters["KeyName"] != key {
+				t.Errorf("%s: expected KeyName %s, got %s", client.Region, key, shared.Parameters["KeyName"])
+			}
+		}
+	}
+
+	for _, s := range []*testServer{east, west} {
+		if n := len(s.Requests("DescribeStacks")); n != 1 {
+			t.Errorf("%s: expected 1 DescribeStacks request, got %d", s.awsRegion, n)
+		}
+	}
+
+	for _, region := range []string{testRegion, "galaxy-test-2"} {
+		path := filepath.Join(dir, "123456789012", region, "base.json")
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected a cache entry for %s: %s", region, err)
+		}
+	}
+
+	if err := BustSharedResourcesCache("base", "galaxy-test-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clients["west-key"].GetSharedResources("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(west.Requests("DescribeStacks")); n != 2 {
+		t.Errorf("expected the busted entry to be looked up again, got %d DescribeStacks requests", n)
+	}
+
+	if n := len(east.Requests("DescribeStacks")); n != 1 {
+		t.Errorf("expected the other region to stay cached, got %d DescribeStacks requests", n)
+	}
+}
+
+func TestSharedResourcesCacheExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	SharedResourcesCacheDir = dir
+	defer func() { SharedResourcesCacheDir = "" }()
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+	s.Handle("GetCallerIdentity", func(url.Values) (int, string) {
+		return http.StatusOK, callerIdentityXML("123456789012")
+	})
+
+	c := NewClient(testRegion)
+	lookup := func(describes int) {
+		if _, err := c.GetSharedResources("base"); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(s.Requests("DescribeStacks")); n != describes {
+			t.Errorf("expected %d DescribeStacks requests, got %d", describes, n)
+		}
+		// the account is only looked up once to find the cache entry
+		if n := len(s.Requests("GetCallerIdentity")); n != 1 {
+			t.Errorf("expected 1 GetCallerIdentity request, got %d", n)
+		}
+	}
+
+	lookup(1)
+	lookup(1)
+
+	// an entry older than the TTL is looked up again
+	old := time.Now().Add(-SharedResourcesCacheTTL - time.Minute)
+	path := filepath.Join(dir, "123456789012", testRegion, "base.json")
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	lookup(2)
+	lookup(2)
+}
+
+func TestDescribeStacksCache(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "CREATE_COMPLETE")
+
+	c := &Client{DescribeStacksCacheTTL: 50 * time.Millisecond}
+	describe := func(expected int) {
+		if _, err := c.DescribeStacks("test"); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(s.Requests("DescribeStacks")); n != expected {
+			t.Errorf("expected %d DescribeStacks requests, got %d", expected, n)
+		}
+	}
+
+	describe(1)
+	// within the TTL the response is reused
+	describe(1)
+
+	// other stacks are cached separately
+	if _, err := c.DescribeStacks("other"); err != nil {
+		t.Fatal(err)
+	}
+	describe(2)
+
+	time.Sleep(60 * time.Millisecond)
+	describe(3)
+
+	// waiting always describes the stack again
+	if err := c.Wait("test", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	describe(4)
+}
+
+func TestDescribeStacksCacheSetTags(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// the stack's tags, as changed by each UpdateStack
+	var mu sync.Mutex
+	tags := map[string]string{"Name": "test"}
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		members := ""
+		for _, key := range sortedKeys(tags) {
+			members += fmt.Sprintf("<member><Key>%s</Key><Value>%s</Value></member>", key, tags[key])
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStacksResponse><DescribeStacksResult><Stacks><member>
+  <StackName>test</StackName><StackStatus>UPDATE_COMPLETE</StackStatus><Tags>%s</Tags>
+</member></Stacks></DescribeStacksResult></DescribeStacksResponse>`, members)
+	})
+	s.Handle("UpdateStack", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		tags = map[string]string{}
+		for i := 1; params.Get(fmt.Sprintf("Tags.member.%d.Key", i)) != ""; i++ {
+			tags[params.Get(fmt.Sprintf("Tags.member.%d.Key", i))] = params.Get(fmt.Sprintf("Tags.member.%d.Value", i))
+		}
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	c := &Client{DescribeStacksCacheTTL: time.Hour}
+	if _, err := c.DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// each SetTags merges onto the stack's current tags, not the cached ones
+	if err := c.SetTags("test", map[string]string{"env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetTags("test", map[string]string{"owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"Name": "test", "env": "prod", "owner": "ops"}
+	mu.Lock()
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags = %v, want %v", tags, expected)
+	}
+	mu.Unlock()
+
+	// and the changed stack isn't described from the cache
+	desc, err := c.DescribeStacks("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.Stacks) != 1 || !reflect.DeepEqual(desc.Stacks[0].TagsMap(), expected) {
+		t.Errorf("expected the stack to be described again, got %#v", desc.Stacks)
+	}
+}
+
+func TestDescribeStacksCacheForget(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	var mu sync.Mutex
+	status := "UPDATE_IN_PROGRESS"
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+	s.Handle("CancelUpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<CancelUpdateStackResponse/>`
+	})
+	s.Handle("ExecuteChangeSet", func(url.Values) (int, string) {
+		return http.StatusOK, `<ExecuteChangeSetResponse><ExecuteChangeSetResult/></ExecuteChangeSetResponse>`
+	})
+
+	c := &Client{DescribeStacksCacheTTL: time.Hour}
+	id := "arn:aws:cloudformation:" + testRegion + ":123456789012:stack/test/1"
+
+	// Check that the stack is described with the given status, however it's
+	// looked up
+	check := func(expected string) {
+		for _, name := range []string{"test", id, ""} {
+			desc, err := c.DescribeStacks(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(desc.Stacks) != 1 || desc.Stacks[0].Status != expected {
+				t.Errorf("DescribeStacks(%q): expected %s, got %#v", name, expected, desc.Stacks)
+			}
+		}
+	}
+
+	check("UPDATE_IN_PROGRESS")
+
+	for _, tc := range []struct {
+		status string
+		change func() error
+	}{
+		{"UPDATE_ROLLBACK_IN_PROGRESS", func() error { return c.CancelUpdate("test") }},
+		{"UPDATE_COMPLETE", func() error { return c.ExecuteChangeSet("test", "deploy") }},
+	} {
+		mu.Lock()
+		status = tc.status
+		mu.Unlock()
+
+		if err := tc.change(); err != nil {
+			t.Fatal(err)
+		}
+		check(tc.status)
+	}
+}
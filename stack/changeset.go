@@ -0,0 +1,339 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type CreateChangeSetResponse struct {
+	RequestId string `xml:"ResponseMetadata>RequestId"`
+	Id        string `xml:"CreateChangeSetResult>Id"`
+	StackId   string `xml:"CreateChangeSetResult>StackId"`
+}
+
+// A ResourceToImport identifies an existing resource to be brought under the
+// management of a stack by ImportResources.
+type ResourceToImport struct {
+	ResourceType      string
+	LogicalResourceId string
+	// The properties which identify the resource, e.g.
+	// {"BucketName": "my-bucket"} for an AWS::S3::Bucket
+	ResourceIdentifier map[string]string
+}
+
+// Create a change set importing existing resources into a stack. The
+// template body must contain the stack's current resources, along with each
+// resource to import with a DeletionPolicy. The change set's ID is returned,
+// and the change set must be executed to complete the import.
+func (c *Client) ImportResources(stackName string, body []byte, resourcesToImport []ResourceToImport) (string, error) {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return "", err
+	}
+	c.logTemplate(stackName, body)
+
+	params := map[string]string{
+		"Action":        "CreateChangeSet",
+		"StackName":     stackName,
+		"ChangeSetName": fmt.Sprintf("%s-import-%d", stackName, time.Now().Unix()),
+		"ChangeSetType": "IMPORT",
+		"TemplateBody":  string(body),
+	}
+
+	for i, res := range resourcesToImport {
+		prefix := fmt.Sprintf("ResourcesToImport.member.%d.", i+1)
+		params[prefix+"ResourceType"] = res.ResourceType
+		params[prefix+"LogicalResourceId"] = res.LogicalResourceId
+
+		for j, key := range sortedKeys(res.ResourceIdentifier) {
+			params[fmt.Sprintf("%sResourceIdentifier.entry.%d.key", prefix, j+1)] = key
+			params[fmt.Sprintf("%sResourceIdentifier.entry.%d.value", prefix, j+1)] = res.ResourceIdentifier[key]
+		}
+	}
+
+	csResp := CreateChangeSetResponse{}
+	if err := query(svc, params, &csResp); err != nil {
+		return "", err
+	}
+	c.forgetDescribeStacks(stackName)
+
+	return csResp.Id, nil
+}
+
+// ErrNoChanges is returned when waiting on a change set which failed only
+// because it contained no changes, which callers can usually treat as success.
+var ErrNoChanges = fmt.Errorf("change set contains no changes")
+
+// ErrNoUpdates is returned by ApplyViaChangeSet when the template and
+// parameters would not change the stack. It's the same error as ErrNoChanges,
+// so either can be checked.
+var ErrNoUpdates = ErrNoChanges
+
+type DescribeChangeSetResponse struct {
+	RequestId       string `xml:"ResponseMetadata>RequestId"`
+	ChangeSetId     string `xml:"DescribeChangeSetResult>ChangeSetId"`
+	ChangeSetName   string `xml:"DescribeChangeSetResult>ChangeSetName"`
+	StackId         string `xml:"DescribeChangeSetResult>StackId"`
+	Status          string `xml:"DescribeChangeSetResult>Status"`
+	StatusReason    string `xml:"DescribeChangeSetResult>StatusReason"`
+	ExecutionStatus string `xml:"DescribeChangeSetResult>ExecutionStatus"`
+
+	Changes   []ResourceChange `xml:"DescribeChangeSetResult>Changes>member>ResourceChange"`
+	NextToken string           `xml:"DescribeChangeSetResult>NextToken"`
+}
+
+// A ResourceChange is a change a change set will make to one resource.
+type ResourceChange struct {
+	// Add, Modify, Remove, Import or Dynamic
+	Action             string `xml:"Action"`
+	LogicalResourceId  string `xml:"LogicalResourceId"`
+	PhysicalResourceId string `xml:"PhysicalResourceId"`
+	ResourceType       string `xml:"ResourceType"`
+	// For a Modify: True if the resource will be destroyed and recreated,
+	// Conditional if it may be, or False
+	Replacement string `xml:"Replacement"`
+}
+
+// Create a change set for a stack, creating the stack if it doesn't exist.
+// Options are sent as stack parameters, except for tag.KEY options which are
+// set as tags on the change set, and carried into the stack when it's
+// executed. The change set's ID is returned.
+func (c *Client) CreateChangeSet(stackName, changeSetName string, body []byte, options map[string]string) (string, error) {
+	if err := checkTemplateSize(body); err != nil {
+		return "", err
+	}
+
+	changeSetType := "UPDATE"
+	if _, err := c.describeStacks(stackName); isNotExist(err) {
+		changeSetType = "CREATE"
+	} else if err != nil {
+		return "", err
+	}
+
+	svc, err := c.getService("cf")
+	if err != nil {
+		return "", err
+	}
+	c.logTemplate(stackName, body)
+
+	params := map[string]string{
+		"Action":        "CreateChangeSet",
+		"StackName":     stackName,
+		"ChangeSetName": changeSetName,
+		"ChangeSetType": changeSetType,
+		"TemplateBody":  string(body),
+	}
+
+	if err := setRollbackConfiguration(params, options); err != nil {
+		return "", err
+	}
+
+	optNum := 1
+	tagNum := 1
+	for _, key := range sortedKeys(options) {
+		val := options[key]
+		if nonParameterOptions[key] {
+			continue
+		}
+
+		if tagKey, ok := tagOption(key); ok {
+			setTagParam(params, tagNum, tagKey, val)
+			tagNum++
+			continue
+		}
+
+		params[fmt.Sprintf("Parameters.member.%d.ParameterKey", optNum)] = key
+		params[fmt.Sprintf("Parameters.member.%d.ParameterValue", optNum)] = val
+		optNum++
+	}
+
+	csResp := CreateChangeSetResponse{}
+	if err := query(svc, params, &csResp); err != nil {
+		return "", err
+	}
+	// a new stack is created in REVIEW_IN_PROGRESS
+	c.forgetDescribeStacks(stackName)
+	return csResp.Id, nil
+}
+
+func (c *Client) DescribeChangeSet(stackName, changeSetName string) (DescribeChangeSetResponse, error) {
+	return c.describeChangeSet(stackName, changeSetName, "")
+}
+
+// Describe one page of a change set's changes, starting from nextToken.
+func (c *Client) describeChangeSet(stackName, changeSetName, nextToken string) (DescribeChangeSetResponse, error) {
+	descResp := DescribeChangeSetResponse{}
+
+	svc, err := c.getService("cf")
+	if err != nil {
+		return descResp, err
+	}
+
+	params := map[string]string{
+		"Action":        "DescribeChangeSet",
+		"StackName":     stackName,
+		"ChangeSetName": changeSetName,
+	}
+	if nextToken != "" {
+		params["NextToken"] = nextToken
+	}
+
+	err = query(svc, params, &descResp)
+	return descResp, err
+}
+
+func (c *Client) ExecuteChangeSet(stackName, changeSetName string) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{
+		"Action":        "ExecuteChangeSet",
+		"StackName":     stackName,
+		"ChangeSetName": changeSetName,
+	}
+
+	if err := query(svc, params, &struct{}{}); err != nil {
+		return err
+	}
+	c.forgetDescribeStacks(stackName)
+	return nil
+}
+
+// Delete a change set which won't be executed, e.g. one which failed, so that
+// its name can be used again.
+func (c *Client) DeleteChangeSet(stackName, changeSetName string) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{
+		"Action":        "DeleteChangeSet",
+		"StackName":     stackName,
+		"ChangeSetName": changeSetName,
+	}
+
+	return query(svc, params, &struct{}{})
+}
+
+// Wait for a change set to be created and ready to execute. A change set
+// without any changes returns ErrNoChanges, and any other failure returns an
+// error with the change set's StatusReason.
+func (c *Client) WaitForChangeSet(stackName, changeSetName string, timeout time.Duration) error {
+	_, err := c.waitForChangeSet(stackName, changeSetName, timeout)
+	return err
+}
+
+// waitForChangeSet implements WaitForChangeSet, also returning the change
+// set's final description.
+func (c *Client) waitForChangeSet(stackName, changeSetName string, timeout time.Duration) (DescribeChangeSetResponse, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		desc, err := c.DescribeChangeSet(stackName, changeSetName)
+		if err != nil {
+			return desc, err
+		}
+
+		switch desc.Status {
+		case "CREATE_COMPLETE":
+			return desc, nil
+		case "FAILED":
+			if isEmptyChangeSet(desc) {
+				return desc, ErrNoChanges
+			}
+			return desc, fmt.Errorf("change set %s failed: %s", changeSetName, desc.StatusReason)
+		}
+
+		if time.Now().After(deadline) {
+			return desc, ErrTimeout
+		}
+
+		sleep(pollInterval)
+	}
+}
+
+// How long ChangeSetImpact waits for a change set to be created
+var changeSetTimeout = 5 * time.Minute
+
+// Wait for a change set to be ready, and return the logical IDs of the
+// resources it will add, modify, and remove. Resources which will be, or may
+// be, destroyed and recreated are listed in replaced rather than modified, so
+// that dangerous changes can be caught before the change set is executed. A
+// change set without any changes returns empty lists.
+func (c *Client) ChangeSetImpact(stackName, changeSetName string) (added, modified, removed, replaced []string, err error) {
+	desc, err := c.waitForChangeSet(stackName, changeSetName, changeSetTimeout)
+	if err == ErrNoChanges {
+		return nil, nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	changes := desc.Changes
+	for pages := 1; desc.NextToken != ""; pages++ {
+		if pages >= MaxPages {
+			return nil, nil, nil, nil, ErrMaxPages
+		}
+
+		desc, err = c.describeChangeSet(stackName, changeSetName, desc.NextToken)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		changes = append(changes, desc.Changes...)
+	}
+
+	for _, change := range changes {
+		id := change.LogicalResourceId
+		switch {
+		case change.Action == "Add":
+			added = append(added, id)
+		case change.Action == "Remove":
+			removed = append(removed, id)
+		case change.Replacement == "True" || change.Replacement == "Conditional":
+			replaced = append(replaced, id)
+		default:
+			modified = append(modified, id)
+		}
+	}
+	return added, modified, removed, replaced, nil
+}
+
+// Check if a change set failed only because it contained no changes
+func isEmptyChangeSet(desc DescribeChangeSetResponse) bool {
+	return desc.Status == "FAILED" &&
+		(strings.Contains(desc.StatusReason, "didn't contain changes") ||
+			strings.Contains(desc.StatusReason, "No updates are to be performed"))
+}
+
+// Create a change set, wait for it to be ready, execute it, and wait for the
+// stack to complete, all within the timeout. Options are the same as for
+// CreateChangeSet. If there are no changes to make, ErrNoUpdates is returned
+// and the stack is left as it is. A change set which fails, including one
+// without changes, is deleted so that the same changeSetName can be applied
+// again.
+func (c *Client) ApplyViaChangeSet(stackName, changeSetName string, body []byte, options map[string]string, timeout time.Duration) error {
+	start := time.Now()
+
+	if _, err := c.CreateChangeSet(stackName, changeSetName, body, options); err != nil {
+		return err
+	}
+
+	desc, err := c.waitForChangeSet(stackName, changeSetName, timeout)
+	if desc.Status == "FAILED" {
+		if err := c.DeleteChangeSet(stackName, changeSetName); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.ExecuteChangeSet(stackName, changeSetName); err != nil {
+		return err
+	}
+
+	return c.Wait(stackName, timeout-time.Since(start))
+}
@@ -0,0 +1,311 @@
+package stack
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportResources(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateChangeSet", func(url.Values) (int, string) {
+		return http.StatusOK, `<CreateChangeSetResponse>
+  <CreateChangeSetResult>
+    <Id>arn:aws:cloudformation:galaxy-test-1:123456789012:changeSet/import/1</Id>
+    <StackId>arn:aws:cloudformation:galaxy-test-1:123456789012:stack/test/1</StackId>
+  </CreateChangeSetResult>
+</CreateChangeSetResponse>`
+	})
+
+	imports := []ResourceToImport{
+		{
+			ResourceType:       "AWS::S3::Bucket",
+			LogicalResourceId:  "Logs",
+			ResourceIdentifier: map[string]string{"BucketName": "galaxy-logs"},
+		},
+	}
+
+	id, err := ImportResources("test", []byte("{}"), imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "arn:aws:cloudformation:galaxy-test-1:123456789012:changeSet/import/1" {
+		t.Errorf("unexpected change set id: %s", id)
+	}
+
+	reqs := s.Requests("CreateChangeSet")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 CreateChangeSet request, got %d", len(reqs))
+	}
+	req := reqs[0]
+
+	expected := map[string]string{
+		"StackName":     "test",
+		"ChangeSetType": "IMPORT",
+		"TemplateBody":  "{}",
+		"ResourcesToImport.member.1.ResourceType":                     "AWS::S3::Bucket",
+		"ResourcesToImport.member.1.LogicalResourceId":                "Logs",
+		"ResourcesToImport.member.1.ResourceIdentifier.entry.1.key":   "BucketName",
+		"ResourcesToImport.member.1.ResourceIdentifier.entry.1.value": "galaxy-logs",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+
+	if !strings.HasPrefix(req.Get("ChangeSetName"), "test-import-") {
+		t.Errorf("unexpected ChangeSetName: %s", req.Get("ChangeSetName"))
+	}
+}
+
+func TestCreateChangeSetTags(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "", "CREATE_COMPLETE")
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id test does not exist")
+	})
+
+	options := map[string]string{
+		"KeyName":        "key",
+		"tag.env":        "dev",
+		"Tag.team":       "web",
+		"RetryIAMErrors": "true",
+	}
+	if _, err := CreateChangeSet("test", "deploy", []byte("{}"), options); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("CreateChangeSet")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 CreateChangeSet request, got %d", len(reqs))
+	}
+
+	expected := map[string]string{
+		"ChangeSetType":                      "CREATE",
+		"Parameters.member.1.ParameterKey":   "KeyName",
+		"Parameters.member.1.ParameterValue": "key",
+		"Tags.member.1.Key":                  "team",
+		"Tags.member.1.Value":                "web",
+		"Tags.member.2.Key":                  "env",
+		"Tags.member.2.Value":                "dev",
+	}
+	for k, v := range expected {
+		if reqs[0].Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, reqs[0].Get(k), v)
+		}
+	}
+
+	for k := range reqs[0] {
+		if strings.HasPrefix(k, "Parameters.member.2.") || strings.HasPrefix(k, "Tags.member.3.") {
+			t.Errorf("unexpected param %s", k)
+		}
+	}
+}
+
+// Respond to each DescribeChangeSet with the next status, repeating the last,
+// and accept any CreateChangeSet and ExecuteChangeSet.
+func handleChangeSet(s *testServer, reason string, statuses ...string) {
+	s.Handle("CreateChangeSet", func(url.Values) (int, string) {
+		return http.StatusOK, `<CreateChangeSetResponse>
+  <CreateChangeSetResult>
+    <Id>arn:aws:cloudformation:galaxy-test-1:123456789012:changeSet/deploy/1</Id>
+    <StackId>arn:aws:cloudformation:galaxy-test-1:123456789012:stack/test/1</StackId>
+  </CreateChangeSetResult>
+</CreateChangeSetResponse>`
+	})
+
+	s.Handle("DescribeChangeSet", func(url.Values) (int, string) {
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeChangeSetResponse>
+  <DescribeChangeSetResult>
+    <ChangeSetName>deploy</ChangeSetName>
+    <Status>%s</Status>
+    <StatusReason>%s</StatusReason>
+  </DescribeChangeSetResult>
+</DescribeChangeSetResponse>`, status, reason)
+	})
+
+	s.Handle("ExecuteChangeSet", func(url.Values) (int, string) {
+		return http.StatusOK, `<ExecuteChangeSetResponse><ExecuteChangeSetResult/></ExecuteChangeSetResponse>`
+	})
+
+	s.Handle("DeleteChangeSet", func(url.Values) (int, string) {
+		return http.StatusOK, `<DeleteChangeSetResponse><DeleteChangeSetResult/></DeleteChangeSetResponse>`
+	})
+}
+
+func TestApplyViaChangeSet(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "", "CREATE_PENDING", "CREATE_IN_PROGRESS", "CREATE_COMPLETE")
+	handleStatuses(s, "test", "UPDATE_COMPLETE", "UPDATE_IN_PROGRESS", "UPDATE_COMPLETE")
+
+	options := map[string]string{"KeyName": "key", "tag.env": "dev"}
+	if err := ApplyViaChangeSet("test", "deploy", []byte("{}"), options, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("CreateChangeSet")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 CreateChangeSet request, got %d", len(reqs))
+	}
+
+	expected := map[string]string{
+		"ChangeSetName":                      "deploy",
+		"ChangeSetType":                      "UPDATE",
+		"Parameters.member.1.ParameterKey":   "KeyName",
+		"Parameters.member.1.ParameterValue": "key",
+		"Tags.member.1.Key":                  "env",
+		"Tags.member.1.Value":                "dev",
+	}
+	for k, v := range expected {
+		if reqs[0].Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, reqs[0].Get(k), v)
+		}
+	}
+
+	execs := s.Requests("ExecuteChangeSet")
+	if len(execs) != 1 || execs[0].Get("ChangeSetName") != "deploy" {
+		t.Errorf("unexpected ExecuteChangeSet requests: %v", execs)
+	}
+
+	if n := len(s.Requests("DescribeStacks")); n != 3 {
+		t.Errorf("expected to wait for the stack update, got %d DescribeStacks requests", n)
+	}
+}
+
+func TestApplyViaChangeSetNoChanges(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "The submitted information didn't contain changes. Submit different information to create a change set.",
+		"CREATE_IN_PROGRESS", "FAILED")
+	handleStatuses(s, "test", "UPDATE_COMPLETE")
+
+	err := ApplyViaChangeSet("test", "deploy", []byte("{}"), nil, time.Second)
+	if err != ErrNoUpdates || err != ErrNoChanges {
+		t.Fatalf("expected ErrNoUpdates, got %v", err)
+	}
+
+	if n := len(s.Requests("ExecuteChangeSet")); n != 0 {
+		t.Errorf("expected no ExecuteChangeSet requests, got %d", n)
+	}
+
+	// the empty change set is deleted, so the next apply can use its name
+	deletes := s.Requests("DeleteChangeSet")
+	if len(deletes) != 1 || deletes[0].Get("ChangeSetName") != "deploy" || deletes[0].Get("StackName") != "test" {
+		t.Errorf("unexpected DeleteChangeSet requests: %v", deletes)
+	}
+}
+
+func TestApplyViaChangeSetFailed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "Template format error: Unresolved resource dependencies [VPC]", "FAILED")
+	handleStatuses(s, "test", "UPDATE_COMPLETE")
+
+	err := ApplyViaChangeSet("test", "deploy", []byte("{}"), nil, time.Second)
+	if err == nil || err == ErrNoUpdates {
+		t.Fatalf("expected a change set failure, got %v", err)
+	}
+
+	if n := len(s.Requests("DeleteChangeSet")); n != 1 {
+		t.Errorf("expected the failed change set to be deleted, got %d DeleteChangeSet requests", n)
+	}
+}
+
+func TestWaitForChangeSetNoChanges(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "The submitted information didn't contain changes. Submit different information to create a change set.",
+		"CREATE_PENDING", "FAILED")
+
+	if err := WaitForChangeSet("test", "deploy", time.Second); err != ErrNoChanges {
+		t.Fatalf("expected ErrNoChanges, got %v", err)
+	}
+}
+
+func TestWaitForChangeSetFailed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleChangeSet(s, "Template format error: Unresolved resource dependencies [VPC]", "FAILED")
+
+	err := WaitForChangeSet("test", "deploy", time.Second)
+	if err == nil || err == ErrNoChanges {
+		t.Fatalf("expected a change set failure, got %v", err)
+	}
+
+	expected := "change set deploy failed: Template format error: Unresolved resource dependencies [VPC]"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err)
+	}
+}
+
+func TestChangeSetImpact(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	change := func(action, id, replacement string) string {
+		return fmt.Sprintf(`<member><Type>Resource</Type><ResourceChange>
+  <Action>%s</Action>
+  <LogicalResourceId>%s</LogicalResourceId>
+  <Replacement>%s</Replacement>
+</ResourceChange></member>`, action, id, replacement)
+	}
+
+	s.Handle("DescribeChangeSet", func(params url.Values) (int, string) {
+		changes, next := "", ""
+		if params.Get("NextToken") == "" {
+			changes = change("Add", "workerASG", "") + change("Modify", "webASG", "False") + change("Modify", "webLC", "True")
+			next = "<NextToken>page2</NextToken>"
+		} else {
+			changes = change("Remove", "oldELB", "") + change("Modify", "webELB", "Conditional") + change("Dynamic", "webDNS", "")
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeChangeSetResponse>
+  <DescribeChangeSetResult>
+    <Status>CREATE_COMPLETE</Status>
+    <Changes>%s</Changes>%s
+  </DescribeChangeSetResult>
+</DescribeChangeSetResponse>`, changes, next)
+	})
+
+	added, modified, removed, replaced, err := ChangeSetImpact("test", "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"added", added, []string{"workerASG"}},
+		{"modified", modified, []string{"webASG", "webDNS"}},
+		{"removed", removed, []string{"oldELB"}},
+		{"replaced", replaced, []string{"webLC", "webELB"}},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.expected) {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.expected)
+		}
+	}
+
+	if reqs := s.Requests("DescribeChangeSet"); len(reqs) != 2 || reqs[1].Get("NextToken") != "page2" {
+		t.Errorf("expected the second page to be requested, got %v", reqs)
+	}
+}
@@ -0,0 +1,507 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+
+	"github.com/litl/galaxy/log"
+)
+
+// A Client makes all of its requests to a single AWS region, allowing one
+// process to manage stacks in multiple regions.
+type Client struct {
+	// The region used for all requests. If empty, the region is taken from
+	// the environment, or the package level Region.
+	Region string
+
+	// Explicit credentials for all requests. If the keys are empty,
+	// credentials are found from the environment, the shared credentials
+	// file, or the instance role.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// If set, the credentials for every request are taken from this provider,
+	// and the keys above are ignored.
+	Credentials CredentialProvider
+
+	// If set, JSON templates are logged at the debug level, re-indented to
+	// be readable, before they're sent. The template sent is unchanged.
+	PrettyLogTemplates bool
+
+	// How failed requests are retried. If nil, DefaultRetryPolicy is used.
+	// MaxAttempts and Retryable apply to throttled requests and server
+	// errors; retries of IAM errors and of Wait's polling only use the
+	// policy's delays.
+	RetryPolicy *RetryPolicy
+
+	// If set, DescribeStacks responses are reused for this long, so that
+	// repeated describes of the same stacks, e.g. from a dashboard, don't each
+	// make a request. Waiting on a stack, or reading it in order to change
+	// it, always describes it afresh, and changing a stack drops its cached
+	// responses.
+	DescribeStacksCacheTTL time.Duration
+
+	// If set, all requests are made through this service rather than to AWS.
+	// See NewClientWithService.
+	service Queryer
+
+	// the exports cached by GetExport
+	exportsMu     sync.Mutex
+	exports       map[string]string
+	exportsListed time.Time
+
+	// the responses cached by DescribeStacks, keyed by region and name
+	describeMu    sync.Mutex
+	describeCache map[string]describeCacheEntry
+
+	// the live regions cached by ValidateRegionLive
+	regionsMu     sync.Mutex
+	regions       map[string]bool
+	regionsListed time.Time
+
+	// the account ID found by GetCallerIdentity, for the SharedResources cache
+	accountMu sync.Mutex
+	account   string
+}
+
+func NewClient(region string) *Client {
+	return &Client{
+		Region: region,
+	}
+}
+
+// Return a Client which makes all of its requests through svc, e.g. a fake
+// for testing code which uses this package. Requests are still logged, and
+// responses decoded, as they would be from AWS.
+func NewClientWithService(region string, svc Queryer) *Client {
+	return &Client{
+		Region:  region,
+		service: svc,
+	}
+}
+
+// The client used by the package level functions
+var defaultClient = &Client{}
+
+func (c *Client) getService(service string) (Queryer, error) {
+	reg, err := c.awsRegion()
+	if err != nil {
+		return nil, err
+	}
+	return c.regionService(service, reg)
+}
+
+// Return the service for a region which has already been looked up.
+func (c *Client) regionService(service string, reg *aws.Region) (Queryer, error) {
+	if c.service != nil {
+		return &awsService{Queryer: c.service, region: reg.Name}, nil
+	}
+
+	auth, err := c.getAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	return newService(service, reg, auth)
+}
+
+func (c *Client) getAuth() (aws.Auth, error) {
+	if c.Credentials != nil {
+		return c.Credentials.Credentials()
+	}
+	return EnvCredentials{
+		AccessKey:    c.AccessKey,
+		SecretKey:    c.SecretKey,
+		SessionToken: c.SessionToken,
+	}.Credentials()
+}
+
+// A CredentialProvider supplies the credentials for a Client, e.g. from a
+// secret store. It's consulted for every request, so any caching or refreshing
+// of the credentials is up to the provider.
+type CredentialProvider interface {
+	Credentials() (aws.Auth, error)
+}
+
+// EnvCredentials is the CredentialProvider used by a Client without one. If
+// the keys are empty, credentials are found from the environment, the shared
+// credentials file, or the instance role.
+type EnvCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+func (e EnvCredentials) Credentials() (aws.Auth, error) {
+	// The auth is rebuilt for every service, so the expiration only needs to
+	// outlast the request. An expired token would be replaced from the
+	// environment.
+	return aws.GetAuth(e.AccessKey, e.SecretKey, e.SessionToken, time.Now().Add(time.Hour))
+}
+
+// Make a request, and decode the response into v
+func query(svc Queryer, params map[string]string, v interface{}) error {
+	return queryMethod(svc, "POST", "/", params, v)
+}
+
+// Make a request to a path on the service's endpoint, and decode the response
+// into v
+func queryPath(svc Queryer, path string, params map[string]string, v interface{}) error {
+	return queryMethod(svc, "POST", path, params, v)
+}
+
+// Make a request with the given HTTP method, and decode the response into v.
+// An error response is returned as the service's error.
+func queryMethod(svc Queryer, method, path string, params map[string]string, v interface{}) error {
+	resp, err := svc.Query(method, path, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return svc.BuildError(resp)
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// Log a template being sent for a stack, if PrettyLogTemplates is set.
+// Templates which aren't JSON, like YAML, aren't logged.
+func (c *Client) logTemplate(name string, body []byte) {
+	if !c.PrettyLogTemplates {
+		return
+	}
+
+	pretty := &bytes.Buffer{}
+	if err := json.Indent(pretty, body, "", "  "); err != nil {
+		return
+	}
+	log.Debugf("template for %s:\n%s", name, pretty)
+}
+
+// The package level functions below all use the default region.
+
+func StackParameters(name string) (map[string]string, []string, error) {
+	return defaultClient.StackParameters(name)
+}
+
+func GetPool(name string) (*Pool, error) {
+	return defaultClient.GetPool(name)
+}
+
+func GetPoolProcessed(name string) (*Pool, error) {
+	return defaultClient.GetPoolProcessed(name)
+}
+
+func CreatePool(baseStack, poolName string, pool *Pool, options map[string]string) (*CreateStackResponse, error) {
+	return defaultClient.CreatePool(baseStack, poolName, pool, options)
+}
+
+func UpdatePool(name string, pool *Pool, options map[string]string) (*UpdateStackResponse, error) {
+	return defaultClient.UpdatePool(name, pool, options)
+}
+
+func GetStackVPC(stackName string) (string, error) {
+	return defaultClient.GetStackVPC(stackName)
+}
+
+func GetStackVPCs(stackName string) ([]string, error) {
+	return defaultClient.GetStackVPCs(stackName)
+}
+
+func ListStackResources(stackName string) (ListStackResourcesResponse, error) {
+	return defaultClient.ListStackResources(stackName)
+}
+
+func StackResourceSummary(name string) (map[string]int, error) {
+	return defaultClient.StackResourceSummary(name)
+}
+
+func DescribeStackResource(stackName, logicalID string) (DescribeStackResourceResponse, error) {
+	return defaultClient.DescribeStackResource(stackName, logicalID)
+}
+
+func AllResourcesDetailed(name string) ([]stackResourceDetail, error) {
+	return defaultClient.AllResourcesDetailed(name)
+}
+
+func GetResourceMetadata(stackName, logicalID string) (string, error) {
+	return defaultClient.GetResourceMetadata(stackName, logicalID)
+}
+
+func DescribeStacks(name string) (DescribeStacksResponse, error) {
+	return defaultClient.DescribeStacks(name)
+}
+
+func DescribeStackEvents(name string) (DescribeStackEventsResult, error) {
+	return defaultClient.DescribeStackEvents(name)
+}
+
+func StackEventsSince(name, lastEventID string) ([]stackEvent, error) {
+	return defaultClient.StackEventsSince(name, lastEventID)
+}
+
+func TailEvents(ctx context.Context, name string, interval time.Duration) (<-chan stackEvent, <-chan error) {
+	return defaultClient.TailEvents(ctx, name, interval)
+}
+
+func ListActive() ([]string, error) {
+	return defaultClient.ListActive()
+}
+
+func ListActiveWithOptions(options map[string]string) ([]string, error) {
+	return defaultClient.ListActiveWithOptions(options)
+}
+
+func List() (ListStacksResponse, error) {
+	return defaultClient.List()
+}
+
+func ListByPrefix(prefix string) ([]stackSummary, error) {
+	return defaultClient.ListByPrefix(prefix)
+}
+
+func Exists(name string) (bool, error) {
+	return defaultClient.Exists(name)
+}
+
+func ExistsByID(stackID string) (bool, error) {
+	return defaultClient.ExistsByID(stackID)
+}
+
+func Wait(name string, timeout time.Duration) error {
+	return defaultClient.Wait(name, timeout)
+}
+
+func WaitWithOptions(name string, timeout time.Duration, options map[string]string) error {
+	return defaultClient.WaitWithOptions(name, timeout, options)
+}
+
+func WaitAndDescribe(name string, timeout time.Duration) (stackDescription, error) {
+	return defaultClient.WaitAndDescribe(name, timeout)
+}
+
+func WaitContext(ctx context.Context, name string, timeout time.Duration) error {
+	return defaultClient.WaitContext(ctx, name, timeout)
+}
+
+func WaitAll(ctx context.Context, names []string, timeout time.Duration) map[string]error {
+	return defaultClient.WaitAll(ctx, names, timeout)
+}
+
+func WaitWithProgress(name string, timeout time.Duration, onProgress func(done, total int)) error {
+	return defaultClient.WaitWithProgress(name, timeout, onProgress)
+}
+
+func WaitWithStatus(name string, timeout time.Duration, onStatus func(status, reason string)) error {
+	return defaultClient.WaitWithStatus(name, timeout, onStatus)
+}
+
+func ListFailures(id string, since time.Time) ([]string, error) {
+	return defaultClient.ListFailures(id, since)
+}
+
+func ListFailureEvents(id string, since time.Time) ([]stackEvent, error) {
+	return defaultClient.ListFailureEvents(id, since)
+}
+
+func WaitViaSQS(queueURL string, stackName string, timeout time.Duration) error {
+	return defaultClient.WaitViaSQS(queueURL, stackName, timeout)
+}
+
+func WaitForComplete(id string, timeout time.Duration) error {
+	return defaultClient.WaitForComplete(id, timeout)
+}
+
+func WaitForUpdate(name string, timeout time.Duration) error {
+	return defaultClient.WaitForUpdate(name, timeout)
+}
+
+func AbortUpdate(name string, timeout time.Duration) error {
+	return defaultClient.AbortUpdate(name, timeout)
+}
+
+func WaitForDelete(name string, timeout time.Duration) error {
+	return defaultClient.WaitForDelete(name, timeout)
+}
+
+func DescribeAvailabilityZones(region string) (DescribeAvailabilityZonesResponse, error) {
+	return NewClient(region).DescribeAvailabilityZones()
+}
+
+func ValidateRegionLive(region string) error {
+	return defaultClient.ValidateRegionLive(region)
+}
+
+func DescribeRegions() (DescribeRegionsResponse, error) {
+	return defaultClient.DescribeRegions()
+}
+
+func DescribeAllRegions() (DescribeRegionsResponse, error) {
+	return defaultClient.DescribeAllRegions()
+}
+
+func DescribeSubnets(vpcID, region string) (DescribeSubnetsResponse, error) {
+	return NewClient(region).DescribeSubnets(vpcID)
+}
+
+func DescribeNatGateways(vpcID, region string) (DescribeNatGatewaysResponse, error) {
+	return NewClient(region).DescribeNatGateways(vpcID)
+}
+
+func DescribeRouteTables(vpcID, region string) (DescribeRouteTablesResponse, error) {
+	return NewClient(region).DescribeRouteTables(vpcID)
+}
+
+func DescribeInstances(filters map[string]string) ([]Instance, error) {
+	return defaultClient.DescribeInstances(filters)
+}
+
+func ListServerCertificates() (ListServerCertsResponse, error) {
+	return defaultClient.ListServerCertificates()
+}
+
+func GetSharedResources(stackName string) (SharedResources, error) {
+	return defaultClient.GetSharedResources(stackName)
+}
+
+func BustSharedResourcesCache(stackName, region string) error {
+	return NewClient(region).BustSharedResourcesCache(stackName)
+}
+
+func GetSharedResourcesMulti(stackNames ...string) (SharedResources, error) {
+	return defaultClient.GetSharedResourcesMulti(stackNames...)
+}
+
+func GetTemplate(name string) ([]byte, error) {
+	return defaultClient.GetTemplate(name)
+}
+
+func GetTemplateParsed(name string) (map[string]interface{}, error) {
+	return defaultClient.GetTemplateParsed(name)
+}
+
+func GetTemplateStage(name, stage string) ([]byte, error) {
+	return defaultClient.GetTemplateStage(name, stage)
+}
+
+func DescribeTemplate(name, stage string) (GetTemplateResponse, error) {
+	return defaultClient.DescribeTemplate(name, stage)
+}
+
+func ExportStack(name string) ([]byte, map[string]string, map[string]string, []string, error) {
+	return defaultClient.ExportStack(name)
+}
+
+func Create(name string, stackTmpl []byte, options map[string]string) (*CreateStackResponse, error) {
+	return defaultClient.Create(name, stackTmpl, options)
+}
+
+func CreateAndWait(name string, stackTmpl []byte, options map[string]string, timeout time.Duration) (*CreateStackResponse, error) {
+	return defaultClient.CreateAndWait(name, stackTmpl, options, timeout)
+}
+
+func Update(name string, stackTmpl []byte, options map[string]string) (*UpdateStackResponse, error) {
+	return defaultClient.Update(name, stackTmpl, options)
+}
+
+func CheckDrift(name string) error {
+	return defaultClient.CheckDrift(name)
+}
+
+func CanUpdate(name string) (bool, string, error) {
+	return defaultClient.CanUpdate(name)
+}
+
+func CanUpdateWithOptions(name string, options map[string]string) (bool, string, error) {
+	return defaultClient.CanUpdateWithOptions(name, options)
+}
+
+func CancelUpdate(name string) error {
+	return defaultClient.CancelUpdate(name)
+}
+
+func SetTags(name string, tags map[string]string) error {
+	return defaultClient.SetTags(name, tags)
+}
+
+func Delete(name string) (*DeleteStackResponse, error) {
+	return defaultClient.Delete(name)
+}
+
+func DeleteWithOptions(name string, options map[string]string) (*DeleteStackResponse, error) {
+	return defaultClient.DeleteWithOptions(name, options)
+}
+
+func DeleteAll(names []string) error {
+	return defaultClient.DeleteAll(names)
+}
+
+func ListExports() ([]stackExport, error) {
+	return defaultClient.ListExports()
+}
+
+func GetExport(name string) (string, error) {
+	return defaultClient.GetExport(name)
+}
+
+func ListImports(exportName string) ([]string, error) {
+	return defaultClient.ListImports(exportName)
+}
+
+func ImportResources(stackName string, body []byte, resourcesToImport []ResourceToImport) (string, error) {
+	return defaultClient.ImportResources(stackName, body, resourcesToImport)
+}
+
+func CreateChangeSet(stackName, changeSetName string, body []byte, options map[string]string) (string, error) {
+	return defaultClient.CreateChangeSet(stackName, changeSetName, body, options)
+}
+
+func DescribeChangeSet(stackName, changeSetName string) (DescribeChangeSetResponse, error) {
+	return defaultClient.DescribeChangeSet(stackName, changeSetName)
+}
+
+func WaitForChangeSet(stackName, changeSetName string, timeout time.Duration) error {
+	return defaultClient.WaitForChangeSet(stackName, changeSetName, timeout)
+}
+
+func ChangeSetImpact(stackName, changeSetName string) ([]string, []string, []string, []string, error) {
+	return defaultClient.ChangeSetImpact(stackName, changeSetName)
+}
+
+func ExecuteChangeSet(stackName, changeSetName string) error {
+	return defaultClient.ExecuteChangeSet(stackName, changeSetName)
+}
+
+func DeleteChangeSet(stackName, changeSetName string) error {
+	return defaultClient.DeleteChangeSet(stackName, changeSetName)
+}
+
+func ApplyViaChangeSet(stackName, changeSetName string, body []byte, options map[string]string, timeout time.Duration) error {
+	return defaultClient.ApplyViaChangeSet(stackName, changeSetName, body, options, timeout)
+}
+
+func UploadTemplate(bucket, key string, body []byte, region string) (string, error) {
+	return NewClient(region).UploadTemplate(bucket, key, body)
+}
+
+func Preflight(region string) error {
+	return NewClient(region).Preflight()
+}
+
+func GetCallerIdentity() (CallerIdentity, error) {
+	return defaultClient.GetCallerIdentity()
+}
+
+func SetPolicy(name string, policy []byte) error {
+	return defaultClient.SetPolicy(name, policy)
+}
@@ -0,0 +1,395 @@
+package stack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+
+	"github.com/litl/galaxy/log"
+)
+
+func TestClientRegion(t *testing.T) {
+	east := newRegionTestServer(t, "us-east-1")
+	defer east.Close()
+	west := newRegionTestServer(t, "us-west-2")
+	defer west.Close()
+
+	Region = "us-east-1"
+
+	west.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<CreateStackResponse>
+  <CreateStackResult><StackId>arn:aws:cloudformation:us-west-2:123456789012:stack/test/1</StackId></CreateStackResult>
+  <ResponseMetadata><RequestId>create-request</RequestId></ResponseMetadata>
+</CreateStackResponse>`
+	})
+
+	client := NewClient("us-west-2")
+	resp, err := client.Create("test", []byte("{}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StackId != "arn:aws:cloudformation:us-west-2:123456789012:stack/test/1" {
+		t.Errorf("unexpected StackId: %s", resp.StackId)
+	}
+
+	if n := len(west.Requests("CreateStack")); n != 1 {
+		t.Errorf("expected 1 CreateStack request in us-west-2, got %d", n)
+	}
+
+	if n := len(east.Requests("CreateStack")); n != 0 {
+		t.Errorf("expected no CreateStack requests in us-east-1, got %d", n)
+	}
+}
+
+func TestClientSharedResourcesRegion(t *testing.T) {
+	east := newTestServer(t)
+	defer east.Close()
+	west := newRegionTestServer(t, "galaxy-test-2")
+	defer west.Close()
+
+	handleSharedResources(west, "base")
+
+	shared, err := NewClient("galaxy-test-2").GetSharedResources("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shared.Subnets) != 2 {
+		t.Errorf("expected 2 subnets, got %v", shared.Subnets)
+	}
+
+	if n := len(west.Requests("DescribeSubnets")); n != 1 {
+		t.Errorf("expected 1 DescribeSubnets request in the stack's region, got %d", n)
+	}
+
+	if n := len(east.Requests("DescribeSubnets")); n != 0 {
+		t.Errorf("expected no DescribeSubnets requests in the default region, got %d", n)
+	}
+}
+
+func TestSetRegionConcurrent(t *testing.T) {
+	defer SetRegion(GetRegion())
+
+	var wg sync.WaitGroup
+	for _, region := range []string{"us-east-1", "us-west-2", "eu-west-1"} {
+		wg.Add(2)
+		go func(region string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				SetRegion(region)
+			}
+		}(region)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := GetAWSRegion(""); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientCredentials(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, describeStackXML("test", "CREATE_COMPLETE", "")
+	})
+
+	client := &Client{
+		AccessKey:    "AKIDEXPLICIT",
+		SecretKey:    "explicit-secret",
+		SessionToken: "explicit-token",
+	}
+
+	if _, err := client.DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default client falls back to the environment
+	if _, err := DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("DescribeStacks")
+	if reqs[0].Get("AWSAccessKeyId") != "AKIDEXPLICIT" {
+		t.Errorf("expected explicit access key, got %q", reqs[0].Get("AWSAccessKeyId"))
+	}
+	if reqs[0].Get("SecurityToken") != "explicit-token" {
+		t.Errorf("expected explicit session token, got %q", reqs[0].Get("SecurityToken"))
+	}
+
+	if reqs[1].Get("AWSAccessKeyId") != "AKIDTEST" {
+		t.Errorf("expected access key from the environment, got %q", reqs[1].Get("AWSAccessKeyId"))
+	}
+}
+
+// staticCredentials is a CredentialProvider counting its calls
+type staticCredentials struct {
+	auth  aws.Auth
+	calls int
+}
+
+func (p *staticCredentials) Credentials() (aws.Auth, error) {
+	p.calls++
+	return p.auth, nil
+}
+
+func TestClientCredentialProvider(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, describeStackXML("test", "CREATE_COMPLETE", "")
+	})
+
+	provider := &staticCredentials{auth: aws.Auth{AccessKey: "AKIDVAULT", SecretKey: "vault-secret"}}
+	client := &Client{
+		AccessKey:   "AKIDEXPLICIT",
+		SecretKey:   "explicit-secret",
+		Credentials: provider,
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.DescribeStacks("test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if provider.calls != 2 {
+		t.Errorf("expected the provider to be called for each request, got %d calls", provider.calls)
+	}
+
+	for _, req := range s.Requests("DescribeStacks") {
+		if req.Get("AWSAccessKeyId") != "AKIDVAULT" {
+			t.Errorf("expected the provider's access key, got %q", req.Get("AWSAccessKeyId"))
+		}
+		if req.Get("Signature") == "" {
+			t.Error("expected a signed request")
+		}
+	}
+}
+
+func TestClientCredentialProviderEC2(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeRegions", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeRegionsResponse><regionInfo>
+  <item><regionName>galaxy-test-1</regionName></item>
+</regionInfo></DescribeRegionsResponse>`
+	})
+	s.Handle("DescribeAvailabilityZones", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeAvailabilityZonesResponse><availabilityZoneInfo>
+  <item><zoneName>galaxy-test-1a</zoneName><zoneType>availability-zone</zoneType></item>
+</availabilityZoneInfo></DescribeAvailabilityZonesResponse>`
+	})
+
+	provider := &staticCredentials{auth: aws.Auth{AccessKey: "AKIDVAULT", SecretKey: "vault-secret"}}
+	client := &Client{Credentials: provider}
+
+	if _, err := client.DescribeRegions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DescribeAvailabilityZones(); err != nil {
+		t.Fatal(err)
+	}
+
+	if provider.calls != 2 {
+		t.Errorf("expected the provider to be called for each request, got %d calls", provider.calls)
+	}
+
+	for _, action := range []string{"DescribeRegions", "DescribeAvailabilityZones"} {
+		reqs := s.Requests(action)
+		if len(reqs) != 1 {
+			t.Fatalf("expected 1 %s request, got %d", action, len(reqs))
+		}
+		if reqs[0].Get("AWSAccessKeyId") != "AKIDVAULT" {
+			t.Errorf("%s: expected the provider's access key, got %q", action, reqs[0].Get("AWSAccessKeyId"))
+		}
+	}
+}
+
+// fakeQueryer answers every request with the same response
+type fakeQueryer struct {
+	status int
+	body   string
+	params []map[string]string
+}
+
+func (f *fakeQueryer) Query(method, path string, params map[string]string) (*http.Response, error) {
+	f.params = append(f.params, params)
+	return &http.Response{
+		StatusCode: f.status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(f.body)),
+	}, nil
+}
+
+func (f *fakeQueryer) BuildError(resp *http.Response) error {
+	return fmt.Errorf("status %d", resp.StatusCode)
+}
+
+func TestClientFakeQueryer(t *testing.T) {
+	fake := &fakeQueryer{
+		status: http.StatusOK,
+		body:   describeStackXML("test", "CREATE_COMPLETE", ""),
+	}
+
+	c := &Client{Region: "us-east-1", service: fake}
+
+	resp, err := c.DescribeStacks("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Stacks) != 1 || resp.Stacks[0].Status != "CREATE_COMPLETE" {
+		t.Errorf("unexpected stacks: %+v", resp.Stacks)
+	}
+
+	if len(fake.params) != 1 || fake.params[0]["Action"] != "DescribeStacks" || fake.params[0]["StackName"] != "test" {
+		t.Errorf("unexpected requests: %v", fake.params)
+	}
+
+	fake.status = http.StatusBadRequest
+	if _, err := c.DescribeStacks("test"); err == nil || err.Error() != "status 400" {
+		t.Errorf("expected the fake's error, got %v", err)
+	}
+}
+
+func TestNewClientWithService(t *testing.T) {
+	fake := &fakeQueryer{
+		status: http.StatusOK,
+		body: `<DescribeAvailabilityZonesResponse>
+  <availabilityZoneInfo>
+    <item><zoneName>us-east-1a</zoneName><zoneType>availability-zone</zoneType></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`,
+	}
+
+	c := NewClientWithService("us-east-1", fake)
+
+	resp, err := c.DescribeAvailabilityZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.AvailabilityZones) != 1 || resp.AvailabilityZones[0].Name != "us-east-1a" {
+		t.Errorf("unexpected zones: %+v", resp.AvailabilityZones)
+	}
+
+	fake.body = `<DescribeRegionsResponse>
+  <regionInfo><item><regionName>us-east-1</regionName></item></regionInfo>
+</DescribeRegionsResponse>`
+	if _, err := c.DescribeRegions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.params) != 2 || fake.params[0]["Action"] != "DescribeAvailabilityZones" || fake.params[1]["Action"] != "DescribeRegions" {
+		t.Errorf("expected both requests through the fake, got %v", fake.params)
+	}
+}
+
+func TestClientPrettyLogTemplates(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	buf := &bytes.Buffer{}
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = log.New(buf, "", log.DEBUG)
+	defer func() { log.DefaultLogger = defaultLogger }()
+
+	client := &Client{PrettyLogTemplates: true}
+
+	tmpl := `{"Resources":{"Queue":{"Type":"AWS::SQS::Queue"}}}`
+	if _, err := client.Create("test", []byte(tmpl), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pretty := `{
+  "Resources": {
+    "Queue": {
+      "Type": "AWS::SQS::Queue"
+    }
+  }
+}`
+	if !strings.Contains(buf.String(), pretty) {
+		t.Errorf("log %q does not contain the indented template", buf.String())
+	}
+
+	reqs := s.Requests("CreateStack")
+	if len(reqs) != 1 || reqs[0].Get("TemplateBody") != tmpl {
+		t.Errorf("expected the template to be sent unchanged, got %v", reqs)
+	}
+
+	// YAML templates aren't logged
+	buf.Reset()
+	if _, err := client.Create("test", []byte("Resources: {}\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "template for test") {
+		t.Errorf("unexpected template log for YAML: %q", buf.String())
+	}
+}
+
+func TestListAllRegions(t *testing.T) {
+	east := newTestServer(t)
+	defer east.Close()
+	west := newRegionTestServer(t, "galaxy-test-2")
+	defer west.Close()
+
+	handleList := func(s *testServer, names ...string) {
+		s.Handle("ListStacks", func(url.Values) (int, string) {
+			members := ""
+			for _, name := range names {
+				members += fmt.Sprintf(`<member><StackName>%s</StackName><StackStatus>CREATE_COMPLETE</StackStatus></member>`, name)
+			}
+			return http.StatusOK, fmt.Sprintf(`<ListStacksResponse>
+  <ListStacksResult><StackSummaries>%s</StackSummaries></ListStacksResult>
+</ListStacksResponse>`, members)
+		})
+	}
+	handleList(east, "east-base", "east-web")
+	handleList(west, "west-base")
+
+	stacks, err := ListAllRegions([]string{testRegion, "galaxy-test-2", "galaxy-nowhere-1"})
+
+	regionsErr, ok := err.(*RegionsError)
+	if !ok {
+		t.Fatalf("expected a *RegionsError, got %v", err)
+	}
+	if len(regionsErr.Errors) != 1 || regionsErr.Errors["galaxy-nowhere-1"] == nil {
+		t.Errorf("unexpected region errors: %v", regionsErr.Errors)
+	}
+
+	names := make(map[string][]string)
+	for region, summaries := range stacks {
+		for _, stack := range summaries {
+			names[region] = append(names[region], stack.StackName)
+		}
+	}
+
+	expected := map[string][]string{
+		testRegion:      {"east-base", "east-web"},
+		"galaxy-test-2": {"west-base"},
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("stacks = %v, want %v", names, expected)
+	}
+}
@@ -1,12 +1,21 @@
 package stack
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goamz/goamz/aws"
@@ -25,27 +34,173 @@ TODO: Use SQS instead of polling
 
 var ErrTimeout = fmt.Errorf("timeout")
 
+// ErrMaxPages is returned when a paginated request has more than MaxPages
+// pages of results.
+var ErrMaxPages = fmt.Errorf("too many pages of results")
+
+// The most pages fetched by any paginated request, as a guard against
+// looping forever.
+var MaxPages = 1000
+
+// The default region, used when a Client has no Region and none is set in the
+// environment. Use SetRegion and GetRegion to change or read it while other
+// goroutines may be using it.
 var Region = "us-east-1"
 
+var regionMu sync.RWMutex
+
+// Set the default region.
+func SetRegion(region string) {
+	regionMu.Lock()
+	defer regionMu.Unlock()
+	Region = region
+}
+
+// Return the default region.
+func GetRegion() string {
+	regionMu.RLock()
+	defer regionMu.RUnlock()
+	return Region
+}
+
+// how often to poll a stack's status while waiting
+var pollInterval = 5 * time.Second
+
+// The longest Wait will sleep between polls while DescribeStacks is
+// returning errors.
+var maxErrorBackoff = time.Minute
+
+// sleep is replaced in tests to record the retry loops' delays
+var sleep = time.Sleep
+
+// Sleep for d, or until ctx is done, returning the context's error if it is.
+// It's replaced in tests to record the wait loop's delays.
+var sleepContext = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 // thie error type also provides a list of failures from the stack's events
 type FailuresError struct {
 	messages []string
+	// the failure events the messages came from, if any
+	events []stackEvent
+	// the stack's final status
+	status string
+}
+
+// Match the *StatusError for the stack's final status, e.g.
+// errors.Is(err, ErrRollbackComplete)
+func (f *FailuresError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && f.status != "" && t.Status == f.status
+}
+
+// StatusError is returned when a stack ends in a failed status, and no
+// failure events were found to explain it.
+type StatusError struct {
+	Status string
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	if e.Reason == "" {
+		return e.Status
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Reason)
+}
+
+// Match the error for the same status, so a failure can be compared with
+// errors.Is against the errors below.
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && t.Status == e.Status
 }
 
+// The errors matching each failed final status. Both a *StatusError and a
+// *FailuresError match the stack's final status with errors.Is.
+var (
+	ErrCreateFailed           = &StatusError{Status: "CREATE_FAILED"}
+	ErrRollbackComplete       = &StatusError{Status: "ROLLBACK_COMPLETE"}
+	ErrRollbackFailed         = &StatusError{Status: "ROLLBACK_FAILED"}
+	ErrDeleteFailed           = &StatusError{Status: "DELETE_FAILED"}
+	ErrUpdateRollbackComplete = &StatusError{Status: "UPDATE_ROLLBACK_COMPLETE"}
+	ErrUpdateRollbackFailed   = &StatusError{Status: "UPDATE_ROLLBACK_FAILED"}
+)
+
 func (f *FailuresError) List() []string {
 	return f.messages
 }
 
-// The basic Error returns the oldest failure in the list
+// Return the failure events, newest first, for the details of each failed
+// resource, like its ResourceProperties. This may be empty even when List
+// isn't, if the failure was only found in the stack's status.
+func (f *FailuresError) Events() []stackEvent {
+	return f.events
+}
+
+// The basic Error returns the root cause of the failure
 func (f *FailuresError) Error() string {
+	return f.RootCause()
+}
+
+// Return the oldest failure which wasn't caused by another resource failing,
+// or the oldest failure if they all look like cascades.
+func (f *FailuresError) RootCause() string {
 	if len(f.messages) == 0 {
 		return ""
 	}
+
+	// the messages are newest first
+	for i := len(f.messages) - 1; i >= 0; i-- {
+		if !isCascadeFailure(f.messages[i]) {
+			return f.messages[i]
+		}
+	}
 	return f.messages[len(f.messages)-1]
 }
 
+// The reasons CloudFormation gives for resources which failed only because
+// another resource did.
+var cascadeFailureReasons = []string{
+	"resource creation cancelled",
+	"resource update cancelled",
+	"resource deletion cancelled",
+	"the following resource(s) failed to",
+	"because another resource",
+}
+
+// Check if a failure message is a side effect of another resource's failure.
+func isCascadeFailure(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, reason := range cascadeFailureReasons {
+		if strings.Contains(msg, reason) {
+			return true
+		}
+	}
+	return false
+}
+
 type GetTemplateResponse struct {
-	TemplateBody []byte `xml:"GetTemplateResult>TemplateBody"`
+	TemplateBody    []byte   `xml:"GetTemplateResult>TemplateBody"`
+	StagesAvailable []string `xml:"GetTemplateResult>StagesAvailable>member"`
+}
+
+// Check if the stack's template is available at stage.
+func (r GetTemplateResponse) HasStage(stage string) bool {
+	for _, s := range r.StagesAvailable {
+		if s == stage {
+			return true
+		}
+	}
+	return false
 }
 
 type CreateStackResponse struct {
@@ -60,25 +215,85 @@ type UpdateStackResponse struct {
 
 type DeleteStackResponse struct {
 	RequestId string `xml:"ResponseMetadata>RequestId"`
+
+	// The token sent with the request, which is included in the stack's
+	// events caused by the delete.
+	ClientRequestToken string `xml:"-"`
 }
 
 type stackParameter struct {
 	Key   string `xml:"ParameterKey"`
 	Value string `xml:"ParameterValue"`
+
+	// NoEcho is set for parameters whose value was masked by AWS. The Value
+	// is NoEchoMask, and must not be used as if it were real.
+	NoEcho bool `xml:"-"`
 }
 
+// The value AWS returns in place of a NoEcho parameter's real value
+const NoEchoMask = "****"
+
 type stackTag struct {
 	Key   string
 	Value string
 }
 
+type stackOutput struct {
+	Key         string `xml:"OutputKey"`
+	Value       string `xml:"OutputValue"`
+	Description string `xml:"Description"`
+	ExportName  string `xml:"ExportName"`
+}
+
 type stackDescription struct {
-	Id           string           `xml:"StackId"`
-	Name         string           `xml:"StackName"`
-	Status       string           `xml:"StackStatus"`
-	StatusReason string           `xml:"StackStatusReason"`
-	Parameters   []stackParameter `xml:"Parameters>member"`
-	Tags         []stackTag       `xml:"Tags>member"`
+	Id               string           `xml:"StackId"`
+	Name             string           `xml:"StackName"`
+	Status           string           `xml:"StackStatus"`
+	StatusReason     string           `xml:"StackStatusReason"`
+	Parameters       []stackParameter `xml:"Parameters>member"`
+	Outputs          []stackOutput    `xml:"Outputs>member"`
+	Tags             []stackTag       `xml:"Tags>member"`
+	Capabilities     []string         `xml:"Capabilities>member"`
+	NotificationARNs []string         `xml:"NotificationARNs>member"`
+	RoleARN          string           `xml:"RoleARN"`
+	DisableRollback  bool             `xml:"DisableRollback"`
+}
+
+// Check if a stack has the given name, or full stack ID.
+func (s stackDescription) matches(nameOrID string) bool {
+	return s.Name == nameOrID || s.Id == nameOrID
+}
+
+// Return the value of the stack's tag with the given key, and whether it was
+// found.
+func (s stackDescription) Tag(key string) (string, bool) {
+	for _, tag := range s.Tags {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// Return the stack's tags as a map of key to value.
+func (s stackDescription) TagsMap() map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range s.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// Return the export names of the stack's exported outputs, in output order.
+// These may be imported by other stacks with Fn::ImportValue.
+func (s stackDescription) ExportedNames() []string {
+	names := []string{}
+	for _, output := range s.Outputs {
+		if output.ExportName != "" {
+			names = append(names, output.ExportName)
+		}
+	}
+	return names
 }
 
 type DescribeStacksResponse struct {
@@ -86,16 +301,37 @@ type DescribeStacksResponse struct {
 	Stacks    []stackDescription `xml:"DescribeStacksResult>Stacks>member"`
 }
 
+// The json field names match the output of the AWS CLI, so that resource
+// listings can be emitted for scripts.
 type stackResource struct {
-	Status     string `xml:"ResourceStatus"`
-	LogicalId  string `xml:"LogicalResourceId"`
-	PhysicalId string `xml:"PhysicalResourceId"`
-	Type       string `xml:"ResourceType"`
+	Status     string `xml:"ResourceStatus" json:"ResourceStatus"`
+	LogicalId  string `xml:"LogicalResourceId" json:"LogicalResourceId"`
+	PhysicalId string `xml:"PhysicalResourceId" json:"PhysicalResourceId"`
+	Type       string `xml:"ResourceType" json:"ResourceType"`
 }
 
 type ListStackResourcesResponse struct {
-	RequestId string          `xml:"ResponseMetadata>RequestId"`
-	Resources []stackResource `xml:"ListStackResourcesResult>StackResourceSummaries>member"`
+	RequestId string          `xml:"ResponseMetadata>RequestId" json:"-"`
+	Resources []stackResource `xml:"ListStackResourcesResult>StackResourceSummaries>member" json:"StackResourceSummaries"`
+	NextToken string          `xml:"ListStackResourcesResult>NextToken" json:"NextToken,omitempty"`
+}
+
+type stackResourceDetail struct {
+	StackId      string    `xml:"StackId"`
+	StackName    string    `xml:"StackName"`
+	Status       string    `xml:"ResourceStatus"`
+	StatusReason string    `xml:"ResourceStatusReason"`
+	LogicalId    string    `xml:"LogicalResourceId"`
+	PhysicalId   string    `xml:"PhysicalResourceId"`
+	Type         string    `xml:"ResourceType"`
+	Description  string    `xml:"Description"`
+	Metadata     string    `xml:"Metadata"`
+	LastUpdated  time.Time `xml:"LastUpdatedTimestamp"`
+}
+
+type DescribeStackResourceResponse struct {
+	RequestId string              `xml:"ResponseMetadata>RequestId"`
+	Resource  stackResourceDetail `xml:"DescribeStackResourceResult>StackResourceDetail"`
 }
 
 type serverCert struct {
@@ -126,7 +362,9 @@ type stackEvent struct {
 }
 
 type DescribeStackEventsResult struct {
-	Events []stackEvent `xml:"DescribeStackEventsResult>StackEvents>member"`
+	RequestId string       `xml:"ResponseMetadata>RequestId"`
+	Events    []stackEvent `xml:"DescribeStackEventsResult>StackEvents>member"`
+	NextToken string       `xml:"DescribeStackEventsResult>NextToken"`
 }
 
 type stackSummary struct {
@@ -141,13 +379,16 @@ type stackSummary struct {
 }
 
 type ListStacksResponse struct {
-	Stacks []stackSummary `xml:"ListStacksResult>StackSummaries>member"`
+	Stacks    []stackSummary `xml:"ListStacksResult>StackSummaries>member"`
+	NextToken string         `xml:"ListStacksResult>NextToken"`
 }
 
 type AvailabilityZoneInfo struct {
 	Name   string `xml:"zoneName"`
 	State  string `xml:"zoneState"`
 	Region string `xml:"regionName"`
+	// availability-zone, local-zone, or wavelength-zone
+	ZoneType string `xml:"zoneType"`
 }
 
 type DescribeAvailabilityZonesResponse struct {
@@ -155,6 +396,18 @@ type DescribeAvailabilityZonesResponse struct {
 	AvailabilityZones []AvailabilityZoneInfo `xml:"availabilityZoneInfo>item"`
 }
 
+// Return only the standard availability zones, leaving out Local Zones and
+// Wavelength Zones, which shouldn't be used for a base stack.
+func (r DescribeAvailabilityZonesResponse) StandardZones() []AvailabilityZoneInfo {
+	zones := []AvailabilityZoneInfo{}
+	for _, az := range r.AvailabilityZones {
+		if az.ZoneType == "availability-zone" {
+			zones = append(zones, az)
+		}
+	}
+	return zones
+}
+
 type Subnet struct {
 	ID                        string `xml:"subnetId"`
 	State                     string `xml:"state"`
@@ -164,6 +417,18 @@ type Subnet struct {
 	AvailabilityZone          string `xml:"availabilityZone"`
 	DefaultForAZ              bool   `xml:"defaultForAz"`
 	MapPublicIPOnLaunch       bool   `xml:"mapPublicIpOnLaunch"`
+
+	// the IPv6 CIDR blocks associated with a dual-stack subnet
+	IPv6CIDRBlocks []string `xml:"ipv6CidrBlockAssociationSet>item>ipv6CidrBlock"`
+
+	Tags []ec2Tag `xml:"tagSet>item"`
+	// the value of the Name tag, or empty if the subnet has none
+	Name string `xml:"-"`
+}
+
+type ec2Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
 }
 
 type DescribeSubnetsResponse struct {
@@ -171,6 +436,21 @@ type DescribeSubnetsResponse struct {
 	Subnets   []Subnet `xml:"subnetSet>item"`
 }
 
+// Return the subnets with at least n available IP addresses.
+func (r DescribeSubnetsResponse) WithAtLeastFreeIPs(n int) []Subnet {
+	return subnetsWithFreeIPs(r.Subnets, n)
+}
+
+func subnetsWithFreeIPs(subnets []Subnet, n int) []Subnet {
+	free := []Subnet{}
+	for _, sn := range subnets {
+		if sn.AvailableIPAddressesCount >= n {
+			free = append(free, sn)
+		}
+	}
+	return free
+}
+
 // Resources from the base stack that may need to be referenced from other
 // stacks
 type SharedResources struct {
@@ -191,25 +471,175 @@ func (s SharedResources) ListSubnets() []string {
 	return subnets
 }
 
-func GetAWSRegion(region string) (*aws.Region, error) {
-	if region == "" {
-		region = os.Getenv("AWS_DEFAULT_REGION")
-		if region != "" {
-			log.Debugf("Using AWS_DEFAULT_REGION=%s", region)
+// Lookup a shared subnet by the value of its Name tag.
+func (s SharedResources) SubnetByName(name string) (Subnet, error) {
+	for _, sn := range s.Subnets {
+		if sn.Name != "" && sn.Name == name {
+			return sn, nil
 		}
 	}
+	return Subnet{}, fmt.Errorf("no such subnet in base stack: %s", name)
+}
 
-	// AWS_REGION isn't used by the aws-cli, but check here just in case
-	if region == "" {
-		region = os.Getenv("AWS_REGION")
-		if region != "" {
-			log.Debugf("Using AWS_REGION=%s", region)
+// Return the ID of the base stack's VPC. This was found along with the other
+// shared resources, so there's no need to call GetStackVPC again.
+func (s SharedResources) VPC() string {
+	return s.VPCID
+}
+
+// Lookup the ID of a security group in the base stack by its logical ID.
+func (s SharedResources) SecurityGroup(logicalID string) (string, error) {
+	id, ok := s.SecurityGroups[logicalID]
+	if !ok || id == "" {
+		return "", fmt.Errorf("no such security group in base stack: %s", logicalID)
+	}
+	return id, nil
+}
+
+// Lookup an instance profile in the base stack by its logical ID.
+func (s SharedResources) Role(logicalID string) (string, error) {
+	id, ok := s.Roles[logicalID]
+	if !ok || id == "" {
+		return "", fmt.Errorf("no such role in base stack: %s", logicalID)
+	}
+	return id, nil
+}
+
+// Lookup the ARN of a server certificate by name.
+func (s SharedResources) ServerCert(name string) (string, error) {
+	arn, ok := s.ServerCerts[name]
+	if !ok || arn == "" {
+		return "", fmt.Errorf("no such server certificate: %s", name)
+	}
+	return arn, nil
+}
+
+// Check if a subnet ID is one of the shared subnets.
+func (s SharedResources) HasSubnet(id string) bool {
+	for _, sn := range s.Subnets {
+		if sn.ID == id {
+			return true
 		}
 	}
+	return false
+}
 
-	if region == "" {
-		region = Region
+// Check if a security group ID is one of the shared security groups.
+func (s SharedResources) HasSecurityGroup(id string) bool {
+	return hasValue(s.SecurityGroups, id)
+}
+
+// Check if an instance profile is one of the shared roles.
+func (s SharedResources) HasRole(id string) bool {
+	return hasValue(s.Roles, id)
+}
+
+// Return template parameters for Create options, from a mapping of parameter
+// name to shared resource key. The keys are:
+//   VPCID: the VPC ID
+//   Subnets: a comma separated list of the subnet IDs
+//   sg.NAME: the security group with logical ID NAME
+//   role.NAME: the instance profile with logical ID NAME
+//   cert.NAME: the ARN of the server certificate NAME
+//   param.NAME: the base stack's parameter NAME
+// Parameters whose resource isn't found are left out, so that they're
+// reported as missing rather than sent empty.
+func (s SharedResources) AsParameters(mapping map[string]string) map[string]string {
+	params := make(map[string]string)
+	for param, key := range mapping {
+		val := ""
+		switch {
+		case key == "VPCID":
+			val = s.VPCID
+		case key == "Subnets":
+			val = strings.Join(s.ListSubnets(), ",")
+		case strings.HasPrefix(key, "sg."):
+			val = s.SecurityGroups[key[3:]]
+		case strings.HasPrefix(key, "role."):
+			val = s.Roles[key[5:]]
+		case strings.HasPrefix(key, "cert."):
+			val = s.ServerCerts[key[5:]]
+		case strings.HasPrefix(key, "param."):
+			val = s.Parameters[key[6:]]
+		}
+
+		if val != "" {
+			params[param] = val
+		}
+	}
+	return params
+}
+
+func hasValue(m map[string]string, val string) bool {
+	for _, v := range m {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup the aws.Region, defaulting to the environment or the package Region.
+// If StrictRegions is set, the region is also validated with
+// ValidateRegionLive.
+func GetAWSRegion(region string) (*aws.Region, error) {
+	return defaultClient.lookupAWSRegion(region)
+}
+
+// Lookup the client's region, as GetAWSRegion does.
+func (c *Client) awsRegion() (*aws.Region, error) {
+	return c.lookupAWSRegion(c.Region)
+}
+
+// Lookup a region. Normally it must be in the static list in goamz. With
+// StrictRegions, the live list from DescribeRegions, made with the client's
+// credentials, decides instead, so that a region added since goamz was built
+// can still be used.
+func (c *Client) lookupAWSRegion(region string) (*aws.Region, error) {
+	reg, err := lookupRegion(region)
+	if !StrictRegions {
+		return reg, err
+	}
+
+	name := regionName(region)
+	if err := c.ValidateRegionLive(name); err != nil {
+		return nil, err
+	}
+
+	if reg == nil {
+		reg = newRegion(name)
 	}
+	return reg, nil
+}
+
+// Return the endpoint of an AWS service in a region
+var regionEndpoint = func(service, region string) string {
+	return fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+}
+
+// Build the aws.Region for a region missing from the static list in goamz,
+// following AWS's naming of regional endpoints. IAM and STS are global.
+func newRegion(name string) *aws.Region {
+	return &aws.Region{
+		Name:                   name,
+		EC2Endpoint:            regionEndpoint("ec2", name),
+		S3Endpoint:             regionEndpoint("s3", name),
+		S3LocationConstraint:   true,
+		S3LowercaseBucket:      true,
+		SNSEndpoint:            regionEndpoint("sns", name),
+		SQSEndpoint:            regionEndpoint("sqs", name),
+		IAMEndpoint:            "https://iam.amazonaws.com",
+		ELBEndpoint:            regionEndpoint("elasticloadbalancing", name),
+		AutoScalingEndpoint:    regionEndpoint("autoscaling", name),
+		RDSEndpoint:            aws.ServiceInfo{Endpoint: regionEndpoint("rds", name), Signer: aws.V2Signature},
+		STSEndpoint:            "https://sts.amazonaws.com",
+		CloudFormationEndpoint: regionEndpoint("cloudformation", name),
+	}
+}
+
+// Lookup the aws.Region from the static list in goamz
+func lookupRegion(region string) (*aws.Region, error) {
+	region = regionName(region)
 
 	var reg aws.Region
 	for name, r := range aws.Regions {
@@ -224,13 +654,31 @@ func GetAWSRegion(region string) (*aws.Region, error) {
 	return &reg, nil
 }
 
-func getService(service, region string) (*aws.Service, error) {
+// Return the name of the region to use, defaulting to the environment or the
+// package Region.
+func regionName(region string) string {
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+		if region != "" {
+			log.Debugf("Using AWS_DEFAULT_REGION=%s", region)
+		}
+	}
 
-	reg, err := GetAWSRegion(region)
-	if err != nil {
-		return nil, err
+	// AWS_REGION isn't used by the aws-cli, but check here just in case
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+		if region != "" {
+			log.Debugf("Using AWS_REGION=%s", region)
+		}
+	}
+
+	if region == "" {
+		region = GetRegion()
 	}
+	return region
+}
 
+func newService(service string, reg *aws.Region, auth aws.Auth) (Queryer, error) {
 	var endpoint string
 	switch service {
 	case "cf":
@@ -241,16 +689,14 @@ func getService(service, region string) (*aws.Service, error) {
 		endpoint = reg.IAMEndpoint
 	case "rds":
 		endpoint = reg.RDSEndpoint.Endpoint
+	case "sqs":
+		endpoint = reg.SQSEndpoint
+	case "sts":
+		endpoint = reg.STSEndpoint
 	default:
 		return nil, fmt.Errorf("Service %s not implemented", service)
 	}
 
-	// only get the creds from the env for now
-	auth, err := aws.GetAuth("", "", "", time.Now())
-	if err != nil {
-		return nil, err
-	}
-
 	serviceInfo := aws.ServiceInfo{
 		Endpoint: endpoint,
 		Signer:   aws.V2Signature,
@@ -260,265 +706,738 @@ func getService(service, region string) (*aws.Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	return svc, nil
+	return &awsService{Queryer: svc, region: reg.Name}, nil
 }
 
-// Lookup and unmarshal an existing stack into a Pool
-func GetPool(name string) (*Pool, error) {
-	pool := &Pool{}
+// Queryer is the part of an aws.Service used to make requests, so that the
+// service can be replaced by a fake with NewClientWithService.
+type Queryer interface {
+	Query(method, path string, params map[string]string) (*http.Response, error)
+	BuildError(*http.Response) error
+}
 
-	poolTmpl, err := GetTemplate(name)
+// awsService logs every query made through a Queryer at the debug level.
+type awsService struct {
+	Queryer
+	region string
+}
+
+// find the RequestId in any of the query API responses
+var requestIDRe = regexp.MustCompile(`<[Rr]equestI[Dd]>([^<]*)</`)
+
+func (s *awsService) Query(method, path string, params map[string]string) (*http.Response, error) {
+	resp, err := s.Queryer.Query(method, path, params)
 	if err != nil {
-		return pool, err
+		log.Debugf("AWS %s region=%s stack=%s error=%q", params["Action"], s.region, params["StackName"], err)
+		return resp, err
 	}
 
-	if err := json.Unmarshal(poolTmpl, pool); err != nil {
+	// buffer the body so we can find the RequestId, and still decode the
+	// response.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
 		return nil, err
 	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	return pool, nil
+	requestID := resp.Header.Get("X-Amzn-Requestid")
+	if m := requestIDRe.FindSubmatch(body); requestID == "" && m != nil {
+		requestID = string(m[1])
+	}
+
+	log.Debugf("AWS %s region=%s stack=%s status=%d request_id=%s",
+		params["Action"], s.region, params["StackName"], resp.StatusCode, requestID)
+	return resp, nil
 }
 
-func GetStackVPC(stackName string) (string, error) {
-	stackResp, err := ListStackResources(stackName)
+// Return a stack's parameters, e.g. to be used as the options to Create a
+// copy of the stack. NoEcho parameters are masked by AWS, so they are left out
+// of params rather than returned as NoEchoMask, and their names are returned
+// in noEcho. They need to be supplied by the caller.
+func (c *Client) StackParameters(name string) (params map[string]string, noEcho []string, err error) {
+	desc, err := c.DescribeStacks(name)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
-	for _, res := range stackResp.Resources {
-		if res.Type == "AWS::EC2::VPC" {
-			return res.PhysicalId, nil
+	for _, stack := range desc.Stacks {
+		if !stack.matches(name) {
+			continue
+		}
+
+		params = make(map[string]string)
+		noEcho = []string{}
+		for _, param := range stack.Parameters {
+			if param.NoEcho {
+				noEcho = append(noEcho, param.Key)
+				continue
+			}
+			params[param.Key] = param.Value
 		}
+
+		sort.Strings(noEcho)
+		return params, noEcho, nil
 	}
 
-	return "", fmt.Errorf("No VPC found")
+	return nil, nil, fmt.Errorf("could not find stack: %s", name)
 }
 
-func DescribeSubnets(vpcID, region string) (DescribeSubnetsResponse, error) {
-	dsnResp := DescribeSubnetsResponse{}
+// Lookup and unmarshal an existing stack into a Pool
+func (c *Client) GetPool(name string) (*Pool, error) {
+	pool := &Pool{}
 
-	service, err := getService("ec2", region)
+	poolTmpl, err := c.GetTemplate(name)
 	if err != nil {
-		return dsnResp, err
+		return pool, err
 	}
 
-	params := map[string]string{
-		"Action":  "DescribeSubnets",
-		"Version": "2014-02-01",
+	if err := json.Unmarshal(poolTmpl, pool); err != nil {
+		return nil, err
 	}
 
-	if vpcID != "" {
-		params["Filter.1.Name"] = "vpc-id"
-		params["Filter.1.Value.1"] = vpcID
-	}
+	return pool, nil
+}
 
-	resp, err := service.Query("GET", "/", params)
+// Like GetPool, but decode the Processed template, which reflects what's
+// deployed after any transforms. The Original template is used if the stack
+// has no Processed stage.
+func (c *Client) GetPoolProcessed(name string) (*Pool, error) {
+	pool := &Pool{}
+
+	tmplResp, err := c.DescribeTemplate(name, TemplateStageProcessed)
 	if err != nil {
-		return dsnResp, err
+		return pool, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := service.BuildError(resp)
-		return dsnResp, err
+	poolTmpl := tmplResp.TemplateBody
+	if len(poolTmpl) == 0 || (len(tmplResp.StagesAvailable) > 0 && !tmplResp.HasStage(TemplateStageProcessed)) {
+		poolTmpl, err = c.GetTemplate(name)
+		if err != nil {
+			return pool, err
+		}
 	}
-	defer resp.Body.Close()
 
-	err = xml.NewDecoder(resp.Body).Decode(&dsnResp)
-	if err != nil {
-		return dsnResp, err
+	if err := json.Unmarshal(poolTmpl, pool); err != nil {
+		return nil, err
 	}
-	return dsnResp, nil
-}
 
-func DescribeAvailabilityZones(region string) (DescribeAvailabilityZonesResponse, error) {
-	azResp := DescribeAvailabilityZonesResponse{}
+	return pool, nil
+}
 
-	service, err := getService("ec2", region)
+// Regenerate the template from a Pool, usually one modified after GetPool, and
+// Update the stack with it.
+func (c *Client) UpdatePool(name string, pool *Pool, options map[string]string) (*UpdateStackResponse, error) {
+	poolTmpl, err := json.MarshalIndent(pool, "", "    ")
 	if err != nil {
-		return azResp, err
+		return nil, err
 	}
 
-	params := map[string]string{
-		"Action":  "DescribeAvailabilityZones",
-		"Version": "2014-02-01",
-	}
+	return c.Update(name, poolTmpl, options)
+}
 
-	resp, err := service.Query("GET", "/", params)
+// Create a new pool stack named poolName, filling in any unset values in the
+// pool from the SharedResources of baseStack. See Pool.SetSharedResources for
+// the values used.
+func (c *Client) CreatePool(baseStack, poolName string, pool *Pool, options map[string]string) (*CreateStackResponse, error) {
+	shared, err := c.GetSharedResources(baseStack)
 	if err != nil {
-		return azResp, err
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := service.BuildError(resp)
-		return azResp, err
+	pool.SetSharedResources(shared)
+
+	if err := pool.ValidateSharedResources(shared); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	err = xml.NewDecoder(resp.Body).Decode(&azResp)
+	poolTmpl, err := json.MarshalIndent(pool, "", "    ")
 	if err != nil {
-		return azResp, err
+		return nil, err
 	}
-	return azResp, nil
+
+	return c.Create(poolName, poolTmpl, options)
 }
 
-// List all resources associated with stackName
-func ListStackResources(stackName string) (ListStackResourcesResponse, error) {
-	listResp := ListStackResourcesResponse{}
+// The output keys checked for a VPC ID, for stacks which don't create their
+// own VPC.
+var VPCOutputKeys = []string{"VpcId", "VPCId", "VPC"}
+
+// If set, the stack tag checked for a VPC ID when a stack has no VPC resource
+// or output.
+var VPCTagKey = ""
 
-	svc, err := getService("cf", "")
+// Return the VPC of a stack. The first VPC resource in the stack is used,
+// then the first output in VPCOutputKeys, then the VPCTagKey tag.
+func (c *Client) GetStackVPC(stackName string) (string, error) {
+	vpcs, err := c.GetStackVPCs(stackName)
 	if err != nil {
-		return listResp, err
+		return "", err
 	}
 
-	params := map[string]string{
-		"Action":    "ListStackResources",
-		"StackName": stackName,
+	if len(vpcs) > 0 {
+		return vpcs[0], nil
 	}
 
-	resp, err := svc.Query("POST", "/", params)
+	descResp, err := c.DescribeStacks(stackName)
 	if err != nil {
-		return listResp, err
+		return "", err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return listResp, err
+	for _, stack := range descResp.Stacks {
+		if stack.matches(stackName) {
+			if vpc := stack.vpc(); vpc != "" {
+				return vpc, nil
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	err = xml.NewDecoder(resp.Body).Decode(&listResp)
-	if err != nil {
-		return listResp, err
+	tried := []string{"resources of type AWS::EC2::VPC", "outputs " + strings.Join(VPCOutputKeys, ", ")}
+	if VPCTagKey != "" {
+		tried = append(tried, "tag "+VPCTagKey)
 	}
-	return listResp, nil
+	return "", fmt.Errorf("no VPC found in stack %s: tried %s", stackName, strings.Join(tried, "; "))
 }
 
-// Describe all running stacks
-func DescribeStacks(name string) (DescribeStacksResponse, error) {
-	descResp := DescribeStacksResponse{}
-
-	svc, err := getService("cf", "")
-	if err != nil {
-		return descResp, err
-	}
-
-	params := map[string]string{
-		"Action": "DescribeStacks",
+// Return the VPC ID found in the stack's outputs or tags, or an empty string.
+func (s stackDescription) vpc() string {
+	for _, key := range VPCOutputKeys {
+		for _, output := range s.Outputs {
+			if output.Key == key && output.Value != "" {
+				return output.Value
+			}
+		}
 	}
 
-	if name != "" {
-		params["StackName"] = name
+	if VPCTagKey != "" {
+		if vpc, _ := s.Tag(VPCTagKey); vpc != "" {
+			return vpc
+		}
 	}
+	return ""
+}
 
-	resp, err := svc.Query("POST", "/", params)
+// Return the IDs of all VPCs in a stack
+func (c *Client) GetStackVPCs(stackName string) ([]string, error) {
+	stackResp, err := c.ListStackResources(stackName)
 	if err != nil {
-		return descResp, err
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return descResp, err
+	vpcs := []string{}
+	for _, res := range stackResp.Resources {
+		if res.Type == "AWS::EC2::VPC" {
+			vpcs = append(vpcs, res.PhysicalId)
+		}
 	}
-	defer resp.Body.Close()
 
-	err = xml.NewDecoder(resp.Body).Decode(&descResp)
-	if err != nil {
+	return vpcs, nil
+}
+
+// Describe the subnets in a VPC, or all subnets if vpcID is empty.
+func (c *Client) DescribeSubnets(vpcID string) (DescribeSubnetsResponse, error) {
+	dsnResp := DescribeSubnetsResponse{}
+
+	service, err := c.getService("ec2")
+	if err != nil {
+		return dsnResp, err
+	}
+
+	params := map[string]string{
+		"Action":  "DescribeSubnets",
+		"Version": "2016-11-15",
+	}
+
+	if vpcID != "" {
+		params["Filter.1.Name"] = "vpc-id"
+		params["Filter.1.Value.1"] = vpcID
+	}
+
+	if err := queryMethod(service, "GET", "/", params, &dsnResp); err != nil {
+		return dsnResp, err
+	}
+
+	for i, sn := range dsnResp.Subnets {
+		for _, tag := range sn.Tags {
+			if tag.Key == "Name" {
+				dsnResp.Subnets[i].Name = tag.Value
+			}
+		}
+	}
+	return dsnResp, nil
+}
+
+func (c *Client) DescribeAvailabilityZones() (DescribeAvailabilityZonesResponse, error) {
+	azResp := DescribeAvailabilityZonesResponse{}
+
+	service, err := c.getService("ec2")
+	if err != nil {
+		return azResp, err
+	}
+
+	params := map[string]string{
+		"Action": "DescribeAvailabilityZones",
+		// zoneType is only returned by newer API versions
+		"Version": "2016-11-15",
+	}
+
+	if err := queryMethod(service, "GET", "/", params, &azResp); err != nil {
+		return azResp, err
+	}
+	return azResp, nil
+}
+
+// List all resources associated with stackName. All pages of resources are
+// returned, with the RequestId of the first page.
+func (c *Client) ListStackResources(stackName string) (ListStackResourcesResponse, error) {
+	listResp := ListStackResourcesResponse{}
+
+	svc, err := c.getService("cf")
+	if err != nil {
+		return listResp, err
+	}
+
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return listResp, ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action":    "ListStackResources",
+			"StackName": stackName,
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		page := ListStackResourcesResponse{}
+		if err := query(svc, params, &page); err != nil {
+			return listResp, err
+		}
+
+		if listResp.RequestId == "" {
+			listResp.RequestId = page.RequestId
+		}
+		listResp.Resources = append(listResp.Resources, page.Resources...)
+
+		nextToken = page.NextToken
+		if nextToken == "" {
+			return listResp, nil
+		}
+	}
+}
+
+// Return the number of resources in a stack in each ResourceStatus.
+func (c *Client) StackResourceSummary(name string) (map[string]int, error) {
+	listResp, err := c.ListStackResources(name)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, res := range listResp.Resources {
+		counts[res.Status]++
+	}
+	return counts, nil
+}
+
+// Describe a single resource in a stack by its logical ID
+func (c *Client) DescribeStackResource(stackName, logicalID string) (DescribeStackResourceResponse, error) {
+	descResp := DescribeStackResourceResponse{}
+
+	svc, err := c.getService("cf")
+	if err != nil {
+		return descResp, err
+	}
+
+	params := map[string]string{
+		"Action":            "DescribeStackResource",
+		"StackName":         stackName,
+		"LogicalResourceId": logicalID,
+	}
+
+	if err := query(svc, params, &descResp); err != nil {
 		return descResp, err
 	}
 	return descResp, nil
 }
 
-// Describe a Stack's Events
-func DescribeStackEvents(name string) (DescribeStackEventsResult, error) {
-	descResp := DescribeStackEventsResult{}
+// Check if AWS rejected a request because of its rate limit
+func isThrottled(err error) bool {
+	awsErr, ok := err.(*aws.Error)
+	return ok && (awsErr.Code == "Throttling" || awsErr.Code == "ThrottlingException")
+}
+
+// Return the details of every resource in a stack, in the order they're
+// listed. Up to MaxConcurrency resources are described at once, and
+// throttled requests are retried according to the client's RetryPolicy.
+func (c *Client) AllResourcesDetailed(name string) ([]stackResourceDetail, error) {
+	listResp, err := c.ListStackResources(name)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := c.retryPolicy()
+	details := make([]stackResourceDetail, len(listResp.Resources))
+	errs := make([]error, len(listResp.Resources))
+	sem := make(chan struct{}, maxConcurrency())
+	var wg sync.WaitGroup
+	for i, res := range listResp.Resources {
+		wg.Add(1)
+		go func(i int, logicalID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			errs[i] = policy.Do(func() error {
+				resp, err := c.DescribeStackResource(name, logicalID)
+				details[i] = resp.Resource
+				return err
+			})
+		}(i, res.LogicalId)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", listResp.Resources[i].LogicalId, err)
+		}
+	}
+	return details, nil
+}
+
+// Return the raw JSON metadata for a stack resource, such as the
+// AWS::CloudFormation::Init config read by cfn-init.
+func (c *Client) GetResourceMetadata(stackName, logicalID string) (string, error) {
+	resp, err := c.DescribeStackResource(stackName, logicalID)
+	if err != nil {
+		return "", err
+	}
+	return resp.Resource.Metadata, nil
+}
+
+// Describe all running stacks. If the client has a DescribeStacksCacheTTL, a
+// recent response may be returned.
+func (c *Client) DescribeStacks(name string) (DescribeStacksResponse, error) {
+	if c.DescribeStacksCacheTTL > 0 {
+		return c.describeStacksCached(name)
+	}
+	return c.describeStacks(name)
+}
+
+// Describe stacks, bypassing the DescribeStacks cache, for callers like Wait
+// which are polling for changes, and for SetTags and others which change a
+// stack based on what they read.
+func (c *Client) describeStacks(name string) (DescribeStacksResponse, error) {
+	descResp := DescribeStacksResponse{}
 
-	svc, err := getService("cf", "")
+	svc, err := c.getService("cf")
 	if err != nil {
 		return descResp, err
 	}
 
 	params := map[string]string{
-		"Action": "DescribeStackEvents",
+		"Action": "DescribeStacks",
 	}
 
 	if name != "" {
 		params["StackName"] = name
 	}
 
-	resp, err := svc.Query("POST", "/", params)
-	if err != nil {
+	if err := query(svc, params, &descResp); err != nil {
 		return descResp, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return descResp, err
+	// DescribeStacks doesn't flag NoEcho parameters, only masks their values
+	for i := range descResp.Stacks {
+		params := descResp.Stacks[i].Parameters
+		for j := range params {
+			params[j].NoEcho = params[j].Value == NoEchoMask
+		}
 	}
-	defer resp.Body.Close()
+	return descResp, nil
+}
+
+// Describe a Stack's Events. All pages of events are returned, sorted newest
+// first by Timestamp. Events with the same Timestamp are sorted by EventId.
+// The RequestId is that of the first page.
+func (c *Client) DescribeStackEvents(name string) (DescribeStackEventsResult, error) {
+	descResp := DescribeStackEventsResult{}
+	err := c.eachStackEventsPage(name, func(page DescribeStackEventsResult) bool {
+		if descResp.RequestId == "" {
+			descResp.RequestId = page.RequestId
+		}
+		descResp.Events = append(descResp.Events, page.Events...)
+		return true
+	})
+	sort.Sort(eventsNewestFirst(descResp.Events))
+	return descResp, err
+}
 
-	err = xml.NewDecoder(resp.Body).Decode(&descResp)
+// Return the stack's events which are newer than the event lastEventID,
+// newest first. Pages of events are only fetched until lastEventID is found.
+// If lastEventID is empty, or is no longer in the stack's history, all events
+// are returned.
+func (c *Client) StackEventsSince(name, lastEventID string) ([]stackEvent, error) {
+	events := []stackEvent{}
+	err := c.eachStackEventsPage(name, func(page DescribeStackEventsResult) bool {
+		for _, event := range page.Events {
+			if lastEventID != "" && event.EventId == lastEventID {
+				return false
+			}
+			events = append(events, event)
+		}
+		return true
+	})
 	if err != nil {
-		return descResp, err
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Sort stack events by descending Timestamp, then by EventId.
+type eventsNewestFirst []stackEvent
+
+func (e eventsNewestFirst) Len() int      { return len(e) }
+func (e eventsNewestFirst) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e eventsNewestFirst) Less(i, j int) bool {
+	if e[i].Timestamp.Equal(e[j].Timestamp) {
+		return e[i].EventId < e[j].EventId
+	}
+	return e[i].Timestamp.After(e[j].Timestamp)
+}
+
+// Call f with each page of a stack's events, newest first, until there are
+// no more pages or f returns false. The events within each page are sorted
+// like DescribeStackEvents.
+func (c *Client) eachStackEventsPage(name string, f func(DescribeStackEventsResult) bool) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
+	}
+
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action": "DescribeStackEvents",
+		}
+
+		if name != "" {
+			params["StackName"] = name
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		page := DescribeStackEventsResult{}
+		if err := query(svc, params, &page); err != nil {
+			return err
+		}
+		sort.Sort(eventsNewestFirst(page.Events))
+
+		if !f(page) || page.NextToken == "" {
+			return nil
+		}
+		nextToken = page.NextToken
 	}
-	return descResp, nil
 }
 
 // return a list of all actives stacks
-func ListActive() ([]string, error) {
-	resp, err := DescribeStacks("")
+// This includes every stack which isn't deleted, even one being deleted or
+// which failed to create; see ListActiveWithOptions to exclude those.
+func (c *Client) ListActive() ([]string, error) {
+	return c.ListActiveWithOptions(nil)
+}
+
+// Like ListActive, with options:
+//   Strict: if "true", exclude stacks which aren't usable: those being
+//           deleted, in DELETE_FAILED, or whose create rolled back. Stacks
+//           whose update rolled back are still included, since they're
+//           running their previous template.
+func (c *Client) ListActiveWithOptions(options map[string]string) ([]string, error) {
+	resp, err := c.DescribeStacks("")
 	if err != nil {
 		return nil, err
 	}
 
+	strict := optionSet(options, "Strict")
+
 	stacks := []string{}
 	for _, stack := range resp.Stacks {
+		if strict && !isUsableStatus(stack.Status) {
+			continue
+		}
 		stacks = append(stacks, stack.Name)
 	}
 
 	return stacks, nil
 }
 
+// Check if a stack in this status can be used: it isn't being deleted, hasn't
+// failed to delete, and didn't roll back its create.
+func isUsableStatus(status string) bool {
+	switch status {
+	case "DELETE_IN_PROGRESS", "DELETE_FAILED", "DELETE_COMPLETE",
+		"ROLLBACK_IN_PROGRESS", "ROLLBACK_COMPLETE", "ROLLBACK_FAILED":
+		return false
+	}
+	return true
+}
+
 // List all stacks
-// This lists all stacks including inactive and deleted.
-func List() (ListStacksResponse, error) {
+// This lists all stacks including inactive and deleted. All pages of stacks
+// are returned.
+func (c *Client) List() (ListStacksResponse, error) {
 	listResp := ListStacksResponse{}
 
-	svc, err := getService("cf", "")
+	svc, err := c.getService("cf")
 	if err != nil {
 		return listResp, err
 	}
 
-	params := map[string]string{
-		"Action": "ListStacks",
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return listResp, ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action": "ListStacks",
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		page := ListStacksResponse{}
+		if err := query(svc, params, &page); err != nil {
+			return listResp, err
+		}
+
+		listResp.Stacks = append(listResp.Stacks, page.Stacks...)
+
+		nextToken = page.NextToken
+		if nextToken == "" {
+			return listResp, nil
+		}
 	}
+}
 
-	resp, err := svc.Query("POST", "/", params)
+// List the stacks with names starting with prefix, excluding deleted stacks.
+func (c *Client) ListByPrefix(prefix string) ([]stackSummary, error) {
+	listResp, err := c.List()
 	if err != nil {
-		return listResp, err
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return listResp, err
+	stacks := []stackSummary{}
+	for _, stack := range listResp.Stacks {
+		if stack.StackStatus == "DELETE_COMPLETE" {
+			continue
+		}
+
+		if strings.HasPrefix(stack.StackName, prefix) {
+			stacks = append(stacks, stack)
+		}
+	}
+
+	return stacks, nil
+}
+
+// RegionsError records each region which failed in ListAllRegions.
+type RegionsError struct {
+	Errors map[string]error
+}
+
+func (e *RegionsError) Error() string {
+	regions := []string{}
+	for region := range e.Errors {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	msgs := []string{}
+	for _, region := range regions {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", region, e.Errors[region]))
+	}
+	return "error listing stacks: " + strings.Join(msgs, "; ")
+}
+
+// List all stacks in each region, keyed by region. Up to MaxConcurrency
+// regions are listed at once, each with its own Client. The regions which
+// were listed are returned even if others failed, along with a
+// *RegionsError.
+func ListAllRegions(regions []string) (map[string][]stackSummary, error) {
+	var mu sync.Mutex
+	stacks := make(map[string][]stackSummary)
+	errs := &RegionsError{Errors: make(map[string]error)}
+
+	sem := make(chan struct{}, maxConcurrency())
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			listResp, err := NewClient(region).List()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs.Errors[region] = err
+				return
+			}
+			stacks[region] = listResp.Stacks
+		}(region)
+	}
+	wg.Wait()
+
+	if len(errs.Errors) > 0 {
+		return stacks, errs
 	}
-	defer resp.Body.Close()
+	return stacks, nil
+}
 
-	err = xml.NewDecoder(resp.Body).Decode(&listResp)
+// Check if a live stack exists, by name or full stack ID.
+func (c *Client) Exists(name string) (bool, error) {
+	resp, err := c.describeStacks("")
 	if err != nil {
-		return listResp, err
+		return false, err
+	}
+
+	for _, stack := range resp.Stacks {
+		if stack.matches(name) {
+			return true, nil
+		}
 	}
-	return listResp, nil
 
+	return false, nil
 }
 
-func Exists(name string) (bool, error) {
-	resp, err := DescribeStacks("")
+// Check if a live stack exists by its full stack ID, describing only that
+// stack. Deleted stacks can still be described by ID, so a stack in
+// DELETE_COMPLETE doesn't exist.
+func (c *Client) ExistsByID(stackID string) (bool, error) {
+	resp, err := c.describeStacks(stackID)
+	if isNotExist(err) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
 	for _, stack := range resp.Stacks {
-		if stack.Name == name {
+		if stack.matches(stackID) && stack.Status != "DELETE_COMPLETE" {
 			return true, nil
 		}
 	}
@@ -530,86 +1449,344 @@ func Exists(name string) (bool, error) {
 // Poll every 5s while the stack is in the CREATE_IN_PROGRESS or
 // UPDATE_IN_PROGRESS state, and succeed when it enters a successful _COMPLETE
 // state.
+// If the stack fails and is being rolled back or deleted (OnFailure=DELETE),
+// keep waiting until it settles, then return the failure.
+// Errors describing the stack, like throttling, are retried according to the
+// client's RetryPolicy.
 // Return and error of ErrTimeout if the timeout is reached.
-func Wait(name string, timeout time.Duration) error {
+func (c *Client) Wait(name string, timeout time.Duration) error {
+	_, err := c.wait(context.Background(), name, timeout, nil)
+	return err
+}
+
+// Like Wait, with options:
+//   AllowUpdateRollback: if "true", an update which rolled back to
+//                        UPDATE_ROLLBACK_COMPLETE isn't an error, since the
+//                        stack is still usable. By default it's a failure,
+//                        since the update wasn't applied.
+// A create which rolls back is always a failure.
+func (c *Client) WaitWithOptions(name string, timeout time.Duration, options map[string]string) error {
+	_, err := c.wait(context.Background(), name, timeout, nil)
+	if optionSet(options, "AllowUpdateRollback") && errors.Is(err, ErrUpdateRollbackComplete) {
+		return nil
+	}
+	return err
+}
+
+// Like Wait, but stop waiting and return the context's error once ctx is done.
+func (c *Client) WaitContext(ctx context.Context, name string, timeout time.Duration) error {
+	_, err := c.wait(ctx, name, timeout, nil)
+	return err
+}
+
+// Like Wait, but also return the stack's description once it has completed,
+// e.g. to read its Outputs without describing the stack again.
+func (c *Client) WaitAndDescribe(name string, timeout time.Duration) (stackDescription, error) {
+	return c.wait(context.Background(), name, timeout, nil)
+}
+
+// Wait for each of the named stacks concurrently, as with WaitContext. Up to
+// MaxConcurrency stacks are polled at once, and the timeout applies to all of
+// them together. The result of every stack is returned, keyed by name, with a
+// nil error for those which completed successfully.
+func (c *Client) WaitAll(ctx context.Context, names []string, timeout time.Duration) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	deadline := time.Now().Add(timeout)
+	sem := make(chan struct{}, maxConcurrency())
+
+	errs := make(map[string]error)
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			var err error
+			select {
+			case sem <- struct{}{}:
+				err = c.WaitContext(ctx, name, deadline.Sub(time.Now()))
+				<-sem
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// Like Wait, but also report the stack's progress on each poll.
+// onProgress receives the number of resources in a _COMPLETE state, and the
+// total number of resources in the stack. Since resources may be added as the
+// stack is created, the total can grow between calls, but neither value will
+// ever decrease. On success, the final call always reports done == total.
+func (c *Client) WaitWithProgress(name string, timeout time.Duration, onProgress func(done, total int)) error {
+	done, total := 0, 0
+	report := func(final bool) {
+		resp, err := c.ListStackResources(name)
+		if err != nil {
+			log.Debug("ListStackResources:", err)
+			if !final {
+				return
+			}
+		}
+
+		complete := 0
+		for _, res := range resp.Resources {
+			if strings.HasSuffix(res.Status, "_COMPLETE") {
+				complete++
+			}
+		}
+
+		if len(resp.Resources) > total {
+			total = len(resp.Resources)
+		}
+		if complete > done {
+			done = complete
+		}
+		if final {
+			done = total
+		}
+		if done > total {
+			total = done
+		}
+
+		onProgress(done, total)
+	}
+
+	_, err := c.wait(context.Background(), name, timeout, func(stack stackDescription) {
+		if stack.Status == "CREATE_IN_PROGRESS" || stack.Status == "UPDATE_IN_PROGRESS" {
+			report(false)
+		}
+	})
+	if err == nil {
+		report(true)
+	}
+	return err
+}
+
+// Like Wait, but call onStatus with the stack's status and status reason
+// whenever either changes, so that the reason for a long wait, like a
+// resource waiting on a signal, can be shown while the stack is in progress.
+func (c *Client) WaitWithStatus(name string, timeout time.Duration, onStatus func(status, reason string)) error {
+	status, reason := "", ""
+	_, err := c.wait(context.Background(), name, timeout, func(stack stackDescription) {
+		if stack.Status == status && stack.StatusReason == reason {
+			return
+		}
+
+		status, reason = stack.Status, stack.StatusReason
+		onStatus(status, reason)
+	})
+	return err
+}
+
+// wait implements Wait, calling poll (if not nil) with each description of
+// the stack. The stack's final description is returned on success.
+func (c *Client) wait(ctx context.Context, name string, timeout time.Duration, poll func(stackDescription)) (stackDescription, error) {
 	start := time.Now()
 	deadline := start.Add(timeout)
+
+	// the failure captured when the stack first entered a failed state, to
+	// be returned once the stack has settled.
+	var failure error
+
+	// the time to sleep before the next poll, which backs off according to
+	// the RetryPolicy while DescribeStacks is failing.
+	policy := c.retryPolicy()
+	delay := pollInterval
+	failedPolls := 0
+
 	for {
-		resp, err := DescribeStacks(name)
+		if err := ctx.Err(); err != nil {
+			return stackDescription{}, err
+		}
+
+		resp, err := c.describeStacks(name)
 		if err != nil {
-			if err, ok := err.(*aws.Error); ok {
-				// the call was successful, but AWS returned an error
-				// no need to wait.
-				return err
+			failedPolls++
+			if _, ok := err.(*aws.Error); ok {
+				// the stack was removed after failing, e.g. with OnFailure=DELETE
+				if failure != nil && isNotExist(err) {
+					return stackDescription{}, failure
+				}
+
+				// AWS returned an error, which is only worth waiting out if
+				// the RetryPolicy allows, e.g. when we're throttled.
+				if !policy.ShouldRetry(failedPolls, err) {
+					if failure != nil {
+						return stackDescription{}, failure
+					}
+					return stackDescription{}, err
+				}
 			}
 
 			// I guess we should sleep and retry here, in case of intermittent
 			// errors
 			log.Errorln("DescribeStacks:", err)
+			// the first retry is already one poll interval out
+			delay = policy.Delay(failedPolls + 1)
+			if delay < pollInterval {
+				delay = pollInterval
+			}
 			goto SLEEP
 		}
+		delay = pollInterval
+		failedPolls = 0
 
 		for _, stack := range resp.Stacks {
-			if stack.Name == name {
+			if stack.matches(name) {
+				if poll != nil {
+					poll(stack)
+				}
+
 				switch stack.Status {
 				case "CREATE_IN_PROGRESS", "UPDATE_IN_PROGRESS":
 					goto SLEEP
 				case "CREATE_COMPLETE", "UPDATE_COMPLETE", "UPDATE_COMPLETE_CLEANUP_IN_PROGRESS":
-					return nil
+					return stack, nil
+				case "ROLLBACK_IN_PROGRESS", "DELETE_IN_PROGRESS",
+					"UPDATE_ROLLBACK_IN_PROGRESS", "UPDATE_ROLLBACK_COMPLETE_CLEANUP_IN_PROGRESS":
+					// The stack has failed, and is still being cleaned up.
+					// Grab the failure now, since the events may be gone by
+					// the time the stack is deleted.
+					if failure == nil {
+						failure = c.stackFailure(name, stack, start)
+					}
+					goto SLEEP
 				default:
-					// see if we can caught the actual FAILURE
-					// start looking slightly before we started the watch.
-					// We're more likely to catch a quick event than we are to
-					// pickup something from a previous transaction.
-					failures, _ := ListFailures(name, start.Add(-2*time.Second))
-					if len(failures) > 0 {
-						return &FailuresError{
-							messages: failures,
+					if failure == nil {
+						failure = c.stackFailure(name, stack, start)
+
+						// A failed create may still be rolled back or deleted
+						// depending on OnFailure, so check once more before
+						// returning.
+						if stack.Status == "CREATE_FAILED" {
+							goto SLEEP
 						}
 					}
-
-					// we didn't catch the events for some reason, return our current status
-					return fmt.Errorf("%s: %s", stack.Status, stack.StatusReason)
+					return stackDescription{}, withFinalStatus(failure, stack.Status)
 				}
 			}
 		}
 
+		// the stack is no longer listed after failing
+		if failure != nil {
+			return stackDescription{}, failure
+		}
+
 	SLEEP:
 		if time.Now().After(deadline) {
-			return ErrTimeout
+			return stackDescription{}, ErrTimeout
 		}
 
-		time.Sleep(5 * time.Second)
+		if err := sleepContext(ctx, delay); err != nil {
+			return stackDescription{}, err
+		}
 	}
 }
 
-// List failures on a stack as "STATUS:REASON"
-func ListFailures(id string, since time.Time) ([]string, error) {
-	resp, err := DescribeStackEvents(id)
-	if err != nil {
-		return nil, err
+// Return the failure for a stack which has entered a failed state.
+func (c *Client) stackFailure(name string, stack stackDescription, start time.Time) error {
+	// see if we can caught the actual FAILURE
+	// start looking slightly before we started the watch.
+	// We're more likely to catch a quick event than we are to
+	// pickup something from a previous transaction.
+	events, _ := c.ListFailureEvents(name, start.Add(-2*time.Second))
+	if len(events) > 0 {
+		return &FailuresError{
+			messages: failureMessages(events),
+			events:   events,
+			status:   stack.Status,
+		}
 	}
 
-	fails := []string{}
+	// we didn't catch the events for some reason, return our current status
+	return &StatusError{Status: stack.Status, Reason: stack.StatusReason}
+}
+
+// Update a failure captured while the stack was still being cleaned up, so
+// that it matches the stack's final status.
+func withFinalStatus(failure error, status string) error {
+	switch err := failure.(type) {
+	case *FailuresError:
+		err.status = status
+	case *StatusError:
+		return &StatusError{Status: status, Reason: err.Reason}
+	}
+	return failure
+}
 
-	for _, event := range resp.Events {
-		status, reason := event.ResourceStatus, event.ResourceStatusReason
-		if event.Timestamp.After(since) && strings.HasSuffix(status, "_FAILED") {
-			fails = append(fails, fmt.Sprintf("%s: %s", status, reason))
+// Events this much older than the since time passed to ListFailures are
+// still read, in case the local clock is ahead of AWS.
+var eventsClockSkew = time.Minute
+
+// If set, the ResourceProperties of each failure event are passed through
+// this function, e.g. to mask passwords before the properties are printed.
+var RedactResourceProperties func(resourceType, properties string) string
+
+// List failures on a stack as "STATUS:REASON"
+// Events are read newest first, and no more pages are requested once the
+// events are older than since.
+func (c *Client) ListFailures(id string, since time.Time) ([]string, error) {
+	events, err := c.ListFailureEvents(id, since)
+	if err != nil {
+		return nil, err
+	}
+	return failureMessages(events), nil
+}
+
+// Like ListFailures, but return the failure events themselves, including
+// the ResourceProperties each failed resource was given.
+func (c *Client) ListFailureEvents(id string, since time.Time) ([]stackEvent, error) {
+	fails := []stackEvent{}
+	cutoff := since.Add(-eventsClockSkew)
+
+	err := c.eachStackEventsPage(id, func(page DescribeStackEventsResult) bool {
+		for _, event := range page.Events {
+			if event.Timestamp.Before(cutoff) {
+				return false
+			}
+
+			if event.Timestamp.After(since) && strings.HasSuffix(event.ResourceStatus, "_FAILED") {
+				if RedactResourceProperties != nil && event.ResourceProperties != "" {
+					event.ResourceProperties = RedactResourceProperties(event.ResourceType, event.ResourceProperties)
+				}
+				fails = append(fails, event)
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return fails, nil
 }
 
+// Format failure events as "STATUS:REASON"
+func failureMessages(events []stackEvent) []string {
+	fails := []string{}
+	for _, event := range events {
+		fails = append(fails, fmt.Sprintf("%s: %s", event.ResourceStatus, event.ResourceStatusReason))
+	}
+	return fails
+}
+
 // Like the Wait function, but instead if returning as soon as there is an
 // error, always wait for a final status.
 // ** This assumes all _COMPLETE statuses are final, and all final statuses end
 //    in _COMPLETE.
-func WaitForComplete(id string, timeout time.Duration) error {
+func (c *Client) WaitForComplete(id string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for {
-		resp, err := DescribeStacks(id)
+		resp, err := c.describeStacks(id)
 		if err != nil {
 			return err
 		} else if len(resp.Stacks) != 1 {
@@ -626,168 +1803,706 @@ func WaitForComplete(id string, timeout time.Duration) error {
 			return ErrTimeout
 		}
 
-		time.Sleep(5 * time.Second)
+		time.Sleep(pollInterval)
 	}
 }
 
+// Like WaitForComplete, but for a stack update. A rolled back update is
+// returned as a *FailuresError, since the intended change was not applied.
+func (c *Client) WaitForUpdate(name string, timeout time.Duration) error {
+	start := time.Now()
+	stack, err := c.waitSettled(name, timeout)
+	if err != nil {
+		return err
+	}
+
+	switch stack.Status {
+	case "UPDATE_COMPLETE":
+		return nil
+	case "UPDATE_ROLLBACK_COMPLETE", "UPDATE_ROLLBACK_FAILED":
+		events, _ := c.ListFailureEvents(name, start.Add(-2*time.Second))
+		failures := failureMessages(events)
+		if len(failures) == 0 {
+			failures = []string{fmt.Sprintf("%s: %s", stack.Status, stack.StatusReason)}
+		}
+		return &FailuresError{
+			messages: failures,
+			events:   events,
+			status:   stack.Status,
+		}
+	}
+
+	return &StatusError{Status: stack.Status, Reason: stack.StatusReason}
+}
+
+// Cancel an update in progress, and wait for the stack to roll back.
+// Returns an error if the rollback itself fails, in which case the stack will
+// need to be repaired before it can be updated again.
+func (c *Client) AbortUpdate(name string, timeout time.Duration) error {
+	start := time.Now()
+	if err := c.CancelUpdate(name); err != nil {
+		return err
+	}
+
+	stack, err := c.waitSettled(name, timeout)
+	if err != nil {
+		return err
+	}
+
+	switch stack.Status {
+	case "UPDATE_ROLLBACK_COMPLETE":
+		return nil
+	case "UPDATE_ROLLBACK_FAILED":
+		return fmt.Errorf("rollback of %s failed: %s", name, c.stackFailure(name, stack, start))
+	}
+
+	return fmt.Errorf("unexpected status after cancelling update of %s: %s: %s", name, stack.Status, stack.StatusReason)
+}
+
+// Poll a stack until it is no longer in an _IN_PROGRESS state, and return
+// its final description.
+func (c *Client) waitSettled(name string, timeout time.Duration) (stackDescription, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := c.describeStacks(name)
+		if err != nil {
+			return stackDescription{}, err
+		} else if len(resp.Stacks) != 1 {
+			return stackDescription{}, fmt.Errorf("could not find stack: %s", name)
+		}
+
+		stack := resp.Stacks[0]
+		if !strings.HasSuffix(stack.Status, "_IN_PROGRESS") {
+			return stack, nil
+		}
+
+		if time.Now().After(deadline) {
+			return stack, ErrTimeout
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// Wait for a stack to be deleted.
+// Succeed once the stack is DELETE_COMPLETE or no longer exists, and return
+// the stack's failures if it enters DELETE_FAILED.
+// Return and error of ErrTimeout if the timeout is reached.
+func (c *Client) WaitForDelete(name string, timeout time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		resp, err := c.describeStacks(name)
+		if err != nil {
+			if isNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, stack := range resp.Stacks {
+			if !stack.matches(name) {
+				continue
+			}
+
+			switch stack.Status {
+			case "DELETE_COMPLETE":
+				return nil
+			case "DELETE_FAILED":
+				return c.stackFailure(name, stack, start)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// Check if an error from AWS is because the requested stack doesn't exist
+func isNotExist(err error) bool {
+	awsErr, ok := err.(*aws.Error)
+	if !ok {
+		return false
+	}
+	return awsErr.Code == "ValidationError" && strings.Contains(awsErr.Message, "does not exist")
+}
+
+func isAlreadyExists(err error) bool {
+	awsErr, ok := err.(*aws.Error)
+	return ok && awsErr.Code == "AlreadyExistsException"
+}
+
 // Get a list of SSL certificates from the IAM service.
 // Cloudformation templates need to reference certs via their ARNs.
-func ListServerCertificates() (ListServerCertsResponse, error) {
+func (c *Client) ListServerCertificates() (ListServerCertsResponse, error) {
 	certResp := ListServerCertsResponse{}
 
-	svc, err := getService("iam", "")
+	svc, err := c.getService("iam")
 	if err != nil {
 		return certResp, err
 	}
 
-	params := map[string]string{
-		"Action":  "ListServerCertificates",
-		"Version": "2010-05-08",
+	params := map[string]string{
+		"Action":  "ListServerCertificates",
+		"Version": "2010-05-08",
+	}
+
+	if err := query(svc, params, &certResp); err != nil {
+		return certResp, err
+	}
+
+	return certResp, nil
+}
+
+// Return the SharedResources from our base stack that are needed for pool
+// stacks. We need the IDs for subnets and security groups, since they cannot
+// be referenced by name in a VPC. We also lookup the IAM instance profile
+// created by the base stack for use in pool's launch configs. If
+// SharedResourcesCacheDir is set, the results are cached to disk so that we
+// don't need to lookup the base stack to build every pool template. Cached
+// results expire after the SharedResourcesCacheTTL.
+func (c *Client) GetSharedResources(stackName string) (SharedResources, error) {
+	if SharedResourcesCacheDir == "" {
+		return c.getSharedResources(stackName)
+	}
+
+	path, err := c.sharedResourcesCachePath(stackName)
+	if err != nil {
+		return SharedResources{}, err
+	}
+
+	if shared, ok := readSharedResourcesCache(path); ok {
+		return shared, nil
+	}
+
+	shared, err := c.getSharedResources(stackName)
+	if err != nil {
+		return shared, err
+	}
+
+	if err := writeSharedResourcesCache(path, shared); err != nil {
+		log.Warnf("error caching SharedResources: %s", err)
+	}
+	return shared, nil
+}
+
+func (c *Client) getSharedResources(stackName string) (SharedResources, error) {
+	shared := SharedResources{
+		SecurityGroups: make(map[string]string),
+		Roles:          make(map[string]string),
+		Parameters:     make(map[string]string),
+		ServerCerts:    make(map[string]string),
+	}
+
+	// each request is retried on its own if we're throttled, rather than
+	// starting the lookup over
+	policy := c.retryPolicy()
+
+	// we need to use DescribeStacks to get any parameters that were used in
+	// the base stack, such as KeyName
+	var descResp DescribeStacksResponse
+	err := policy.Do(func() error {
+		var err error
+		descResp, err = c.DescribeStacks(stackName)
+		return err
+	})
+	if err != nil {
+		return shared, err
+	}
+
+	// load all parameters from the base stack into the shared values. The
+	// masked values of NoEcho parameters are left out, so they can't be
+	// passed on, or cached, as if they were real.
+	for _, stack := range descResp.Stacks {
+		if stack.matches(stackName) {
+			for _, param := range stack.Parameters {
+				if param.NoEcho {
+					continue
+				}
+				shared.Parameters[param.Key] = param.Value
+			}
+		}
+	}
+
+	var res ListStackResourcesResponse
+	err = policy.Do(func() error {
+		var err error
+		res, err = c.ListStackResources(stackName)
+		return err
+	})
+	if err != nil {
+		return shared, err
+	}
+
+	for _, resource := range res.Resources {
+		switch resource.Type {
+		case "AWS::EC2::SecurityGroup":
+			shared.SecurityGroups[resource.LogicalId] = resource.PhysicalId
+		case "AWS::IAM::InstanceProfile":
+			shared.Roles[resource.LogicalId] = resource.PhysicalId
+		case "AWS::EC2::VPC":
+			shared.VPCID = resource.PhysicalId
+		}
+	}
+
+	// a stack which doesn't create its own VPC may still name one
+	if shared.VPCID == "" {
+		for _, stack := range descResp.Stacks {
+			if stack.matches(stackName) {
+				shared.VPCID = stack.vpc()
+			}
+		}
+	}
+
+	// the subnets are in the same region as the stack
+	var snResp DescribeSubnetsResponse
+	err = policy.Do(func() error {
+		var err error
+		snResp, err = c.DescribeSubnets(shared.VPCID)
+		return err
+	})
+	if err != nil {
+		return shared, err
+	}
+	shared.Subnets = snResp.Subnets
+
+	// now we need to find any server certs we may have, retrying if we're
+	// throttled, since the error isn't returned
+	var certResp ListServerCertsResponse
+	err = policy.Do(func() error {
+		var err error
+		certResp, err = c.ListServerCertificates()
+		return err
+	})
+	if err != nil {
+		// we've made it this far, just log this error so we can at least get the CF data
+		log.Error("error listing server certificates:", err)
+	}
+
+	for _, cert := range certResp.Certs {
+		shared.ServerCerts[cert.ServerCertificateName] = cert.Arn
+	}
+
+	return shared, nil
+}
+
+// The most stacks fetched at once by functions which make requests
+// concurrently, to avoid being throttled by AWS.
+var MaxConcurrency = 4
+
+func maxConcurrency() int {
+	if MaxConcurrency < 1 {
+		return 1
+	}
+	return MaxConcurrency
+}
+
+// Get the SharedResources from several base stacks, e.g. separate network and
+// security stacks, merged into one. Up to MaxConcurrency stacks, along with
+// their server certificate lookups, are fetched at once, and each throttled
+// request is retried according to the client's RetryPolicy. An error
+// listing every collision is returned if the stacks define the same security
+// group, role or parameter with different values, or different VPCs. The
+// subnets are those of the stack containing the VPC.
+func (c *Client) GetSharedResourcesMulti(stackNames ...string) (SharedResources, error) {
+	merged := SharedResources{
+		SecurityGroups: make(map[string]string),
+		Roles:          make(map[string]string),
+		Parameters:     make(map[string]string),
+		ServerCerts:    make(map[string]string),
+	}
+
+	// the stack each value was taken from, keyed by "Kind.Key"
+	sources := make(map[string]string)
+	collisions := []string{}
+
+	merge := func(kind string, dst, src map[string]string, stackName string) {
+		for key, val := range src {
+			id := kind + "." + key
+			if prev, ok := sources[id]; ok && dst[key] != val {
+				collisions = append(collisions, fmt.Sprintf("%s in %s and %s", id, prev, stackName))
+				continue
+			}
+			dst[key] = val
+			sources[id] = stackName
+		}
+	}
+
+	// fetch the stacks concurrently, but merge them in order
+	results := make([]SharedResources, len(stackNames))
+	errs := make([]error, len(stackNames))
+	sem := make(chan struct{}, maxConcurrency())
+	var wg sync.WaitGroup
+	for i, name := range stackNames {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i], errs[i] = c.GetSharedResources(name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, name := range stackNames {
+		if errs[i] != nil {
+			return merged, errs[i]
+		}
+		shared := results[i]
+
+		merge("SecurityGroups", merged.SecurityGroups, shared.SecurityGroups, name)
+		merge("Roles", merged.Roles, shared.Roles, name)
+		merge("Parameters", merged.Parameters, shared.Parameters, name)
+		merge("ServerCerts", merged.ServerCerts, shared.ServerCerts, name)
+
+		if shared.VPCID == "" {
+			continue
+		}
+
+		if merged.VPCID != "" && merged.VPCID != shared.VPCID {
+			collisions = append(collisions, fmt.Sprintf("VPC in %s and %s", sources["VPC"], name))
+			continue
+		}
+
+		merged.VPCID = shared.VPCID
+		merged.Subnets = shared.Subnets
+		sources["VPC"] = name
+	}
+
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return merged, fmt.Errorf("conflicting shared resources: %s", strings.Join(collisions, "; "))
+	}
+
+	return merged, nil
+}
+
+// Template stages which can be requested from GetTemplateStage
+const (
+	TemplateStageOriginal  = "Original"
+	TemplateStageProcessed = "Processed"
+)
+
+// Get the original template for a stack
+func (c *Client) GetTemplate(name string) ([]byte, error) {
+	return c.GetTemplateStage(name, TemplateStageOriginal)
+}
+
+// Get a stack's template, parsed into a generic map for inspection, e.g. to
+// list its Resources or Parameters. The template may be JSON or YAML.
+func (c *Client) GetTemplateParsed(name string) (map[string]interface{}, error) {
+	body, err := c.GetTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := parseTemplate(body)
+	if err != nil {
+		return nil, fmt.Errorf("template for %s: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+// Get a stack's template at the given stage. The Processed stage reflects
+// any transforms applied to the Original template. An empty stage defaults to
+// Original.
+func (c *Client) GetTemplateStage(name, stage string) ([]byte, error) {
+	tmplResp, err := c.DescribeTemplate(name, stage)
+	return tmplResp.TemplateBody, err
+}
+
+// Get a stack's template at the given stage, along with the stages which are
+// available for the template.
+func (c *Client) DescribeTemplate(name, stage string) (GetTemplateResponse, error) {
+	tmplResp := GetTemplateResponse{}
+
+	svc, err := c.getService("cf")
+	if err != nil {
+		return tmplResp, err
+	}
+
+	if stage == "" {
+		stage = TemplateStageOriginal
+	}
+
+	params := map[string]string{
+		"Action":        "GetTemplate",
+		"StackName":     name,
+		"TemplateStage": stage,
+	}
+
+	err = query(svc, params, &tmplResp)
+	return tmplResp, err
+}
+
+// Return everything needed to recreate a stack elsewhere: its template, its
+// parameters, and its tags, with the default Name tag and AWS's own tags left
+// out. The values of NoEcho parameters can't be read, so they're left out of
+// params, and their names are returned in noEcho.
+func (c *Client) ExportStack(name string) (template []byte, params, tags map[string]string, noEcho []string, err error) {
+	template, err = c.GetTemplate(name)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	descResp, err := c.DescribeStacks(name)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	for _, stack := range descResp.Stacks {
+		if !stack.matches(name) {
+			continue
+		}
+
+		params = make(map[string]string)
+		noEcho = []string{}
+		for _, param := range stack.Parameters {
+			if param.NoEcho {
+				noEcho = append(noEcho, param.Key)
+				continue
+			}
+			params[param.Key] = param.Value
+		}
+		sort.Strings(noEcho)
+
+		tags = make(map[string]string)
+		for _, tag := range stack.Tags {
+			if strings.HasPrefix(tag.Key, "aws:") || (tag.Key == "Name" && tag.Value == stack.Name) {
+				continue
+			}
+			tags[tag.Key] = tag.Value
+		}
+
+		return template, params, tags, noEcho, nil
+	}
+
+	return nil, nil, nil, nil, fmt.Errorf("could not find stack: %s", name)
+}
+
+// The largest template AWS accepts as a TemplateBody
+const MaxTemplateBodySize = 51200
+
+// TemplateTooLargeError is returned by Create and Update for a template over
+// MaxTemplateBodySize, which AWS would reject.
+type TemplateTooLargeError struct {
+	Size int
+}
+
+func (e *TemplateTooLargeError) Error() string {
+	return fmt.Sprintf("template is %d bytes, over the %d byte limit for an inline template; "+
+		"upload it with UploadTemplate and use its TemplateURL instead", e.Size, MaxTemplateBodySize)
+}
+
+func checkTemplateSize(stackTmpl []byte) error {
+	if len(stackTmpl) > MaxTemplateBodySize {
+		return &TemplateTooLargeError{Size: len(stackTmpl)}
+	}
+	return nil
+}
+
+// how long Create waits for a failed stack to be deleted with the
+// DeleteFailedBeforeCreate option
+var deleteFailedTimeout = 10 * time.Minute
+
+// The longest name CloudFormation accepts for a stack
+const maxStackNameLength = 128
+
+var (
+	stackNameRe        = regexp.MustCompile(`^[a-zA-Z][-a-zA-Z0-9]*$`)
+	invalidStackNameRe = regexp.MustCompile(`[^-a-zA-Z0-9]+`)
+)
+
+// Check that a name is accepted by CloudFormation as a stack name.
+func ValidStackName(name string) error {
+	if len(name) > maxStackNameLength {
+		return fmt.Errorf("invalid stack name %q: longer than %d characters", name, maxStackNameLength)
+	}
+
+	if !stackNameRe.MatchString(name) {
+		return fmt.Errorf("invalid stack name %q: must start with a letter and contain only letters, numbers and hyphens", name)
+	}
+	return nil
+}
+
+// Coerce a name, like a pool name, into a valid stack name. Runs of invalid
+// characters are replaced by a hyphen, and names which don't start with a
+// letter are prefixed with "stack-".
+func SanitizeStackName(name string) string {
+	name = invalidStackNameRe.ReplaceAllString(name, "-")
+	if !stackNameRe.MatchString(name) {
+		name = "stack-" + name
+	}
+
+	if len(name) > maxStackNameLength {
+		name = name[:maxStackNameLength]
+	}
+	return name
+}
+
+// Create a CloudFormation stack
+// Request parameters which are taken from the options:
+//   StackPolicyDuringUpdateBody: optional update policy
+//   StackPolicyBody: optional policy for the stack
+//   tag.KEY: tags to be applied to this stack at creation
+//   RollbackAlarms: comma separated ARNs of CloudWatch alarms which roll back
+//                   the stack if they go off during the operation
+//   RollbackMonitoringMinutes: how long to keep watching the RollbackAlarms
+//                              after the operation completes
+// Other options:
+//   DeleteFailedBeforeCreate: if "true", and a stack with the same name
+//                             already exists in ROLLBACK_COMPLETE, delete the
+//                             failed stack, wait for the delete, and retry
+//                             the create once.
+//   RetryIAMErrors: if "true", retry the create with backoff when it fails
+//                   because an IAM role or instance profile isn't visible
+//                   yet.
+//   NoDefaultNameTag: if "true", don't tag the stack with Name=<name>.
+//   ValidateParameters: if "true", check the parameters against the template
+//                       with ValidateParameters first, returning its
+//                       *ParameterError rather than making a create which
+//                       would fail.
+func (c *Client) Create(name string, stackTmpl []byte, options map[string]string) (*CreateStackResponse, error) {
+	if err := ValidStackName(name); err != nil {
+		return nil, err
+	}
+
+	if err := checkTemplateSize(stackTmpl); err != nil {
+		return nil, err
+	}
+
+	if optionSet(options, "ValidateParameters") {
+		if err := ValidateParameters(stackTmpl, options); err != nil {
+			return nil, err
+		}
+	}
+
+	createResp, err := c.createStackRetry(name, stackTmpl, options)
+	if err == nil || !optionSet(options, "DeleteFailedBeforeCreate") || !isAlreadyExists(err) {
+		return createResp, err
 	}
 
-	resp, err := svc.Query("POST", "/", params)
-	if err != nil {
-		return certResp, err
+	// only a stack that failed to create can be safely replaced
+	desc, descErr := c.describeStacks(name)
+	if descErr != nil || len(desc.Stacks) == 0 || desc.Stacks[0].Status != "ROLLBACK_COMPLETE" {
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return certResp, err
+	log.Debugf("deleting failed stack %s before create", name)
+	if _, err := c.Delete(name); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	err = xml.NewDecoder(resp.Body).Decode(&certResp)
-	if err != nil {
-		return certResp, err
+	if err := c.WaitForDelete(name, deleteFailedTimeout); err != nil {
+		return nil, err
 	}
 
-	return certResp, nil
+	return c.createStackRetry(name, stackTmpl, options)
 }
 
-// Return the SharedResources from our base stack that are needed for pool
-// stacks. We need the IDs for subnets and security groups, since they cannot
-// be referenced by name in a VPC. We also lookup the IAM instance profile
-// created by the base stack for use in pool's launch configs.  This could be
-// cached to disk so that we don't need to lookup the base stack to build a
-// pool template.
-func GetSharedResources(stackName string) (SharedResources, error) {
-	shared := SharedResources{
-		SecurityGroups: make(map[string]string),
-		Roles:          make(map[string]string),
-		Parameters:     make(map[string]string),
-		ServerCerts:    make(map[string]string),
-	}
+// how many times a create is retried with the RetryIAMErrors option
+var iamRetries = 4
 
-	// we need to use DescribeStacks to get any parameters that were used in
-	// the base stack, such as KeyName
-	descResp, err := DescribeStacks(stackName)
-	if err != nil {
-		return shared, err
+// Create a stack, retrying IAM errors if the RetryIAMErrors option is set.
+func (c *Client) createStackRetry(name string, stackTmpl []byte, options map[string]string) (*CreateStackResponse, error) {
+	policy := c.retryPolicy()
+	policy.MaxAttempts = iamRetries + 1
+	policy.Retryable = func(err error) bool {
+		return optionSet(options, "RetryIAMErrors") && isIAMPropagationError(err)
 	}
 
-	// load all parameters from the base stack into the shared values
-	for _, stack := range descResp.Stacks {
-		if stack.Name == stackName {
-			for _, param := range stack.Parameters {
-				shared.Parameters[param.Key] = param.Value
-			}
+	for attempt := 1; ; attempt++ {
+		createResp, err := c.createStack(name, stackTmpl, options)
+		if !policy.ShouldRetry(attempt, err) {
+			return createResp, err
 		}
-	}
 
-	res, err := ListStackResources(stackName)
-	if err != nil {
-		return shared, err
+		log.Debugf("retrying create of %s: %s", name, err)
+		sleep(policy.Delay(attempt))
 	}
+}
 
-	for _, resource := range res.Resources {
-		switch resource.Type {
-		case "AWS::EC2::SecurityGroup":
-			shared.SecurityGroups[resource.LogicalId] = resource.PhysicalId
-		case "AWS::IAM::InstanceProfile":
-			shared.Roles[resource.LogicalId] = resource.PhysicalId
-		case "AWS::EC2::VPC":
-			shared.VPCID = resource.PhysicalId
-		}
+// Check for the validation errors caused by a new IAM role or instance
+// profile which hasn't propagated yet.
+func isIAMPropagationError(err error) bool {
+	awsErr, ok := err.(*aws.Error)
+	if !ok || awsErr.Code != "ValidationError" {
+		return false
 	}
 
-	// NOTE: using default AZ
-	snResp, err := DescribeSubnets(shared.VPCID, "")
-	if err != nil {
-		return shared, err
+	msg := strings.ToLower(awsErr.Message)
+	switch {
+	case strings.Contains(msg, "cannot be assumed"):
+		return true
+	case strings.Contains(msg, "invalid iaminstanceprofile"):
+		return true
+	case strings.Contains(msg, "role") && (strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist")):
+		return true
 	}
-	shared.Subnets = snResp.Subnets
+	return false
+}
 
-	// now we need to find any server certs we may have
-	certResp, err := ListServerCertificates()
-	if err != nil {
-		// we've made it this far, just log this error so we can at least get the CF data
-		log.Error("error listing server certificates:", err)
+// Set the RollbackConfiguration request params from the RollbackAlarms and
+// RollbackMonitoringMinutes options.
+func setRollbackConfiguration(params, options map[string]string) error {
+	if alarms := options["RollbackAlarms"]; alarms != "" {
+		for i, arn := range strings.Split(alarms, ",") {
+			prefix := fmt.Sprintf("RollbackConfiguration.RollbackTriggers.member.%d.", i+1)
+			params[prefix+"Arn"] = strings.TrimSpace(arn)
+			params[prefix+"Type"] = "AWS::CloudWatch::Alarm"
+		}
 	}
 
-	for _, cert := range certResp.Certs {
-		shared.ServerCerts[cert.ServerCertificateName] = cert.Arn
+	if minutes := options["RollbackMonitoringMinutes"]; minutes != "" {
+		if n, err := strconv.Atoi(minutes); err != nil || n < 0 {
+			return fmt.Errorf("invalid RollbackMonitoringMinutes: %q", minutes)
+		}
+		params["RollbackConfiguration.MonitoringTimeInMinutes"] = minutes
 	}
-
-	return shared, nil
+	return nil
 }
 
-func GetTemplate(name string) ([]byte, error) {
-	svc, err := getService("cf", "")
+func (c *Client) createStack(name string, stackTmpl []byte, options map[string]string) (*CreateStackResponse, error) {
+	svc, err := c.getService("cf")
 	if err != nil {
 		return nil, err
 	}
+	c.logTemplate(name, stackTmpl)
 
 	params := map[string]string{
-		"Action":    "GetTemplate",
-		"StackName": name,
-	}
-
-	resp, err := svc.Query("POST", "/", params)
-	if err != nil {
-		return nil, err
+		"Action":       "CreateStack",
+		"StackName":    name,
+		"TemplateBody": string(stackTmpl),
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
+	if err := setRollbackConfiguration(params, options); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	tmplResp := GetTemplateResponse{}
-	err = xml.NewDecoder(resp.Body).Decode(&tmplResp)
-
-	return tmplResp.TemplateBody, err
-}
-
-// Create a CloudFormation stack
-// Request parameters which are taken from the options:
-//   StackPolicyDuringUpdateBody: optional update policy
-//   tag.KEY: tags to be applied to this stack at creation
-func Create(name string, stackTmpl []byte, options map[string]string) (*CreateStackResponse, error) {
-	svc, err := getService("cf", "")
-	if err != nil {
-		return nil, err
+	optNum := 1
+	tagNum := 1
+	if !optionSet(options, "NoDefaultNameTag") {
+		setTagParam(params, tagNum, "Name", name)
+		tagNum++
 	}
 
-	params := map[string]string{
-		"Action":              "CreateStack",
-		"StackName":           name,
-		"TemplateBody":        string(stackTmpl),
-		"Tags.member.1.Key":   "Name",
-		"Tags.member.1.Value": name,
-	}
+	for _, key := range sortedKeys(options) {
+		val := options[key]
+		if key == "StackPolicyDuringUpdateBody" || key == "StackPolicyBody" {
+			params[key] = val
+			continue
+		}
 
-	optNum := 1
-	tagNum := 2
-	for key, val := range options {
-		if key == "StackPolicyDuringUpdateBody" {
-			params["StackPolicyDuringUpdateBody"] = val
+		if nonParameterOptions[key] {
 			continue
 		}
 
-		if strings.HasPrefix(strings.ToLower(key), "tag.") {
-			params[fmt.Sprintf("Tags.member.%d.Key", tagNum)] = key[4:]
-			params[fmt.Sprintf("Tags.member.%d.Value", tagNum)] = val
+		if tagKey, ok := tagOption(key); ok {
+			setTagParam(params, tagNum, tagKey, val)
 			tagNum++
 			continue
 		}
@@ -798,34 +2513,75 @@ func Create(name string, stackTmpl []byte, options map[string]string) (*CreateSt
 		optNum++
 	}
 
-	resp, err := svc.Query("POST", "/", params)
+	createResp := &CreateStackResponse{}
+	err = query(svc, params, createResp)
+	c.forgetDescribeStacks(name)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return nil, err
-	}
-	defer resp.Body.Close()
+	return createResp, nil
+}
 
-	createResp := &CreateStackResponse{}
-	err = xml.NewDecoder(resp.Body).Decode(createResp)
+// Create a CloudFormation stack, and Wait for it to complete.
+// If the stack fails to create, the error will be a *FailuresError listing
+// the failures from the stack's events when they are available.
+func (c *Client) CreateAndWait(name string, stackTmpl []byte, options map[string]string, timeout time.Duration) (*CreateStackResponse, error) {
+	createResp, err := c.Create(name, stackTmpl, options)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := c.Wait(name, timeout); err != nil {
+		return createResp, err
+	}
+
 	return createResp, nil
 }
 
 // Update an existing CloudFormation stack.
 // Request parameters which are taken from the options:
-//   StackPolicyDuringUpdateBody
-func Update(name string, stackTmpl []byte, options map[string]string) (*UpdateStackResponse, error) {
-	svc, err := getService("cf", "")
+//   StackPolicyDuringUpdateBody: a policy which only applies during this
+//                                update, overriding the stack's policy
+//   StackPolicyBody: a new policy for the stack, replacing the current policy
+//                    as part of the update
+//   RollbackAlarms, RollbackMonitoringMinutes: as for Create
+// Other options:
+//   CheckDrift: if "true", first run drift detection on the stack, and
+//               return a *DriftError rather than update a drifted stack.
+//   AllowDrift: if "true", update the stack even when CheckDrift finds drift.
+//   InheritParameters: if "true", keep the current value of every stack
+//                      parameter not given in the options. NoEcho parameters
+//                      are kept with UsePreviousValue.
+func (c *Client) Update(name string, stackTmpl []byte, options map[string]string) (*UpdateStackResponse, error) {
+	if err := checkTemplateSize(stackTmpl); err != nil {
+		return nil, err
+	}
+
+	// NoEcho parameters to be sent with UsePreviousValue
+	var previous []string
+	if optionSet(options, "InheritParameters") {
+		var err error
+		options, previous, err = c.inheritParameters(name, stackTmpl, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if optionSet(options, "CheckDrift") {
+		err := c.CheckDrift(name)
+		if _, drifted := err.(*DriftError); drifted && optionSet(options, "AllowDrift") {
+			log.Warnf("updating anyway: %s", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	svc, err := c.getService("cf")
 	if err != nil {
 		return nil, err
 	}
+	c.logTemplate(name, stackTmpl)
 
 	params := map[string]string{
 		"Action":       "UpdateStack",
@@ -833,14 +2589,23 @@ func Update(name string, stackTmpl []byte, options map[string]string) (*UpdateSt
 		"TemplateBody": string(stackTmpl),
 	}
 
+	if err := setRollbackConfiguration(params, options); err != nil {
+		return nil, err
+	}
+
 	optNum := 1
-	for key, val := range options {
-		if key == "StackPolicyDuringUpdateBody" {
-			params["StackPolicyDuringUpdateBody"] = val
+	for _, key := range sortedKeys(options) {
+		val := options[key]
+		if key == "StackPolicyDuringUpdateBody" || key == "StackPolicyBody" {
+			params[key] = val
+			continue
+		}
+
+		if nonParameterOptions[key] {
 			continue
 		}
 
-		if strings.HasPrefix(strings.ToLower(key), "tag.") {
+		if _, ok := tagOption(key); ok {
 			// Currently can't update a stack's tags
 			continue
 		}
@@ -850,59 +2615,370 @@ func Update(name string, stackTmpl []byte, options map[string]string) (*UpdateSt
 		optNum++
 	}
 
-	resp, err := svc.Query("POST", "/", params)
+	for _, key := range previous {
+		params[fmt.Sprintf("Parameters.member.%d.ParameterKey", optNum)] = key
+		params[fmt.Sprintf("Parameters.member.%d.UsePreviousValue", optNum)] = "true"
+		optNum++
+	}
+
+	updateResp := &UpdateStackResponse{}
+	err = query(svc, params, updateResp)
+	c.forgetDescribeStacks(name)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
-		return nil, err
+	return updateResp, nil
+
+}
+
+// Merge a stack's current parameters under the options, returning the merged
+// options, and the names of any NoEcho parameters which weren't given. Their
+// masked values can't be sent back, so they're returned separately. Only
+// parameters declared by the new template are inherited, since UpdateStack
+// rejects any others.
+func (c *Client) inheritParameters(name string, stackTmpl []byte, options map[string]string) (map[string]string, []string, error) {
+	tmpl, err := parseTemplate(stackTmpl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("template: %s", err)
 	}
-	defer resp.Body.Close()
+	declared, _ := tmpl["Parameters"].(map[string]interface{})
 
-	updateResp := &UpdateStackResponse{}
-	err = xml.NewDecoder(resp.Body).Decode(updateResp)
+	desc, err := c.describeStacks(name)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return updateResp, nil
+	merged := make(map[string]string)
+	previous := []string{}
+	for _, stack := range desc.Stacks {
+		if !stack.matches(name) {
+			continue
+		}
+
+		for _, param := range stack.Parameters {
+			if _, ok := options[param.Key]; ok {
+				continue
+			}
+
+			// the new template may no longer declare it
+			if _, ok := declared[param.Key]; !ok {
+				continue
+			}
 
+			if param.NoEcho {
+				previous = append(previous, param.Key)
+				continue
+			}
+			merged[param.Key] = param.Value
+		}
+	}
+
+	for key, val := range options {
+		merged[key] = val
+	}
+
+	sort.Strings(previous)
+	return merged, previous, nil
 }
 
-// Delete and entire stack by name
-func Delete(name string) (*DeleteStackResponse, error) {
-	svc, err := getService("cf", "")
+// Check if a stack can be updated: it exists, and is in a stable state from
+// which an update can start. If not, the reason is returned. Errors are only
+// returned for failures to check the stack.
+func (c *Client) CanUpdate(name string) (bool, string, error) {
+	return c.CanUpdateWithOptions(name, nil)
+}
+
+// Like CanUpdate, with options:
+//   CheckDrift: if "true", also run drift detection, and a drifted stack
+//               can't be updated.
+func (c *Client) CanUpdateWithOptions(name string, options map[string]string) (bool, string, error) {
+	resp, err := c.describeStacks(name)
+	if isNotExist(err) {
+		return false, fmt.Sprintf("stack %s does not exist", name), nil
+	}
 	if err != nil {
-		return nil, err
+		return false, "", err
+	}
+
+	if len(resp.Stacks) == 0 {
+		return false, fmt.Sprintf("stack %s does not exist", name), nil
+	}
+
+	status := resp.Stacks[0].Status
+	switch {
+	case status == "CREATE_COMPLETE", status == "UPDATE_COMPLETE", status == "UPDATE_ROLLBACK_COMPLETE",
+		status == "IMPORT_COMPLETE", status == "IMPORT_ROLLBACK_COMPLETE":
+	case strings.HasSuffix(status, "_IN_PROGRESS"):
+		return false, fmt.Sprintf("stack %s is in %s; wait for the operation to finish", name, status), nil
+	case status == "ROLLBACK_COMPLETE":
+		return false, fmt.Sprintf("stack %s failed to create; delete and create it again", name), nil
+	case status == "UPDATE_ROLLBACK_FAILED":
+		return false, fmt.Sprintf("stack %s is in %s; continue the rollback first", name, status), nil
+	default:
+		return false, fmt.Sprintf("stack %s is in %s, which can't be updated", name, status), nil
+	}
+
+	if optionSet(options, "CheckDrift") {
+		err := c.CheckDrift(name)
+		if _, drifted := err.(*DriftError); drifted {
+			return false, err.Error(), nil
+		} else if err != nil {
+			return false, "", err
+		}
+	}
+
+	return true, "", nil
+}
+
+// Cancel an update in progress. The stack will be rolled back to its previous
+// state.
+func (c *Client) CancelUpdate(name string) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
 	}
 
 	params := map[string]string{
-		"Action":    "DeleteStack",
+		"Action":    "CancelUpdateStack",
 		"StackName": name,
 	}
 
-	resp, err := svc.Query("POST", "/", params)
+	if err := query(svc, params, &struct{}{}); err != nil {
+		return err
+	}
+	c.forgetDescribeStacks(name)
+
+	return nil
+}
+
+// Add or replace tags on an existing stack, without changing its template or
+// parameters. CloudFormation replaces the full set of tags on update, so the
+// given tags are merged with the stack's current tags.
+func (c *Client) SetTags(name string, tags map[string]string) error {
+	desc, err := c.describeStacks(name)
+	if err != nil {
+		return err
+	}
+
+	if len(desc.Stacks) == 0 {
+		return fmt.Errorf("stack %s not found", name)
+	}
+	stack := desc.Stacks[0]
+
+	merged := stack.TagsMap()
+	for key, val := range tags {
+		merged[key] = val
+	}
+
+	svc, err := c.getService("cf")
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	params := map[string]string{
+		"Action":              "UpdateStack",
+		"StackName":           name,
+		"UsePreviousTemplate": "true",
+	}
+
+	for i, param := range stack.Parameters {
+		params[fmt.Sprintf("Parameters.member.%d.ParameterKey", i+1)] = param.Key
+		params[fmt.Sprintf("Parameters.member.%d.UsePreviousValue", i+1)] = "true"
+	}
+
+	for i, capability := range stack.Capabilities {
+		params[fmt.Sprintf("Capabilities.member.%d", i+1)] = capability
+	}
+
+	for i, key := range sortedKeys(merged) {
+		setTagParam(params, i+1, key, merged[key])
+	}
+
+	err = query(svc, params, &struct{}{})
+	c.forgetDescribeStacks(name)
+	return err
+}
+
+// Delete and entire stack by name
+func (c *Client) Delete(name string) (*DeleteStackResponse, error) {
+	return c.DeleteWithOptions(name, nil)
+}
+
+// TerminationProtectedError is returned when deleting a stack with termination
+// protection enabled.
+type TerminationProtectedError struct {
+	Stack string
+	Err   error
+}
+
+func (e *TerminationProtectedError) Error() string {
+	return fmt.Sprintf("stack %s has termination protection enabled, and was not deleted", e.Stack)
+}
+
+// Check if an error is due to the stack's termination protection
+func isTerminationProtected(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "TerminationProtection is enabled")
+}
+
+// Delete a stack, with the following options:
+//   CheckImports:         if "true", first verify that none of the stack's
+//                         exports are imported by another stack, returning an
+//                         *ExportInUseError if they are.
+//   ForceDeleteProtected: if "true", first disable the stack's termination
+//                         protection. Otherwise a protected stack returns a
+//                         *TerminationProtectedError.
+//   ClientRequestToken:   the token identifying this delete in the stack's
+//                         events. If not set, a random token is used. Either
+//                         way, the token is returned in the response.
+func (c *Client) DeleteWithOptions(name string, options map[string]string) (*DeleteStackResponse, error) {
+	if optionSet(options, "CheckImports") {
+		if err := c.checkImports(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if optionSet(options, "ForceDeleteProtected") {
+		if err := c.updateTerminationProtection(name, false); err != nil {
+			return nil, err
+		}
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err := svc.BuildError(resp)
+	svc, err := c.getService("cf")
+	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+
+	token := options["ClientRequestToken"]
+	if token == "" {
+		token, err = newRequestToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := map[string]string{
+		"Action":             "DeleteStack",
+		"StackName":          name,
+		"ClientRequestToken": token,
+	}
 
 	deleteResp := &DeleteStackResponse{}
-	err = xml.NewDecoder(resp.Body).Decode(deleteResp)
+	err = query(svc, params, deleteResp)
+	c.forgetDescribeStacks(name)
+	if isTerminationProtected(err) {
+		return nil, &TerminationProtectedError{Stack: name, Err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	deleteResp.ClientRequestToken = token
 	return deleteResp, nil
 }
 
+// Return a random ClientRequestToken
+func newRequestToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "galaxy-" + hex.EncodeToString(b), nil
+}
+
+// Enable or disable a stack's termination protection
+func (c *Client) updateTerminationProtection(name string, enabled bool) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{
+		"Action":                      "UpdateTerminationProtection",
+		"StackName":                   name,
+		"EnableTerminationProtection": strconv.FormatBool(enabled),
+	}
+
+	if err := query(svc, params, &struct{}{}); err != nil {
+		return err
+	}
+	c.forgetDescribeStacks(name)
+	return nil
+}
+
+// how long DeleteAll waits for each stack to be deleted
+var deleteAllTimeout = 30 * time.Minute
+
+// DeleteAllError records each stack that could not be deleted by DeleteAll.
+type DeleteAllError struct {
+	Stacks []string
+	Errors []error
+}
+
+func (e *DeleteAllError) Error() string {
+	msgs := []string{}
+	for i, name := range e.Stacks {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e.Errors[i]))
+	}
+	return "error deleting stacks: " + strings.Join(msgs, "; ")
+}
+
+// Delete a list of stacks in order, waiting for each to be deleted before
+// moving on to the next. Stacks which depend on others, like pools on their
+// base stack, must come first.
+// Deletion continues after a failure, and all failures are returned as a
+// *DeleteAllError.
+func (c *Client) DeleteAll(names []string) error {
+	errs := &DeleteAllError{}
+	for _, name := range names {
+		_, err := c.Delete(name)
+		if err == nil {
+			err = c.WaitForDelete(name, deleteAllTimeout)
+		}
+
+		if err != nil {
+			errs.Stacks = append(errs.Stacks, name)
+			errs.Errors = append(errs.Errors, err)
+		}
+	}
+
+	if len(errs.Stacks) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Return the keys of a map in sorted order, so that request parameters are
+// always numbered the same way.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Return the tag key of a tag.KEY option, if the option is a tag.
+func tagOption(key string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(key), "tag.") {
+		return "", false
+	}
+	return key[4:], true
+}
+
+// Set the request params for tag number n, counting from 1.
+func setTagParam(params map[string]string, n int, key, val string) {
+	params[fmt.Sprintf("Tags.member.%d.Key", n)] = key
+	params[fmt.Sprintf("Tags.member.%d.Value", n)] = val
+}
+
+// Check if a boolean option is set to a true value
+func optionSet(options map[string]string, key string) bool {
+	set, _ := strconv.ParseBool(options[key])
+	return set
+}
+
 // Return a default template to create our base stack.
 func DefaultGalaxyTemplate() []byte {
 	azResp, err := DescribeAvailabilityZones("")
@@ -916,7 +2992,7 @@ func DefaultGalaxyTemplate() []byte {
 		VPCCIDR: "10.24.0.1/16",
 	}
 
-	for i, az := range azResp.AvailabilityZones {
+	for i, az := range azResp.StandardZones() {
 		s := &SubnetTmplParams{
 			Name:   fmt.Sprintf("galaxySubnet%d", i+1),
 			Subnet: fmt.Sprintf("10.24.%d.0/24", i+1),
@@ -936,8 +3012,8 @@ func DefaultGalaxyTemplate() []byte {
 
 // set a stack policy
 // TODO: add delete policy
-func SetPolicy(name string, policy []byte) error {
-	svc, err := getService("cf", "")
+func (c *Client) SetPolicy(name string, policy []byte) error {
+	svc, err := c.getService("cf")
 	if err != nil {
 		return err
 	}
@@ -948,14 +3024,5 @@ func SetPolicy(name string, policy []byte) error {
 		"StackPolicyBody": string(policy),
 	}
 
-	resp, err := svc.Query("POST", "/", params)
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return svc.BuildError(resp)
-	}
-
-	return nil
+	return query(svc, params, &struct{}{})
 }
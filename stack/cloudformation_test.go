@@ -0,0 +1,3071 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+
+	"github.com/litl/galaxy/log"
+)
+
+const testRegion = "galaxy-test-1"
+
+// testServer fakes the AWS query APIs, dispatching each request on its
+// Action parameter. Every request's parameters are recorded for inspection.
+type testServer struct {
+	*httptest.Server
+
+	t        *testing.T
+	mu       sync.Mutex
+	handlers map[string]func(url.Values) (int, string)
+	requests []url.Values
+
+	// state to restore on Close
+	awsRegion    string
+	prevRegion   aws.Region
+	region       string
+	pollInterval time.Duration
+	env          map[string]string
+}
+
+// Start a testServer, and make it the package's default region.
+func newTestServer(t *testing.T) *testServer {
+	s := newRegionTestServer(t, testRegion)
+	Region = testRegion
+	return s
+}
+
+// Start a testServer, and point all AWS endpoints for region at it.
+func newRegionTestServer(t *testing.T, region string) *testServer {
+	s := &testServer{
+		t:            t,
+		handlers:     make(map[string]func(url.Values) (int, string)),
+		awsRegion:    region,
+		prevRegion:   aws.Regions[region],
+		region:       Region,
+		pollInterval: pollInterval,
+		env:          make(map[string]string),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	aws.Regions[region] = aws.Region{
+		Name:                   region,
+		EC2Endpoint:            s.URL,
+		IAMEndpoint:            s.URL,
+		CloudFormationEndpoint: s.URL,
+		SQSEndpoint:            s.URL,
+		STSEndpoint:            s.URL,
+	}
+
+	env := map[string]string{
+		"AWS_DEFAULT_REGION":    "",
+		"AWS_REGION":            "",
+		"AWS_ACCESS_KEY_ID":     "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	}
+	for k, v := range env {
+		s.env[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+
+	pollInterval = time.Millisecond
+	return s
+}
+
+func (s *testServer) Close() {
+	s.Server.Close()
+	if s.prevRegion.Name == "" {
+		delete(aws.Regions, s.awsRegion)
+	} else {
+		aws.Regions[s.awsRegion] = s.prevRegion
+	}
+	for k, v := range s.env {
+		os.Setenv(k, v)
+	}
+	Region = s.region
+	pollInterval = s.pollInterval
+}
+
+// Handle registers the response function for an Action.
+func (s *testServer) Handle(action string, f func(url.Values) (int, string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[action] = f
+}
+
+// Requests returns the recorded parameters of every request for action.
+func (s *testServer) Requests(action string) []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reqs := []url.Values{}
+	for _, r := range s.requests {
+		if r.Get("Action") == action {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := r.Form.Get("Action")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Form)
+	f, ok := s.handlers[action]
+	s.mu.Unlock()
+
+	if !ok {
+		s.t.Errorf("unexpected request for action %q", action)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, errorResponse("InvalidAction", action))
+		return
+	}
+
+	code, body := f(r.Form)
+	w.WriteHeader(code)
+	fmt.Fprint(w, body)
+}
+
+// Return an AWS formatted error document
+func errorResponse(code, msg string) string {
+	return fmt.Sprintf(`<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>err-request</RequestId></ErrorResponse>`, code, msg)
+}
+
+// Return a DescribeStacks response for a single stack
+func describeStackXML(name, status, reason string) string {
+	return fmt.Sprintf(`<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackId>arn:aws:cloudformation:%s:123456789012:stack/%s/1</StackId>
+        <StackName>%s</StackName>
+        <StackStatus>%s</StackStatus>
+        <StackStatusReason>%s</StackStatusReason>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+  <ResponseMetadata><RequestId>describe-request</RequestId></ResponseMetadata>
+</DescribeStacksResponse>`, testRegion, name, name, status, reason)
+}
+
+// Return a ListStackResources response with one resource per status
+func listResourcesXML(statuses ...string) string {
+	members := ""
+	for i, status := range statuses {
+		members += fmt.Sprintf(`<member>
+  <LogicalResourceId>Resource%d</LogicalResourceId>
+  <PhysicalResourceId>physical-%d</PhysicalResourceId>
+  <ResourceStatus>%s</ResourceStatus>
+  <ResourceType>AWS::EC2::Instance</ResourceType>
+</member>`, i, i, status)
+	}
+
+	return fmt.Sprintf(`<ListStackResourcesResponse>
+  <ListStackResourcesResult>
+    <StackResourceSummaries>%s</StackResourceSummaries>
+  </ListStackResourcesResult>
+  <ResponseMetadata><RequestId>list-request</RequestId></ResponseMetadata>
+</ListStackResourcesResponse>`, members)
+}
+
+func TestListStackResourcesJSON(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		return http.StatusOK, listResourcesXML("CREATE_COMPLETE")
+	})
+
+	resp, err := ListStackResources("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"StackResourceSummaries":[{"ResourceStatus":"CREATE_COMPLETE","LogicalResourceId":"Resource0",` +
+		`"PhysicalResourceId":"physical-0","ResourceType":"AWS::EC2::Instance"}]}`
+	if string(out) != expected {
+		t.Errorf("expected JSON %s, got %s", expected, out)
+	}
+}
+
+func TestWaitWithProgress(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// the stack reports a growing set of resources while it's being created
+	polls := [][]string{
+		{"CREATE_IN_PROGRESS"},
+		{"CREATE_COMPLETE", "CREATE_IN_PROGRESS"},
+		{"CREATE_COMPLETE", "CREATE_IN_PROGRESS", "CREATE_IN_PROGRESS"},
+		{"CREATE_COMPLETE", "CREATE_COMPLETE", "CREATE_IN_PROGRESS"},
+	}
+
+	describes := 0
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		describes++
+		if describes > len(polls) {
+			return http.StatusOK, describeStackXML("test", "CREATE_COMPLETE", "")
+		}
+		return http.StatusOK, describeStackXML("test", "CREATE_IN_PROGRESS", "")
+	})
+
+	lists := 0
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		if lists >= len(polls) {
+			return http.StatusOK, listResourcesXML("CREATE_COMPLETE", "CREATE_COMPLETE", "CREATE_COMPLETE")
+		}
+		statuses := polls[lists]
+		lists++
+		return http.StatusOK, listResourcesXML(statuses...)
+	})
+
+	lastDone, lastTotal := 0, 0
+	calls := 0
+	err := WaitWithProgress("test", time.Second, func(done, total int) {
+		calls++
+		if done < lastDone || total < lastTotal {
+			t.Errorf("progress decreased: %d/%d -> %d/%d", lastDone, lastTotal, done, total)
+		}
+		if done > total {
+			t.Errorf("done %d > total %d", done, total)
+		}
+		lastDone, lastTotal = done, total
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != len(polls)+1 {
+		t.Errorf("expected %d progress calls, got %d", len(polls)+1, calls)
+	}
+
+	if lastDone != 3 || lastTotal != 3 {
+		t.Errorf("final progress %d/%d, want 3/3", lastDone, lastTotal)
+	}
+}
+
+func TestWaitWithStatus(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	polls := [][2]string{
+		{"CREATE_IN_PROGRESS", "User Initiated"},
+		{"CREATE_IN_PROGRESS", "User Initiated"},
+		{"CREATE_IN_PROGRESS", "Waiting for ELB webELB"},
+		{"CREATE_IN_PROGRESS", "Waiting for ELB webELB"},
+		{"CREATE_COMPLETE", ""},
+	}
+
+	describes := 0
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		poll := polls[describes]
+		if describes < len(polls)-1 {
+			describes++
+		}
+		return http.StatusOK, describeStackXML("test", poll[0], poll[1])
+	})
+
+	seen := [][2]string{}
+	err := WaitWithStatus("test", time.Second, func(status, reason string) {
+		seen = append(seen, [2]string{status, reason})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]string{
+		{"CREATE_IN_PROGRESS", "User Initiated"},
+		{"CREATE_IN_PROGRESS", "Waiting for ELB webELB"},
+		{"CREATE_COMPLETE", ""},
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("statuses = %v, want %v", seen, expected)
+	}
+}
+
+// Return a DescribeStackEvents response with one event per "STATUS:REASON"
+// pair, all occurring at ts.
+func stackEventsXML(ts time.Time, events ...[2]string) string {
+	members := ""
+	for i, e := range events {
+		members += fmt.Sprintf(`<member>
+  <EventId>event-%d</EventId>
+  <LogicalResourceId>Resource%d</LogicalResourceId>
+  <ResourceStatus>%s</ResourceStatus>
+  <ResourceStatusReason>%s</ResourceStatusReason>
+  <ResourceType>AWS::EC2::Instance</ResourceType>
+  <Timestamp>%s</Timestamp>
+</member>`, i, i, e[0], e[1], ts.UTC().Format(time.RFC3339))
+	}
+
+	return fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult>
+    <StackEvents>%s</StackEvents>
+  </DescribeStackEventsResult>
+  <ResponseMetadata><RequestId>events-request</RequestId></ResponseMetadata>
+</DescribeStackEventsResponse>`, members)
+}
+
+func TestWaitOnFailureDelete(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	statuses := []string{"CREATE_IN_PROGRESS", "CREATE_FAILED", "DELETE_IN_PROGRESS", "DELETE_IN_PROGRESS"}
+	describes := 0
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		if describes >= len(statuses) {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id test does not exist")
+		}
+		status := statuses[describes]
+		describes++
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now(), [2]string{"CREATE_FAILED", "instance failed"})
+	})
+
+	err := Wait("test", time.Second)
+	if describes != len(statuses) {
+		t.Errorf("Wait returned after %d describes, want %d", describes, len(statuses))
+	}
+
+	failures, ok := err.(*FailuresError)
+	if !ok {
+		t.Fatalf("expected *FailuresError, got %#v", err)
+	}
+
+	if failures.Error() != "CREATE_FAILED: instance failed" {
+		t.Errorf("unexpected failure: %q", failures.Error())
+	}
+}
+
+func TestListFailuresStopsPaging(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	since := time.Now().Add(-time.Hour)
+	pages := map[string]string{
+		// newer than since
+		"": stackEventsXML(since.Add(time.Minute), [2]string{"CREATE_FAILED", "new failure"}),
+		// inside the clock skew window, so paging continues
+		"page2": stackEventsXML(since.Add(-eventsClockSkew/2), [2]string{"CREATE_FAILED", "skewed failure"}),
+		// past the window
+		"page3": stackEventsXML(since.Add(-2*eventsClockSkew), [2]string{"CREATE_FAILED", "old failure"}),
+		"page4": stackEventsXML(since.Add(-3*eventsClockSkew), [2]string{"CREATE_FAILED", "older failure"}),
+	}
+	next := map[string]string{"": "page2", "page2": "page3", "page3": "page4"}
+
+	s.Handle("DescribeStackEvents", func(v url.Values) (int, string) {
+		token := v.Get("NextToken")
+		body := pages[token]
+		if next[token] != "" {
+			body = strings.Replace(body, "</DescribeStackEventsResult>",
+				"<NextToken>"+next[token]+"</NextToken></DescribeStackEventsResult>", 1)
+		}
+		return http.StatusOK, body
+	})
+
+	failures, err := ListFailures("test", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failures) != 1 || failures[0] != "CREATE_FAILED: new failure" {
+		t.Errorf("unexpected failures: %q", failures)
+	}
+
+	if n := len(s.Requests("DescribeStackEvents")); n != 3 {
+		t.Errorf("expected 3 pages of events, got %d", n)
+	}
+
+	all, err := DescribeStackEvents("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Events) != 4 {
+		t.Errorf("expected all 4 events, got %d", len(all.Events))
+	}
+}
+
+func TestGetTemplateStage(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("GetTemplate", func(params url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<GetTemplateResponse>
+  <GetTemplateResult><TemplateBody>{"Description": "%s"}</TemplateBody></GetTemplateResult>
+</GetTemplateResponse>`, params.Get("TemplateStage"))
+	})
+
+	body, err := GetTemplateStage("test", TemplateStageProcessed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"Description": "Processed"}` {
+		t.Errorf("unexpected template body: %s", body)
+	}
+
+	if _, err := GetTemplate("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("GetTemplate")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 GetTemplate requests, got %d", len(reqs))
+	}
+
+	for i, stage := range []string{"Processed", "Original"} {
+		if reqs[i].Get("TemplateStage") != stage {
+			t.Errorf("request %d: TemplateStage = %q, want %q", i, reqs[i].Get("TemplateStage"), stage)
+		}
+	}
+}
+
+func TestGetTemplateParsed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	body := `{
+  "Parameters": {"KeyName": {"Type": "String"}},
+  "Resources": {"webASG": {"Type": "AWS::AutoScaling::AutoScalingGroup"}}
+}`
+	s.Handle("GetTemplate", func(url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<GetTemplateResponse>
+  <GetTemplateResult><TemplateBody>%s</TemplateBody></GetTemplateResult>
+</GetTemplateResponse>`, body)
+	})
+
+	tmpl, err := GetTemplateParsed("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, _ := tmpl["Parameters"].(map[string]interface{})
+	if _, ok := params["KeyName"]; !ok || len(params) != 1 {
+		t.Errorf("unexpected Parameters: %v", tmpl["Parameters"])
+	}
+
+	resources, _ := tmpl["Resources"].(map[string]interface{})
+	asg, _ := resources["webASG"].(map[string]interface{})
+	if asg["Type"] != "AWS::AutoScaling::AutoScalingGroup" {
+		t.Errorf("unexpected Resources: %v", tmpl["Resources"])
+	}
+
+	body = `Parameters:
+  KeyName:
+    Type: String
+Resources:
+  webASG:
+    Type: AWS::AutoScaling::AutoScalingGroup
+    Properties:
+      LaunchConfigurationName: !Ref webLC
+      TargetGroupARNs:
+        - !GetAtt webTG.Arn
+`
+	tmpl, err = GetTemplateParsed("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resources, _ = tmpl["Resources"].(map[string]interface{})
+	asg, _ = resources["webASG"].(map[string]interface{})
+	if asg["Type"] != "AWS::AutoScaling::AutoScalingGroup" {
+		t.Errorf("unexpected Resources: %v", tmpl["Resources"])
+	}
+
+	// short form intrinsic functions are expanded to their full form
+	expected := map[string]interface{}{
+		"LaunchConfigurationName": map[string]interface{}{"Ref": "webLC"},
+		"TargetGroupARNs": []interface{}{
+			map[string]interface{}{"Fn::GetAtt": []interface{}{"webTG", "Arn"}},
+		},
+	}
+	if !reflect.DeepEqual(asg["Properties"], expected) {
+		t.Errorf("Properties = %#v, want %#v", asg["Properties"], expected)
+	}
+}
+
+func TestDescribeTemplateStages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("GetTemplate", func(url.Values) (int, string) {
+		return http.StatusOK, `<GetTemplateResponse>
+  <GetTemplateResult>
+    <TemplateBody>{}</TemplateBody>
+    <StagesAvailable>
+      <member>Original</member>
+      <member>Processed</member>
+    </StagesAvailable>
+  </GetTemplateResult>
+</GetTemplateResponse>`
+	})
+
+	resp, err := DescribeTemplate("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(resp.StagesAvailable, []string{"Original", "Processed"}) {
+		t.Errorf("StagesAvailable = %v", resp.StagesAvailable)
+	}
+	if !resp.HasStage(TemplateStageProcessed) {
+		t.Error("expected the Processed stage to be available")
+	}
+	if string(resp.TemplateBody) != "{}" {
+		t.Errorf("unexpected TemplateBody: %s", resp.TemplateBody)
+	}
+}
+
+func TestGetPoolProcessed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// the stack has no Processed stage at first
+	stages := "<member>Original</member>"
+	s.Handle("GetTemplate", func(params url.Values) (int, string) {
+		body := ""
+		if params.Get("TemplateStage") == TemplateStageOriginal || strings.Contains(stages, "Processed") {
+			body = fmt.Sprintf(`{"AWSTemplateFormatVersion": "2010-09-09", "Description": "%s"}`, params.Get("TemplateStage"))
+		}
+		return http.StatusOK, fmt.Sprintf(`<GetTemplateResponse>
+  <GetTemplateResult>
+    <TemplateBody>%s</TemplateBody>
+    <StagesAvailable>%s</StagesAvailable>
+  </GetTemplateResult>
+</GetTemplateResponse>`, body, stages)
+	})
+
+	pool, err := GetPoolProcessed("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Description != "Original" {
+		t.Errorf("expected the Original template without a Processed stage, got %q", pool.Description)
+	}
+
+	stages += "<member>Processed</member>"
+	pool, err = GetPoolProcessed("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Description != "Processed" {
+		t.Errorf("expected the Processed template, got %q", pool.Description)
+	}
+
+	if n := len(s.Requests("GetTemplate")); n != 3 {
+		t.Errorf("expected 3 GetTemplate requests, got %d", n)
+	}
+}
+
+// Return a CreateStack response for name
+func createStackXML(name string) string {
+	return fmt.Sprintf(`<CreateStackResponse>
+  <CreateStackResult><StackId>arn:aws:cloudformation:%s:123456789012:stack/%s/1</StackId></CreateStackResult>
+  <ResponseMetadata><RequestId>create-request</RequestId></ResponseMetadata>
+</CreateStackResponse>`, testRegion, name)
+}
+
+func TestCreateAndWaitFailure(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	statuses := []string{"CREATE_IN_PROGRESS", "ROLLBACK_IN_PROGRESS", "ROLLBACK_COMPLETE"}
+	describes := 0
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		status := statuses[describes]
+		if describes < len(statuses)-1 {
+			describes++
+		}
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now(),
+			[2]string{"CREATE_FAILED", "Resource creation cancelled"},
+			[2]string{"CREATE_FAILED", "invalid AMI"},
+		)
+	})
+
+	resp, err := CreateAndWait("test", []byte("{}"), nil, time.Second)
+	if resp == nil || resp.StackId == "" {
+		t.Errorf("expected a CreateStackResponse, got %#v", resp)
+	}
+
+	failures, ok := err.(*FailuresError)
+	if !ok {
+		t.Fatalf("expected *FailuresError, got %#v", err)
+	}
+
+	if len(failures.List()) != 2 {
+		t.Errorf("expected 2 failures, got %v", failures.List())
+	}
+
+	if failures.Error() != "CREATE_FAILED: invalid AMI" {
+		t.Errorf("unexpected failure: %q", failures.Error())
+	}
+}
+
+func TestFailuresErrorRootCause(t *testing.T) {
+	// events are listed newest first
+	f := &FailuresError{messages: []string{
+		"ROLLBACK_IN_PROGRESS: The following resource(s) failed to create: [webASG, webSG]. Rollback requested by user.",
+		"CREATE_FAILED: Resource creation cancelled",
+		"CREATE_FAILED: The security group 'sg-1234' does not exist",
+		"CREATE_FAILED: Resource creation cancelled",
+	}}
+
+	expected := "CREATE_FAILED: The security group 'sg-1234' does not exist"
+	if cause := f.RootCause(); cause != expected {
+		t.Errorf("RootCause() = %q, want %q", cause, expected)
+	}
+	if f.Error() != expected {
+		t.Errorf("Error() = %q, want %q", f.Error(), expected)
+	}
+
+	// with only cascades, the oldest failure is used
+	f = &FailuresError{messages: []string{
+		"CREATE_FAILED: Resource creation cancelled",
+		"UPDATE_FAILED: Resource update cancelled",
+	}}
+	if cause := f.RootCause(); cause != "UPDATE_FAILED: Resource update cancelled" {
+		t.Errorf("unexpected RootCause() for cascades: %q", cause)
+	}
+
+	if cause := (&FailuresError{}).RootCause(); cause != "" {
+		t.Errorf("expected no RootCause() without failures, got %q", cause)
+	}
+}
+
+func TestWaitErrorsIs(t *testing.T) {
+	for _, events := range [][][2]string{
+		{{"CREATE_FAILED", "invalid AMI"}},
+		nil,
+	} {
+		s := newTestServer(t)
+
+		handleStatuses(s, "test", "CREATE_IN_PROGRESS", "ROLLBACK_IN_PROGRESS", "ROLLBACK_COMPLETE")
+		s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+			return http.StatusOK, stackEventsXML(time.Now(), events...)
+		})
+
+		err := Wait("test", time.Second)
+		if !errors.Is(err, ErrRollbackComplete) {
+			t.Errorf("expected %#v to match ErrRollbackComplete", err)
+		}
+		if errors.Is(err, ErrCreateFailed) {
+			t.Errorf("expected %#v not to match ErrCreateFailed", err)
+		}
+
+		s.Close()
+	}
+}
+
+// Fake the lifecycle of stack deletion for a pool and its base stack. The
+// base can't be deleted while the pool still exists.
+func handleDeletes(s *testServer, stacks map[string]string) {
+	var mu sync.Mutex
+
+	s.Handle("DeleteStack", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := params.Get("StackName")
+		if _, ok := stacks["pool"]; ok && name == "base" {
+			stacks[name] = "DELETE_FAILED"
+		} else {
+			stacks[name] = "DELETE_IN_PROGRESS"
+		}
+		return http.StatusOK, `<DeleteStackResponse><ResponseMetadata><RequestId>delete-request</RequestId></ResponseMetadata></DeleteStackResponse>`
+	})
+
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := params.Get("StackName")
+		status, ok := stacks[name]
+		if !ok {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id "+name+" does not exist")
+		}
+
+		// the stack is gone after the next describe
+		if status == "DELETE_IN_PROGRESS" {
+			delete(stacks, name)
+		}
+		return http.StatusOK, describeStackXML(name, status, "in use by pool")
+	})
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now())
+	})
+}
+
+func TestDeleteAll(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleDeletes(s, map[string]string{
+		"pool": "CREATE_COMPLETE",
+		"base": "CREATE_COMPLETE",
+	})
+
+	if err := DeleteAll([]string{"pool", "base"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("DeleteStack")
+	if len(reqs) != 2 || reqs[0].Get("StackName") != "pool" || reqs[1].Get("StackName") != "base" {
+		t.Errorf("unexpected DeleteStack requests: %v", reqs)
+	}
+}
+
+func TestDeleteAllOutOfOrder(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleDeletes(s, map[string]string{
+		"pool": "CREATE_COMPLETE",
+		"base": "CREATE_COMPLETE",
+	})
+
+	err := DeleteAll([]string{"base", "pool"})
+	delErr, ok := err.(*DeleteAllError)
+	if !ok {
+		t.Fatalf("expected *DeleteAllError, got %#v", err)
+	}
+
+	if len(delErr.Stacks) != 1 || delErr.Stacks[0] != "base" {
+		t.Errorf("expected only base to fail, got %v", delErr.Stacks)
+	}
+
+	if delErr.Errors[0].Error() != "DELETE_FAILED: in use by pool" {
+		t.Errorf("unexpected error: %s", delErr.Errors[0])
+	}
+}
+
+// Handle DeleteStack for a stack with termination protection, until it's
+// disabled with UpdateTerminationProtection.
+func handleProtectedDelete(s *testServer) {
+	protected := true
+	s.Handle("UpdateTerminationProtection", func(params url.Values) (int, string) {
+		protected = params.Get("EnableTerminationProtection") == "true"
+		return http.StatusOK, `<UpdateTerminationProtectionResponse><UpdateTerminationProtectionResult><StackId>test</StackId></UpdateTerminationProtectionResult></UpdateTerminationProtectionResponse>`
+	})
+	s.Handle("DeleteStack", func(params url.Values) (int, string) {
+		if protected {
+			return http.StatusBadRequest, errorResponse("ValidationError",
+				"Stack [test] cannot be deleted while TerminationProtection is enabled")
+		}
+		return http.StatusOK, `<DeleteStackResponse><ResponseMetadata><RequestId>delete-request</RequestId></ResponseMetadata></DeleteStackResponse>`
+	})
+}
+
+func TestDeleteTerminationProtected(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleProtectedDelete(s)
+
+	_, err := Delete("test")
+	if _, ok := err.(*TerminationProtectedError); !ok {
+		t.Fatalf("expected *TerminationProtectedError, got %#v", err)
+	}
+
+	if reqs := s.Requests("UpdateTerminationProtection"); len(reqs) != 0 {
+		t.Errorf("termination protection was changed without ForceDeleteProtected: %v", reqs)
+	}
+}
+
+func TestDeleteForceDeleteProtected(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleProtectedDelete(s)
+
+	_, err := DeleteWithOptions("test", map[string]string{"ForceDeleteProtected": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("UpdateTerminationProtection")
+	if len(reqs) != 1 || reqs[0].Get("StackName") != "test" || reqs[0].Get("EnableTerminationProtection") != "false" {
+		t.Errorf("unexpected UpdateTerminationProtection requests: %v", reqs)
+	}
+}
+
+func TestStackResourceSummary(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("ListStackResources", func(params url.Values) (int, string) {
+		if params.Get("NextToken") == "page2" {
+			return http.StatusOK, listResourcesXML("CREATE_COMPLETE", "CREATE_FAILED")
+		}
+
+		page := listResourcesXML("CREATE_COMPLETE", "CREATE_IN_PROGRESS", "CREATE_COMPLETE")
+		return http.StatusOK, strings.Replace(page, "</StackResourceSummaries>",
+			"</StackResourceSummaries><NextToken>page2</NextToken>", 1)
+	})
+
+	counts, err := StackResourceSummary("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"CREATE_COMPLETE":    3,
+		"CREATE_IN_PROGRESS": 1,
+		"CREATE_FAILED":      1,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("summary = %v, want %v", counts, expected)
+	}
+
+	if n := len(s.Requests("ListStackResources")); n != 2 {
+		t.Errorf("expected 2 ListStackResources requests, got %d", n)
+	}
+}
+
+func TestDeleteClientRequestToken(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DeleteStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<DeleteStackResponse><ResponseMetadata><RequestId>delete-request</RequestId></ResponseMetadata></DeleteStackResponse>`
+	})
+
+	resp, err := DeleteWithOptions("test", map[string]string{"ClientRequestToken": "deploy-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ClientRequestToken != "deploy-42" {
+		t.Errorf("expected token deploy-42, got %q", resp.ClientRequestToken)
+	}
+
+	// without the option a token is generated
+	resp, err = Delete("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ClientRequestToken == "" || resp.ClientRequestToken == "deploy-42" {
+		t.Errorf("expected a new token, got %q", resp.ClientRequestToken)
+	}
+
+	reqs := s.Requests("DeleteStack")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 DeleteStack requests, got %d", len(reqs))
+	}
+
+	if token := reqs[0].Get("ClientRequestToken"); token != "deploy-42" {
+		t.Errorf("expected token deploy-42 to be sent, got %q", token)
+	}
+	if token := reqs[1].Get("ClientRequestToken"); token != resp.ClientRequestToken {
+		t.Errorf("sent token %q, but returned %q", token, resp.ClientRequestToken)
+	}
+}
+
+func TestAllResourcesDetailed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		return http.StatusOK, listResourcesXML("CREATE_COMPLETE", "CREATE_COMPLETE", "UPDATE_COMPLETE")
+	})
+
+	// the first request for each resource is throttled
+	var mu sync.Mutex
+	throttled := make(map[string]bool)
+	s.Handle("DescribeStackResource", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		id := params.Get("LogicalResourceId")
+		if !throttled[id] {
+			throttled[id] = true
+			return http.StatusBadRequest, errorResponse("Throttling", "Rate exceeded")
+		}
+
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackResourceResponse>
+  <DescribeStackResourceResult>
+    <StackResourceDetail>
+      <LogicalResourceId>%s</LogicalResourceId>
+      <ResourceType>AWS::EC2::Instance</ResourceType>
+      <Metadata>{&quot;id&quot;:&quot;%s&quot;}</Metadata>
+    </StackResourceDetail>
+  </DescribeStackResourceResult>
+</DescribeStackResourceResponse>`, id, id)
+	})
+
+	details, err := AllResourcesDetailed("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(details) != 3 {
+		t.Fatalf("expected 3 resources, got %d", len(details))
+	}
+
+	for i, detail := range details {
+		id := fmt.Sprintf("Resource%d", i)
+		if detail.LogicalId != id || detail.Metadata != `{"id":"`+id+`"}` {
+			t.Errorf("unexpected detail for %s: %#v", id, detail)
+		}
+	}
+
+	if n := len(s.Requests("DescribeStackResource")); n != 6 {
+		t.Errorf("expected 6 DescribeStackResource requests, got %d", n)
+	}
+}
+
+func TestGetResourceMetadata(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStackResource", func(params url.Values) (int, string) {
+		if params.Get("StackName") != "test" || params.Get("LogicalResourceId") != "lc" {
+			t.Errorf("unexpected params: %v", params)
+		}
+		return http.StatusOK, `<DescribeStackResourceResponse>
+  <DescribeStackResourceResult>
+    <StackResourceDetail>
+      <StackName>test</StackName>
+      <LogicalResourceId>lc</LogicalResourceId>
+      <ResourceType>AWS::AutoScaling::LaunchConfiguration</ResourceType>
+      <ResourceStatus>CREATE_COMPLETE</ResourceStatus>
+      <Metadata>{&quot;AWS::CloudFormation::Init&quot;:{&quot;config&quot;:{&quot;packages&quot;:{&quot;yum&quot;:{&quot;docker&quot;:[]}}}}}</Metadata>
+      <LastUpdatedTimestamp>2015-04-01T12:00:00Z</LastUpdatedTimestamp>
+    </StackResourceDetail>
+  </DescribeStackResourceResult>
+</DescribeStackResourceResponse>`
+	})
+
+	metadata, err := GetResourceMetadata("test", "lc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init := map[string]map[string]interface{}{}
+	if err := json.Unmarshal([]byte(metadata), &init); err != nil {
+		t.Fatalf("invalid metadata %q: %s", metadata, err)
+	}
+
+	if _, ok := init["AWS::CloudFormation::Init"]["config"]; !ok {
+		t.Errorf("missing AWS::CloudFormation::Init config: %s", metadata)
+	}
+}
+
+func TestDescribeStacksCreationOptions(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>test</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Capabilities>
+          <member>CAPABILITY_IAM</member>
+        </Capabilities>
+        <NotificationARNs>
+          <member>arn:aws:sns:us-east-1:123456789012:stack-events</member>
+        </NotificationARNs>
+        <RoleARN>arn:aws:iam::123456789012:role/cfn</RoleARN>
+        <DisableRollback>true</DisableRollback>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	resp, err := DescribeStacks("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Stacks) != 1 {
+		t.Fatalf("expected 1 stack, got %d", len(resp.Stacks))
+	}
+	stack := resp.Stacks[0]
+
+	if len(stack.Capabilities) != 1 || stack.Capabilities[0] != "CAPABILITY_IAM" {
+		t.Errorf("unexpected Capabilities: %v", stack.Capabilities)
+	}
+
+	if len(stack.NotificationARNs) != 1 || stack.NotificationARNs[0] != "arn:aws:sns:us-east-1:123456789012:stack-events" {
+		t.Errorf("unexpected NotificationARNs: %v", stack.NotificationARNs)
+	}
+
+	if stack.RoleARN != "arn:aws:iam::123456789012:role/cfn" {
+		t.Errorf("unexpected RoleARN: %s", stack.RoleARN)
+	}
+
+	if !stack.DisableRollback {
+		t.Error("expected DisableRollback")
+	}
+}
+
+func TestCreateParameterOrder(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	options := map[string]string{
+		"KeyName":          "key",
+		"PoolImageId":      "ami-1234",
+		"ControllerSize":   "t2.small",
+		"tag.galaxy":       "base",
+		"tag.env":          "dev",
+		"PoolInstanceType": "t2.medium",
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := Create("test", []byte("{}"), options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reqs := s.Requests("CreateStack")
+	for _, req := range reqs {
+		// these change with every request
+		for _, p := range []string{"Timestamp", "Signature"} {
+			req.Del(p)
+		}
+	}
+
+	for i := 1; i < len(reqs); i++ {
+		if !reflect.DeepEqual(reqs[0], reqs[i]) {
+			t.Fatalf("request %d differs:\n%v\n%v", i, reqs[0], reqs[i])
+		}
+	}
+
+	expected := map[string]string{
+		"Parameters.member.1.ParameterKey": "ControllerSize",
+		"Parameters.member.4.ParameterKey": "PoolInstanceType",
+		"Tags.member.1.Key":                "Name",
+		"Tags.member.2.Key":                "env",
+		"Tags.member.3.Key":                "galaxy",
+	}
+	for k, v := range expected {
+		if reqs[0].Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, reqs[0].Get(k), v)
+		}
+	}
+}
+
+func TestCreateNoDefaultNameTag(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	options := map[string]string{
+		"NoDefaultNameTag": "true",
+		"KeyName":          "key",
+		"tag.env":          "dev",
+		"tag.galaxy":       "base",
+	}
+
+	if _, err := Create("test", []byte("{}"), options); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("CreateStack")[0]
+	expected := map[string]string{
+		"Tags.member.1.Key":                "env",
+		"Tags.member.1.Value":              "dev",
+		"Tags.member.2.Key":                "galaxy",
+		"Tags.member.2.Value":              "base",
+		"Tags.member.3.Key":                "",
+		"Parameters.member.1.ParameterKey": "KeyName",
+		"Parameters.member.2.ParameterKey": "",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+}
+
+// Respond to each DescribeStacks with the next status, repeating the last.
+func handleStatuses(s *testServer, name string, statuses ...string) {
+	var mu sync.Mutex
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return http.StatusOK, describeStackXML(name, status, "")
+	})
+}
+
+func TestWaitForUpdate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "UPDATE_IN_PROGRESS", "UPDATE_COMPLETE_CLEANUP_IN_PROGRESS", "UPDATE_COMPLETE")
+
+	if err := WaitForUpdate("test", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForUpdateRollback(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "UPDATE_IN_PROGRESS", "UPDATE_ROLLBACK_IN_PROGRESS", "UPDATE_ROLLBACK_COMPLETE")
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now(), [2]string{"UPDATE_FAILED", "invalid instance type"})
+	})
+
+	err := WaitForUpdate("test", time.Second)
+	failures, ok := err.(*FailuresError)
+	if !ok {
+		t.Fatalf("expected *FailuresError, got %#v", err)
+	}
+
+	if failures.Error() != "UPDATE_FAILED: invalid instance type" {
+		t.Errorf("unexpected failure: %q", failures.Error())
+	}
+}
+
+func TestFailureEventProperties(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "CREATE_IN_PROGRESS", "ROLLBACK_IN_PROGRESS", "ROLLBACK_COMPLETE")
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult>
+    <StackEvents>
+      <member>
+        <EventId>event-1</EventId>
+        <LogicalResourceId>db</LogicalResourceId>
+        <ResourceStatus>CREATE_FAILED</ResourceStatus>
+        <ResourceStatusReason>invalid instance class</ResourceStatusReason>
+        <ResourceType>AWS::RDS::DBInstance</ResourceType>
+        <ResourceProperties>{"DBInstanceClass":"db.huge","MasterUserPassword":"hunter2"}</ResourceProperties>
+        <Timestamp>%s</Timestamp>
+      </member>
+    </StackEvents>
+  </DescribeStackEventsResult>
+</DescribeStackEventsResponse>`, time.Now().UTC().Format(time.RFC3339))
+	})
+
+	defer func() { RedactResourceProperties = nil }()
+	RedactResourceProperties = func(resourceType, properties string) string {
+		return strings.Replace(properties, "hunter2", "****", -1)
+	}
+
+	err := Wait("test", time.Second)
+	failures, ok := err.(*FailuresError)
+	if !ok {
+		t.Fatalf("expected *FailuresError, got %#v", err)
+	}
+
+	events := failures.Events()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 failure event, got %d", len(events))
+	}
+
+	expected := `{"DBInstanceClass":"db.huge","MasterUserPassword":"****"}`
+	if events[0].LogicalResourceId != "db" || events[0].ResourceProperties != expected {
+		t.Errorf("unexpected failure event: %#v", events[0])
+	}
+}
+
+func TestWaitWithOptionsUpdateRollback(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now(), [2]string{"UPDATE_FAILED", "invalid instance type"})
+	})
+
+	for _, tc := range []struct {
+		options map[string]string
+		failed  bool
+	}{
+		{nil, true},
+		{map[string]string{"AllowUpdateRollback": "false"}, true},
+		{map[string]string{"AllowUpdateRollback": "true"}, false},
+	} {
+		handleStatuses(s, "test", "UPDATE_IN_PROGRESS", "UPDATE_ROLLBACK_IN_PROGRESS", "UPDATE_ROLLBACK_COMPLETE")
+
+		err := WaitWithOptions("test", time.Second, tc.options)
+		if !tc.failed && err != nil {
+			t.Errorf("options %v: unexpected error: %v", tc.options, err)
+		}
+		if tc.failed && !errors.Is(err, ErrUpdateRollbackComplete) {
+			t.Errorf("options %v: expected ErrUpdateRollbackComplete, got %v", tc.options, err)
+		}
+	}
+
+	// a rolled back create is still a failure
+	handleStatuses(s, "test", "CREATE_IN_PROGRESS", "ROLLBACK_IN_PROGRESS", "ROLLBACK_COMPLETE")
+	err := WaitWithOptions("test", time.Second, map[string]string{"AllowUpdateRollback": "true"})
+	if !errors.Is(err, ErrRollbackComplete) {
+		t.Errorf("expected ErrRollbackComplete, got %v", err)
+	}
+}
+
+func TestAbortUpdate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CancelUpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<CancelUpdateStackResponse/>`
+	})
+	handleStatuses(s, "test", "UPDATE_ROLLBACK_IN_PROGRESS", "UPDATE_ROLLBACK_COMPLETE_CLEANUP_IN_PROGRESS", "UPDATE_ROLLBACK_COMPLETE")
+
+	if err := AbortUpdate("test", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.Requests("CancelUpdateStack")); n != 1 {
+		t.Errorf("expected 1 CancelUpdateStack request, got %d", n)
+	}
+}
+
+func TestAbortUpdateRollbackFailed(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CancelUpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<CancelUpdateStackResponse/>`
+	})
+	handleStatuses(s, "test", "UPDATE_ROLLBACK_IN_PROGRESS", "UPDATE_ROLLBACK_FAILED")
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now(), [2]string{"UPDATE_FAILED", "security group in use"})
+	})
+
+	err := AbortUpdate("test", time.Second)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := "rollback of test failed: UPDATE_FAILED: security group in use"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err)
+	}
+}
+
+func TestTemplateSizeLimit(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	large := []byte(`{"Description": "` + strings.Repeat("x", 60*1024) + `"}`)
+
+	_, err := Create("test", large, nil)
+	if _, ok := err.(*TemplateTooLargeError); !ok {
+		t.Errorf("expected *TemplateTooLargeError from Create, got %#v", err)
+	}
+
+	_, err = Update("test", large, nil)
+	if _, ok := err.(*TemplateTooLargeError); !ok {
+		t.Errorf("expected *TemplateTooLargeError from Update, got %#v", err)
+	}
+
+	if n := len(s.Requests("CreateStack")) + len(s.Requests("UpdateStack")); n != 0 {
+		t.Errorf("expected no requests for a large template, got %d", n)
+	}
+
+	if _, err := Create("test", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update("test", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateDeleteFailedBeforeCreate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	creates := 0
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		creates++
+		if creates == 1 {
+			return http.StatusBadRequest, errorResponse("AlreadyExistsException", "Stack [test] already exists")
+		}
+		return http.StatusOK, createStackXML("test")
+	})
+
+	handleStatuses(s, "test", "ROLLBACK_COMPLETE", "DELETE_IN_PROGRESS", "DELETE_COMPLETE")
+	s.Handle("DeleteStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<DeleteStackResponse><ResponseMetadata><RequestId>delete-request</RequestId></ResponseMetadata></DeleteStackResponse>`
+	})
+
+	opts := map[string]string{"DeleteFailedBeforeCreate": "true", "KeyName": "key"}
+	if _, err := Create("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.Requests("DeleteStack")); n != 1 {
+		t.Errorf("expected 1 DeleteStack request, got %d", n)
+	}
+
+	reqs := s.Requests("CreateStack")
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 CreateStack requests, got %d", len(reqs))
+	}
+
+	// the option must not be sent as a stack parameter
+	if reqs[1].Get("Parameters.member.1.ParameterKey") != "KeyName" || reqs[1].Get("Parameters.member.2.ParameterKey") != "" {
+		t.Errorf("unexpected parameters: %v", reqs[1])
+	}
+}
+
+func TestCreateAlreadyExistsWithoutOption(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusBadRequest, errorResponse("AlreadyExistsException", "Stack [test] already exists")
+	})
+	handleStatuses(s, "test", "ROLLBACK_COMPLETE")
+
+	_, err := Create("test", []byte("{}"), nil)
+	if awsErr, ok := err.(*aws.Error); !ok || awsErr.Code != "AlreadyExistsException" {
+		t.Fatalf("expected AlreadyExistsException, got %v", err)
+	}
+
+	if n := len(s.Requests("DeleteStack")); n != 0 {
+		t.Errorf("expected no DeleteStack requests, got %d", n)
+	}
+}
+
+func TestQueryDebugLog(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "CREATE_COMPLETE")
+
+	buf := &bytes.Buffer{}
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = log.New(buf, "", log.DEBUG)
+	defer func() { log.DefaultLogger = defaultLogger }()
+
+	if _, err := DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"DescribeStacks", "region=" + testRegion, "stack=test", "status=200", "request_id=describe-request"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log %q does not contain %q", out, want)
+		}
+	}
+}
+
+func TestSharedResourcesVPC(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+
+	shared, err := GetSharedResources("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.VPC() != "vpc-1234" {
+		t.Errorf("VPC = %q, want vpc-1234", shared.VPC())
+	}
+
+	if n := len(s.Requests("ListStackResources")); n != 1 {
+		t.Errorf("expected 1 ListStackResources request, got %d", n)
+	}
+
+	// the subnets are looked up in the VPC that was found
+	reqs := s.Requests("DescribeSubnets")
+	if len(reqs) != 1 || reqs[0].Get("Filter.1.Value.1") != "vpc-1234" {
+		t.Errorf("unexpected DescribeSubnets requests: %v", reqs)
+	}
+}
+
+func TestSetTags(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>test</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>key</ParameterValue></member>
+        </Parameters>
+        <Capabilities><member>CAPABILITY_IAM</member></Capabilities>
+        <Tags>
+          <member><Key>Name</Key><Value>test</Value></member>
+          <member><Key>env</Key><Value>dev</Value></member>
+        </Tags>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	if err := SetTags("test", map[string]string{"env": "prod", "owner": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("UpdateStack")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 UpdateStack request, got %d", len(reqs))
+	}
+	req := reqs[0]
+
+	expected := map[string]string{
+		"UsePreviousTemplate":                  "true",
+		"Parameters.member.1.ParameterKey":     "KeyName",
+		"Parameters.member.1.UsePreviousValue": "true",
+		"Capabilities.member.1":                "CAPABILITY_IAM",
+		"Tags.member.1.Key":                    "Name",
+		"Tags.member.1.Value":                  "test",
+		"Tags.member.2.Key":                    "env",
+		"Tags.member.2.Value":                  "prod",
+		"Tags.member.3.Key":                    "owner",
+		"Tags.member.3.Value":                  "ops",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+
+	if req.Get("TemplateBody") != "" {
+		t.Errorf("unexpected TemplateBody: %s", req.Get("TemplateBody"))
+	}
+}
+
+func TestDescribeSubnetsIPv6(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeSubnets", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item>
+      <subnetId>subnet-a</subnetId>
+      <vpcId>vpc-1234</vpcId>
+      <cidrBlock>10.0.1.0/24</cidrBlock>
+      <ipv6CidrBlockAssociationSet>
+        <item>
+          <associationId>subnet-cidr-assoc-1</associationId>
+          <ipv6CidrBlock>2600:1f18:1234:5600::/64</ipv6CidrBlock>
+          <ipv6CidrBlockState><state>associated</state></ipv6CidrBlockState>
+        </item>
+      </ipv6CidrBlockAssociationSet>
+    </item>
+  </subnetSet>
+</DescribeSubnetsResponse>`
+	})
+
+	resp, err := DescribeSubnets("vpc-1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Subnets) != 1 {
+		t.Fatalf("expected 1 subnet, got %d", len(resp.Subnets))
+	}
+
+	subnet := resp.Subnets[0]
+	if subnet.CIDRBlock != "10.0.1.0/24" {
+		t.Errorf("unexpected CIDRBlock: %s", subnet.CIDRBlock)
+	}
+
+	expected := []string{"2600:1f18:1234:5600::/64"}
+	if !reflect.DeepEqual(subnet.IPv6CIDRBlocks, expected) {
+		t.Errorf("IPv6CIDRBlocks = %v, want %v", subnet.IPv6CIDRBlocks, expected)
+	}
+
+	// older API versions don't return the IPv6 CIDR blocks
+	if v := s.Requests("DescribeSubnets")[0].Get("Version"); v != "2016-11-15" {
+		t.Errorf("unexpected API version: %s", v)
+	}
+}
+
+func TestDescribeSubnetsName(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeSubnets", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item>
+      <subnetId>subnet-a</subnetId>
+      <tagSet>
+        <item><key>env</key><value>prod</value></item>
+        <item><key>Name</key><value>galaxy-private-a</value></item>
+      </tagSet>
+    </item>
+    <item>
+      <subnetId>subnet-b</subnetId>
+    </item>
+  </subnetSet>
+</DescribeSubnetsResponse>`
+	})
+
+	resp, err := DescribeSubnets("vpc-1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Subnets) != 2 {
+		t.Fatalf("expected 2 subnets, got %d", len(resp.Subnets))
+	}
+	if name := resp.Subnets[0].Name; name != "galaxy-private-a" {
+		t.Errorf("Name = %q, want galaxy-private-a", name)
+	}
+	if name := resp.Subnets[1].Name; name != "" {
+		t.Errorf("expected no Name for an untagged subnet, got %q", name)
+	}
+
+	shared := SharedResources{Subnets: resp.Subnets}
+	if sn, err := shared.SubnetByName("galaxy-private-a"); err != nil || sn.ID != "subnet-a" {
+		t.Errorf("SubnetByName = %v, %v; want subnet-a", sn.ID, err)
+	}
+	if _, err := shared.SubnetByName(""); err == nil {
+		t.Error("expected no subnet with an empty name")
+	}
+}
+
+func TestDescribeAvailabilityZonesStandard(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeAvailabilityZones", func(params url.Values) (int, string) {
+		if params.Get("Version") != "2016-11-15" {
+			t.Errorf("Version = %q, want an API version which returns zoneType", params.Get("Version"))
+		}
+		return http.StatusOK, `<DescribeAvailabilityZonesResponse>
+  <requestId>az-request</requestId>
+  <availabilityZoneInfo>
+    <item><zoneName>galaxy-test-1a</zoneName><zoneState>available</zoneState><regionName>galaxy-test-1</regionName><zoneType>availability-zone</zoneType></item>
+    <item><zoneName>galaxy-test-1-lax-1a</zoneName><zoneState>available</zoneState><regionName>galaxy-test-1</regionName><zoneType>local-zone</zoneType></item>
+    <item><zoneName>galaxy-test-1b</zoneName><zoneState>available</zoneState><regionName>galaxy-test-1</regionName><zoneType>availability-zone</zoneType></item>
+    <item><zoneName>galaxy-test-1-wl1-atl-wlz-1</zoneName><zoneState>available</zoneState><regionName>galaxy-test-1</regionName><zoneType>wavelength-zone</zoneType></item>
+    <item><zoneName>galaxy-test-1c</zoneName><zoneState>available</zoneState><regionName>galaxy-test-1</regionName></item>
+  </availabilityZoneInfo>
+</DescribeAvailabilityZonesResponse>`
+	})
+
+	resp, err := DescribeAvailabilityZones(testRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.AvailabilityZones) != 5 || resp.AvailabilityZones[1].ZoneType != "local-zone" {
+		t.Errorf("unexpected zones: %#v", resp.AvailabilityZones)
+	}
+
+	names := []string{}
+	for _, az := range resp.StandardZones() {
+		names = append(names, az.Name)
+	}
+
+	expected := []string{"galaxy-test-1a", "galaxy-test-1b"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("standard zones = %v, want %v", names, expected)
+	}
+}
+
+func TestStackTags(t *testing.T) {
+	stack := stackDescription{
+		Tags: []stackTag{
+			{Key: "Name", Value: "test"},
+			{Key: "environment", Value: "prod"},
+		},
+	}
+
+	if val, ok := stack.Tag("environment"); !ok || val != "prod" {
+		t.Errorf("Tag(environment) = %q, %t; want \"prod\", true", val, ok)
+	}
+
+	if val, ok := stack.Tag("owner"); ok || val != "" {
+		t.Errorf("Tag(owner) = %q, %t; want \"\", false", val, ok)
+	}
+
+	expected := map[string]string{"Name": "test", "environment": "prod"}
+	if tags := stack.TagsMap(); !reflect.DeepEqual(tags, expected) {
+		t.Errorf("TagsMap() = %v, want %v", tags, expected)
+	}
+}
+
+func TestExportedNames(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>base</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Outputs>
+          <member><OutputKey>VpcId</OutputKey><OutputValue>vpc-1234</OutputValue><ExportName>base-VpcId</ExportName></member>
+          <member><OutputKey>Url</OutputKey><OutputValue>http://example.com</OutputValue></member>
+          <member><OutputKey>SubnetId</OutputKey><OutputValue>subnet-1234</OutputValue><ExportName>base-SubnetId</ExportName></member>
+        </Outputs>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	resp, err := DescribeStacks("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"base-VpcId", "base-SubnetId"}
+	if names := resp.Stacks[0].ExportedNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("ExportedNames() = %v, want %v", names, expected)
+	}
+}
+
+func TestWaitErrorBackoff(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(m time.Duration) { maxErrorBackoff = m }(maxErrorBackoff)
+	maxErrorBackoff = 6 * pollInterval
+
+	defer func(f func(context.Context, time.Duration) error) { sleepContext = f }(sleepContext)
+	delays := []time.Duration{}
+	sleepContext = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	// an empty status is a response that can't be decoded
+	statuses := []string{"", "", "", "", "CREATE_IN_PROGRESS", "", "CREATE_COMPLETE"}
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == "" {
+			return http.StatusOK, "not xml"
+		}
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+
+	if err := Wait("test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	p := pollInterval
+	expected := []time.Duration{2 * p, 4 * p, 6 * p, 6 * p, p, 2 * p}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("delays = %v, want %v", delays, expected)
+	}
+}
+
+func TestWaitThrottled(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(f func(context.Context, time.Duration) error) { sleepContext = f }(sleepContext)
+	delays := []time.Duration{}
+	sleepContext = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	// an empty status is a throttled request
+	statuses := []string{"", "", "CREATE_COMPLETE"}
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == "" {
+			return http.StatusBadRequest, errorResponse("Throttling", "Rate exceeded")
+		}
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+
+	// a policy without a BaseDelay still waits a poll interval between polls
+	c := &Client{RetryPolicy: &RetryPolicy{MaxAttempts: 3, Retryable: isTransient}}
+	if err := c.Wait("test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Duration{pollInterval, pollInterval}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("delays = %v, want %v", delays, expected)
+	}
+
+	// once the policy gives up, the throttling error is returned
+	statuses = []string{"", "", "", "CREATE_COMPLETE"}
+	err := c.Wait("test", time.Minute)
+	if !isThrottled(err) {
+		t.Errorf("expected a throttling error, got %v", err)
+	}
+	if n := len(s.Requests("DescribeStacks")); n != 6 {
+		t.Errorf("expected 3 more DescribeStacks requests, got %d in all", n)
+	}
+}
+
+func TestDescribeStackEventsOrder(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	event := func(id string, ts time.Time) string {
+		return fmt.Sprintf(`<member><EventId>%s</EventId><Timestamp>%s</Timestamp></member>`, id, ts.Format(time.RFC3339))
+	}
+
+	pages := map[string]string{
+		"":      event("b", now) + event("c", now.Add(-2*time.Second)) + event("a", now),
+		"page2": event("e", now.Add(-3*time.Second)) + event("d", now.Add(-time.Second)),
+	}
+
+	s.Handle("DescribeStackEvents", func(v url.Values) (int, string) {
+		token := v.Get("NextToken")
+		next := ""
+		if token == "" {
+			next = "<NextToken>page2</NextToken>"
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult><StackEvents>%s</StackEvents>%s</DescribeStackEventsResult>
+</DescribeStackEventsResponse>`, pages[token], next)
+	})
+
+	resp, err := DescribeStackEvents("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, e := range resp.Events {
+		ids = append(ids, e.EventId)
+	}
+
+	expected := []string{"a", "b", "d", "c", "e"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("events ordered %v, want %v", ids, expected)
+	}
+}
+
+func TestDescribeStackEventsRequestId(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStackEventsResponse>
+  <DescribeStackEventsResult>
+    <StackEvents>
+      <member>
+        <EventId>event-1</EventId>
+        <StackId>arn:aws:cloudformation:galaxy-test-1:123456789012:stack/test/1</StackId>
+        <StackName>test</StackName>
+        <ResourceStatus>CREATE_COMPLETE</ResourceStatus>
+      </member>
+    </StackEvents>
+  </DescribeStackEventsResult>
+  <ResponseMetadata><RequestId>events-request</RequestId></ResponseMetadata>
+</DescribeStackEventsResponse>`
+	})
+
+	resp, err := DescribeStackEvents("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.RequestId != "events-request" {
+		t.Errorf("expected RequestId events-request, got %q", resp.RequestId)
+	}
+
+	if len(resp.Events) != 1 || resp.Events[0].StackId != "arn:aws:cloudformation:galaxy-test-1:123456789012:stack/test/1" {
+		t.Errorf("unexpected events: %#v", resp.Events)
+	}
+}
+
+// Handle the GetSharedResources requests for separate network and security
+// base stacks. The security stack also defines webSG if collide is set.
+func handleSplitBaseStacks(s *testServer, collide bool) {
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		return http.StatusOK, describeStackXML(params.Get("StackName"), "CREATE_COMPLETE", "")
+	})
+
+	s.Handle("ListStackResources", func(params url.Values) (int, string) {
+		if params.Get("StackName") == "network" {
+			return http.StatusOK, stackResourcesXML(
+				[3]string{"vpc", "vpc-1234", "AWS::EC2::VPC"},
+				[3]string{"webSG", "sg-web", "AWS::EC2::SecurityGroup"},
+			)
+		}
+
+		resources := [][3]string{
+			{"sshSG", "sg-ssh", "AWS::EC2::SecurityGroup"},
+			{"galaxyInstanceProfile", "galaxy-profile", "AWS::IAM::InstanceProfile"},
+		}
+		if collide {
+			resources = append(resources, [3]string{"webSG", "sg-other", "AWS::EC2::SecurityGroup"})
+		}
+		return http.StatusOK, stackResourcesXML(resources...)
+	})
+
+	s.Handle("DescribeSubnets", func(params url.Values) (int, string) {
+		if params.Get("Filter.1.Value.1") != "vpc-1234" {
+			return http.StatusOK, `<DescribeSubnetsResponse><subnetSet/></DescribeSubnetsResponse>`
+		}
+		return http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet><item><subnetId>subnet-a</subnetId><vpcId>vpc-1234</vpcId></item></subnetSet>
+</DescribeSubnetsResponse>`
+	})
+
+	s.Handle("ListServerCertificates", func(url.Values) (int, string) {
+		return http.StatusOK, `<ListServerCertificatesResponse/>`
+	})
+}
+
+func TestGetSharedResourcesMulti(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSplitBaseStacks(s, false)
+
+	shared, err := GetSharedResourcesMulti("network", "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sgs := map[string]string{"webSG": "sg-web", "sshSG": "sg-ssh"}
+	if !reflect.DeepEqual(shared.SecurityGroups, sgs) {
+		t.Errorf("SecurityGroups = %v, want %v", shared.SecurityGroups, sgs)
+	}
+	if shared.Roles["galaxyInstanceProfile"] != "galaxy-profile" {
+		t.Errorf("unexpected Roles: %v", shared.Roles)
+	}
+	if shared.VPCID != "vpc-1234" {
+		t.Errorf("VPCID = %q, want vpc-1234", shared.VPCID)
+	}
+	if !reflect.DeepEqual(shared.ListSubnets(), []string{"subnet-a"}) {
+		t.Errorf("unexpected Subnets: %v", shared.ListSubnets())
+	}
+}
+
+func TestGetSharedResourcesMultiCollision(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSplitBaseStacks(s, true)
+
+	_, err := GetSharedResourcesMulti("network", "security")
+	if err == nil {
+		t.Fatal("expected a collision error")
+	}
+
+	if !strings.Contains(err.Error(), "SecurityGroups.webSG in network and security") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestSharedResourcesLookup(t *testing.T) {
+	shared := SharedResources{
+		SecurityGroups: map[string]string{"webSG": "sg-web"},
+		Roles:          map[string]string{"galaxyInstanceProfile": "galaxy-profile"},
+		ServerCerts:    map[string]string{"galaxy-cert": "arn:cert"},
+	}
+
+	lookups := []struct {
+		lookup   func(string) (string, error)
+		key      string
+		expected string
+		missing  string
+	}{
+		{shared.SecurityGroup, "webSG", "sg-web", "no such security group in base stack: sshSG"},
+		{shared.Role, "galaxyInstanceProfile", "galaxy-profile", "no such role in base stack: sshSG"},
+		{shared.ServerCert, "galaxy-cert", "arn:cert", "no such server certificate: sshSG"},
+	}
+
+	for _, l := range lookups {
+		val, err := l.lookup(l.key)
+		if err != nil || val != l.expected {
+			t.Errorf("lookup %s = %q, %v; want %q", l.key, val, err, l.expected)
+		}
+
+		_, err = l.lookup("sshSG")
+		if err == nil || err.Error() != l.missing {
+			t.Errorf("expected error %q, got %v", l.missing, err)
+		}
+	}
+}
+
+func TestSharedResourcesAsParameters(t *testing.T) {
+	shared := SharedResources{
+		VPCID:          "vpc-1234",
+		SecurityGroups: map[string]string{"webSG": "sg-web"},
+		Parameters:     map[string]string{"KeyName": "galaxy-key"},
+		Subnets:        []Subnet{{ID: "subnet-1"}, {ID: "subnet-2"}},
+	}
+
+	params := shared.AsParameters(map[string]string{
+		"VpcId":   "VPCID",
+		"WebSG":   "sg.WebSG",
+		"SSHSG":   "sg.webSG",
+		"Subnets": "Subnets",
+		"KeyName": "param.KeyName",
+		"Cert":    "cert.galaxy-cert",
+	})
+
+	expected := map[string]string{
+		"VpcId":   "vpc-1234",
+		"SSHSG":   "sg-web",
+		"Subnets": "subnet-1,subnet-2",
+		"KeyName": "galaxy-key",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("AsParameters() = %v, want %v", params, expected)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	statuses := map[string]string{
+		"ok":  "CREATE_COMPLETE",
+		"bad": "ROLLBACK_COMPLETE",
+	}
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		name := params.Get("StackName")
+		return http.StatusOK, describeStackXML(name, statuses[name], "create failed")
+	})
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now())
+	})
+
+	errs := WaitAll(context.Background(), []string{"ok", "bad"}, time.Second)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 results, got %v", errs)
+	}
+
+	if err, ok := errs["ok"]; !ok || err != nil {
+		t.Errorf("expected ok to succeed, got %v", err)
+	}
+
+	if err := errs["bad"]; err == nil || err.Error() != "ROLLBACK_COMPLETE: create failed" {
+		t.Errorf("unexpected error for bad: %v", err)
+	}
+}
+
+func TestWaitAndDescribe(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	statuses := []string{"CREATE_IN_PROGRESS", "CREATE_COMPLETE"}
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>test</StackName>
+        <StackStatus>%s</StackStatus>
+        <Outputs>
+          <member><OutputKey>QueueURL</OutputKey><OutputValue>https://queue</OutputValue></member>
+        </Outputs>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`, status)
+	})
+
+	stack, err := WaitAndDescribe("test", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stack.Status != "CREATE_COMPLETE" {
+		t.Errorf("expected CREATE_COMPLETE, got %s", stack.Status)
+	}
+
+	if len(stack.Outputs) != 1 || stack.Outputs[0].Key != "QueueURL" || stack.Outputs[0].Value != "https://queue" {
+		t.Errorf("unexpected outputs: %#v", stack.Outputs)
+	}
+
+	if n := len(s.Requests("DescribeStacks")); n != 2 {
+		t.Errorf("expected 2 DescribeStacks requests, got %d", n)
+	}
+}
+
+func TestWaitContextCanceled(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "CREATE_IN_PROGRESS")
+
+	// cancel in the middle of a long poll interval
+	pollInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := WaitContext(ctx, "test", 2*time.Hour); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the wait to stop when canceled, took %s", d)
+	}
+}
+
+func TestWaitAllConcurrency(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(m int) { MaxConcurrency = m }(MaxConcurrency)
+	MaxConcurrency = 2
+
+	var mu sync.Mutex
+	polls := make(map[string]int)
+	inFlight, maxInFlight := make(map[string]bool), 0
+
+	// each stack completes on its third poll
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		name := params.Get("StackName")
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		polls[name]++
+		status := "CREATE_IN_PROGRESS"
+		if polls[name] == 3 {
+			status = "CREATE_COMPLETE"
+			delete(inFlight, name)
+		} else {
+			inFlight[name] = true
+		}
+		if len(inFlight) > maxInFlight {
+			maxInFlight = len(inFlight)
+		}
+		return http.StatusOK, describeStackXML(name, status, "")
+	})
+
+	names := []string{"a", "b", "c", "d", "e"}
+	errs := WaitAll(context.Background(), names, time.Second)
+	for _, name := range names {
+		if err, ok := errs[name]; !ok || err != nil {
+			t.Errorf("expected %s to succeed, got %v", name, err)
+		}
+	}
+
+	if maxInFlight > MaxConcurrency {
+		t.Errorf("%d stacks were polled at once, want at most %d", maxInFlight, MaxConcurrency)
+	}
+}
+
+func TestExistsByID(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	id := func(name string) string {
+		return "arn:aws:cloudformation:" + testRegion + ":123456789012:stack/" + name + "/1"
+	}
+
+	statuses := map[string]string{
+		id("live"):    "CREATE_COMPLETE",
+		id("deleted"): "DELETE_COMPLETE",
+	}
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		stackID := params.Get("StackName")
+		status, ok := statuses[stackID]
+		if !ok {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id "+stackID+" does not exist")
+		}
+		name := strings.Split(stackID, "/")[1]
+		return http.StatusOK, describeStackXML(name, status, "")
+	})
+
+	for name, expected := range map[string]bool{"live": true, "deleted": false, "missing": false} {
+		exists, err := ExistsByID(id(name))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if exists != expected {
+			t.Errorf("%s: expected exists=%t", name, expected)
+		}
+	}
+
+	for _, req := range s.Requests("DescribeStacks") {
+		if req.Get("StackName") == "" {
+			t.Errorf("expected only targeted DescribeStacks requests")
+		}
+	}
+}
+
+func TestWaitByStackID(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "CREATE_IN_PROGRESS", "CREATE_COMPLETE")
+
+	id := "arn:aws:cloudformation:" + testRegion + ":123456789012:stack/test/1"
+	if err := Wait(id, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("DescribeStacks")
+	if len(reqs) != 2 || reqs[0].Get("StackName") != id {
+		t.Errorf("unexpected DescribeStacks requests: %v", reqs)
+	}
+
+	exists, err := Exists(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("expected stack to exist by ID")
+	}
+}
+
+func TestMaxPages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(m int) { MaxPages = m }(MaxPages)
+	MaxPages = 5
+
+	// always return another page
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStackEventsResponse>
+  <DescribeStackEventsResult><StackEvents/><NextToken>more</NextToken></DescribeStackEventsResult>
+</DescribeStackEventsResponse>`
+	})
+	s.Handle("ListImports", func(url.Values) (int, string) {
+		return http.StatusOK, `<ListImportsResponse>
+  <ListImportsResult><Imports><member>pool</member></Imports><NextToken>more</NextToken></ListImportsResult>
+</ListImportsResponse>`
+	})
+
+	if _, err := DescribeStackEvents("test"); err != ErrMaxPages {
+		t.Errorf("DescribeStackEvents: expected ErrMaxPages, got %v", err)
+	}
+	if n := len(s.Requests("DescribeStackEvents")); n != MaxPages {
+		t.Errorf("expected %d DescribeStackEvents requests, got %d", MaxPages, n)
+	}
+
+	if _, err := ListImports("export"); err != ErrMaxPages {
+		t.Errorf("ListImports: expected ErrMaxPages, got %v", err)
+	}
+	if n := len(s.Requests("ListImports")); n != MaxPages {
+		t.Errorf("expected %d ListImports requests, got %d", MaxPages, n)
+	}
+}
+
+func TestStackEventsSince(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	event := func(id string, age int) string {
+		ts := now.Add(-time.Duration(age) * time.Second)
+		return fmt.Sprintf(`<member><EventId>%s</EventId><Timestamp>%s</Timestamp></member>`, id, ts.Format(time.RFC3339))
+	}
+
+	pages := map[string]string{
+		"":      event("e5", 0) + event("e4", 1),
+		"page2": event("e3", 2) + event("e2", 3),
+		"page3": event("e1", 4),
+	}
+	next := map[string]string{"": "page2", "page2": "page3"}
+
+	s.Handle("DescribeStackEvents", func(v url.Values) (int, string) {
+		token := v.Get("NextToken")
+		nextToken := ""
+		if next[token] != "" {
+			nextToken = "<NextToken>" + next[token] + "</NextToken>"
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult><StackEvents>%s</StackEvents>%s</DescribeStackEventsResult>
+</DescribeStackEventsResponse>`, pages[token], nextToken)
+	})
+
+	events, err := StackEventsSince("test", "e3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.EventId)
+	}
+	if !reflect.DeepEqual(ids, []string{"e5", "e4"}) {
+		t.Errorf("events = %v, want [e5 e4]", ids)
+	}
+
+	// the last page isn't needed
+	if n := len(s.Requests("DescribeStackEvents")); n != 2 {
+		t.Errorf("expected 2 DescribeStackEvents requests, got %d", n)
+	}
+}
+
+func TestGetSharedResourcesMultiConcurrency(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(m int) { MaxConcurrency = m }(MaxConcurrency)
+	MaxConcurrency = 2
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+
+	// count the requests in flight for every handler
+	track := func(f func(url.Values) (int, string)) func(url.Values) (int, string) {
+		return func(params url.Values) (int, string) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return f(params)
+		}
+	}
+
+	s.Handle("DescribeStacks", track(func(params url.Values) (int, string) {
+		return http.StatusOK, describeStackXML(params.Get("StackName"), "CREATE_COMPLETE", "")
+	}))
+	s.Handle("ListStackResources", track(func(params url.Values) (int, string) {
+		sg := params.Get("StackName") + "SG"
+		return http.StatusOK, stackResourcesXML([3]string{sg, "sg-" + sg, "AWS::EC2::SecurityGroup"})
+	}))
+	s.Handle("DescribeSubnets", track(func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeSubnetsResponse><subnetSet/></DescribeSubnetsResponse>`
+	}))
+	s.Handle("ListServerCertificates", track(func(url.Values) (int, string) {
+		return http.StatusOK, `<ListServerCertificatesResponse/>`
+	}))
+
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	shared, err := GetSharedResourcesMulti(names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shared.SecurityGroups) != len(names) {
+		t.Errorf("expected %d security groups, got %v", len(names), shared.SecurityGroups)
+	}
+
+	if maxInFlight > MaxConcurrency {
+		t.Errorf("%d requests were in flight, want at most %d", maxInFlight, MaxConcurrency)
+	}
+	if maxInFlight < 2 {
+		t.Errorf("expected concurrent requests, got at most %d in flight", maxInFlight)
+	}
+}
+
+func TestGetSharedResourcesMultiThrottled(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSplitBaseStacks(s, false)
+
+	// every other request is throttled
+	throttled := false
+	s.Handle("ListServerCertificates", func(url.Values) (int, string) {
+		throttled = !throttled
+		if throttled {
+			return http.StatusBadRequest, errorResponse("Throttling", "Rate exceeded")
+		}
+		return http.StatusOK, `<ListServerCertificatesResponse>
+  <ListServerCertificatesResult>
+    <ServerCertificateMetadataList>
+      <member>
+        <ServerCertificateName>web</ServerCertificateName>
+        <Arn>arn:aws:iam::123456789012:server-certificate/web</Arn>
+      </member>
+    </ServerCertificateMetadataList>
+  </ListServerCertificatesResult>
+</ListServerCertificatesResponse>`
+	})
+
+	defer func(m int) { MaxConcurrency = m }(MaxConcurrency)
+	MaxConcurrency = 1
+
+	shared, err := GetSharedResourcesMulti("network", "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.ServerCerts["web"] != "arn:aws:iam::123456789012:server-certificate/web" {
+		t.Errorf("expected the cert after a throttled request, got %v", shared.ServerCerts)
+	}
+	if n := len(s.Requests("ListServerCertificates")); n != 4 {
+		t.Errorf("expected 4 ListServerCertificates requests, got %d", n)
+	}
+}
+
+func TestGetSharedResourcesMultiRetriesRequests(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSplitBaseStacks(s, false)
+
+	// the first DescribeSubnets is throttled
+	var mu sync.Mutex
+	throttled := false
+	s.Handle("DescribeSubnets", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !throttled {
+			throttled = true
+			return http.StatusServiceUnavailable, errorResponse("RequestLimitExceeded", "Request limit exceeded")
+		}
+		return http.StatusOK, `<DescribeSubnetsResponse><subnetSet/></DescribeSubnetsResponse>`
+	})
+
+	if _, err := GetSharedResourcesMulti("network", "security"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the throttled request is made again
+	for action, expected := range map[string]int{
+		"DescribeStacks":         2,
+		"ListStackResources":     2,
+		"DescribeSubnets":        3,
+		"ListServerCertificates": 2,
+	} {
+		if n := len(s.Requests(action)); n != expected {
+			t.Errorf("expected %d %s requests, got %d", expected, action, n)
+		}
+	}
+}
+
+func TestListByPrefix(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	summary := func(name, status string) string {
+		return fmt.Sprintf(`<member><StackName>%s</StackName><StackStatus>%s</StackStatus></member>`, name, status)
+	}
+
+	s.Handle("ListStacks", func(params url.Values) (int, string) {
+		members, next := "", ""
+		if params.Get("NextToken") == "" {
+			members = summary("galaxy-pool-web", "CREATE_COMPLETE") + summary("galaxy-base", "CREATE_COMPLETE")
+			next = "<NextToken>page2</NextToken>"
+		} else {
+			members = summary("galaxy-pool-old", "DELETE_COMPLETE") + summary("galaxy-pool-worker", "UPDATE_COMPLETE")
+		}
+		return http.StatusOK, fmt.Sprintf(`<ListStacksResponse>
+  <ListStacksResult><StackSummaries>%s</StackSummaries>%s</ListStacksResult>
+</ListStacksResponse>`, members, next)
+	})
+
+	stacks, err := ListByPrefix("galaxy-pool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, stack := range stacks {
+		names = append(names, stack.StackName)
+	}
+
+	expected := []string{"galaxy-pool-web", "galaxy-pool-worker"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("stacks = %v, want %v", names, expected)
+	}
+}
+
+func TestListActiveStrict(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	member := func(name, status string) string {
+		return fmt.Sprintf(`<member><StackName>%s</StackName><StackStatus>%s</StackStatus></member>`, name, status)
+	}
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<DescribeStacksResponse>
+  <DescribeStacksResult><Stacks>%s</Stacks></DescribeStacksResult>
+</DescribeStacksResponse>`, member("web", "UPDATE_COMPLETE")+member("old", "DELETE_IN_PROGRESS")+member("worker", "UPDATE_ROLLBACK_COMPLETE"))
+	})
+
+	stacks, err := ListActive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"web", "old", "worker"}; !reflect.DeepEqual(stacks, expected) {
+		t.Errorf("stacks = %v, want %v", stacks, expected)
+	}
+
+	stacks, err = ListActiveWithOptions(map[string]string{"Strict": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"web", "worker"}; !reflect.DeepEqual(stacks, expected) {
+		t.Errorf("strict stacks = %v, want %v", stacks, expected)
+	}
+}
+
+func TestCanUpdate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	status := "UPDATE_IN_PROGRESS"
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		if params.Get("StackName") != "test" {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id "+params.Get("StackName")+" does not exist")
+		}
+		return http.StatusOK, describeStackXML("test", status, "")
+	})
+
+	ok, reason, err := CanUpdate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected a stack in UPDATE_IN_PROGRESS not to be updatable")
+	}
+	if expected := "stack test is in UPDATE_IN_PROGRESS; wait for the operation to finish"; reason != expected {
+		t.Errorf("expected reason %q, got %q", expected, reason)
+	}
+
+	status = "UPDATE_ROLLBACK_COMPLETE"
+	if ok, reason, err := CanUpdate("test"); err != nil || !ok || reason != "" {
+		t.Errorf("expected a stack in UPDATE_ROLLBACK_COMPLETE to be updatable, got %t, %q, %v", ok, reason, err)
+	}
+
+	if ok, reason, err := CanUpdate("missing"); err != nil || ok || reason != "stack missing does not exist" {
+		t.Errorf("expected a missing stack not to be updatable, got %t, %q, %v", ok, reason, err)
+	}
+}
+
+func TestUpdateStackPolicies(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	during := `{"Statement":[{"Effect":"Allow","Action":"Update:*","Principal":"*","Resource":"*"}]}`
+	policy := `{"Statement":[{"Effect":"Deny","Action":"Update:Delete","Principal":"*","Resource":"*"}]}`
+
+	opts := map[string]string{
+		"StackPolicyDuringUpdateBody": during,
+		"StackPolicyBody":             policy,
+		"KeyName":                     "key",
+	}
+	if _, err := Update("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("UpdateStack")[0]
+	if req.Get("StackPolicyDuringUpdateBody") != during {
+		t.Errorf("StackPolicyDuringUpdateBody = %q", req.Get("StackPolicyDuringUpdateBody"))
+	}
+	if req.Get("StackPolicyBody") != policy {
+		t.Errorf("StackPolicyBody = %q", req.Get("StackPolicyBody"))
+	}
+
+	// the policies aren't stack parameters
+	if req.Get("Parameters.member.1.ParameterKey") != "KeyName" || req.Get("Parameters.member.2.ParameterKey") != "" {
+		t.Errorf("unexpected parameters: %v", req)
+	}
+}
+
+func TestNonParameterOptions(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	opts := map[string]string{"KeyName": "key"}
+	for key := range nonParameterOptions {
+		opts[key] = "false"
+	}
+	opts["StackPolicyBody"] = "{}"
+	opts["StackPolicyDuringUpdateBody"] = "{}"
+	opts["RollbackAlarms"] = "arn:aws:cloudwatch:galaxy-test-1:123456789012:alarm:errors"
+	opts["RollbackMonitoringMinutes"] = "5"
+
+	if _, err := Create("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{"CreateStack", "UpdateStack"} {
+		req := s.Requests(action)[0]
+		if req.Get("Parameters.member.1.ParameterKey") != "KeyName" || req.Get("Parameters.member.2.ParameterKey") != "" {
+			t.Errorf("%s: expected only KeyName as a parameter, got %v", action, req)
+		}
+		if req.Get("StackPolicyBody") != "{}" {
+			t.Errorf("%s: StackPolicyBody = %q", action, req.Get("StackPolicyBody"))
+		}
+	}
+}
+
+func TestUpdateInheritParameters(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>test</StackName>
+        <StackStatus>UPDATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>old-key</ParameterValue></member>
+          <member><ParameterKey>DBPassword</ParameterKey><ParameterValue>****</ParameterValue></member>
+          <member><ParameterKey>InstanceType</ParameterKey><ParameterValue>t2.small</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+
+	opts := map[string]string{
+		"InheritParameters": "true",
+		"KeyName":           "new-key",
+	}
+	tmpl := []byte(`{"Parameters": {
+  "KeyName": {"Type": "String"},
+  "DBPassword": {"Type": "String", "NoEcho": "true"},
+  "InstanceType": {"Type": "String"}
+}}`)
+	if _, err := Update("test", tmpl, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("UpdateStack")[0]
+	expected := map[string]string{
+		"Parameters.member.1.ParameterKey":     "InstanceType",
+		"Parameters.member.1.ParameterValue":   "t2.small",
+		"Parameters.member.2.ParameterKey":     "KeyName",
+		"Parameters.member.2.ParameterValue":   "new-key",
+		"Parameters.member.3.ParameterKey":     "DBPassword",
+		"Parameters.member.3.ParameterValue":   "",
+		"Parameters.member.3.UsePreviousValue": "true",
+		"Parameters.member.4.ParameterKey":     "",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+
+	// parameters the new template drops aren't sent, even if NoEcho
+	tmpl = []byte(`{"Parameters": {"KeyName": {"Type": "String"}}}`)
+	if _, err := Update("test", tmpl, map[string]string{"InheritParameters": "true"}); err != nil {
+		t.Fatal(err)
+	}
+
+	req = s.Requests("UpdateStack")[1]
+	expected = map[string]string{
+		"Parameters.member.1.ParameterKey":   "KeyName",
+		"Parameters.member.1.ParameterValue": "old-key",
+		"Parameters.member.2.ParameterKey":   "",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+}
+
+func TestStackParameters(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>test</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>key</ParameterValue></member>
+          <member><ParameterKey>DBPassword</ParameterKey><ParameterValue>****</ParameterValue></member>
+          <member><ParameterKey>InstanceType</ParameterKey><ParameterValue>t2.small</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	params, noEcho, err := StackParameters("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(noEcho, []string{"DBPassword"}) {
+		t.Errorf("expected DBPassword to be NoEcho, got %v", noEcho)
+	}
+
+	expected := map[string]string{"KeyName": "key", "InstanceType": "t2.small"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("parameters = %v, want %v", params, expected)
+	}
+}
+
+func TestSharedResourcesNoEcho(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>base</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>galaxy-key</ParameterValue></member>
+          <member><ParameterKey>DBPassword</ParameterKey><ParameterValue>****</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	desc, err := DescribeStacks("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, param := range desc.Stacks[0].Parameters {
+		if param.NoEcho != (param.Key == "DBPassword") {
+			t.Errorf("parameter %s has NoEcho=%t", param.Key, param.NoEcho)
+		}
+	}
+
+	shared, err := GetSharedResources("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"KeyName": "galaxy-key"}
+	if !reflect.DeepEqual(shared.Parameters, expected) {
+		t.Errorf("shared parameters = %v, want %v", shared.Parameters, expected)
+	}
+}
+
+func TestRollbackConfiguration(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	alarm := "arn:aws:cloudwatch:galaxy-test-1:123456789012:alarm:web-5xx"
+	opts := map[string]string{
+		"RollbackAlarms":            alarm,
+		"RollbackMonitoringMinutes": "10",
+		"KeyName":                   "key",
+	}
+	if _, err := Create("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("CreateStack")[0]
+	expected := map[string]string{
+		"RollbackConfiguration.RollbackTriggers.member.1.Arn":  alarm,
+		"RollbackConfiguration.RollbackTriggers.member.1.Type": "AWS::CloudWatch::Alarm",
+		"RollbackConfiguration.MonitoringTimeInMinutes":        "10",
+		"Parameters.member.1.ParameterKey":                     "KeyName",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+
+	if p := req.Get("Parameters.member.2.ParameterKey"); p != "" {
+		t.Errorf("unexpected parameter %q", p)
+	}
+
+	opts["RollbackMonitoringMinutes"] = "ten"
+	if _, err := Update("test", []byte("{}"), opts); err == nil {
+		t.Error("expected an error for invalid RollbackMonitoringMinutes")
+	}
+	if n := len(s.Requests("UpdateStack")); n != 0 {
+		t.Errorf("expected no UpdateStack requests, got %d", n)
+	}
+}
+
+func TestCreateInvalidStackName(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	_, err := Create("web_pool", []byte("{}"), nil)
+	if err == nil || !strings.Contains(err.Error(), `invalid stack name "web_pool"`) {
+		t.Errorf("expected an invalid stack name error, got %v", err)
+	}
+
+	if n := len(s.Requests("CreateStack")); n != 0 {
+		t.Errorf("expected no CreateStack requests, got %d", n)
+	}
+
+	if err := ValidStackName(strings.Repeat("a", 129)); err == nil {
+		t.Error("expected an error for a name over 128 characters")
+	}
+
+	if err := ValidStackName("galaxy-prod-web2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSanitizeStackName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"web_pool":          "web-pool",
+		"galaxy_prod__web":  "galaxy-prod-web",
+		"2fast":             "stack-2fast",
+		"":                  "stack-",
+		"already-valid-123": "already-valid-123",
+	} {
+		sanitized := SanitizeStackName(name)
+		if sanitized != expected {
+			t.Errorf("SanitizeStackName(%q) = %q, want %q", name, sanitized, expected)
+		}
+		if err := ValidStackName(sanitized); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCreateRetryIAMErrors(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	delays := []time.Duration{}
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	creates := 0
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		creates++
+		if creates < 3 {
+			return http.StatusBadRequest, errorResponse("ValidationError",
+				"Role arn:aws:iam::123456789012:role/galaxy is invalid or cannot be assumed")
+		}
+		return http.StatusOK, createStackXML("test")
+	})
+
+	opts := map[string]string{"RetryIAMErrors": "true"}
+	if _, err := Create("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if creates != 3 {
+		t.Errorf("expected 3 CreateStack requests, got %d", creates)
+	}
+
+	expected := []time.Duration{pollInterval, 2 * pollInterval}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("delays = %v, want %v", delays, expected)
+	}
+
+	if p := s.Requests("CreateStack")[2].Get("Parameters.member.1.ParameterKey"); p != "" {
+		t.Errorf("unexpected parameter %q", p)
+	}
+}
+
+func TestCreateRetryIAMErrorsFailsFast(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusBadRequest, errorResponse("ValidationError", "Template format error: JSON not well-formed.")
+	})
+
+	opts := map[string]string{"RetryIAMErrors": "true"}
+	if _, err := Create("test", []byte("{"), opts); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if n := len(s.Requests("CreateStack")); n != 1 {
+		t.Errorf("expected 1 CreateStack request, got %d", n)
+	}
+}
+
+func TestGetStackVPCs(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		return http.StatusOK, stackResourcesXML(
+			[3]string{"hubVPC", "vpc-hub", "AWS::EC2::VPC"},
+			[3]string{"peering", "pcx-1234", "AWS::EC2::VPCPeeringConnection"},
+			[3]string{"spokeVPC", "vpc-spoke", "AWS::EC2::VPC"},
+		)
+	})
+
+	vpcs, err := GetStackVPCs("transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vpcs, []string{"vpc-hub", "vpc-spoke"}) {
+		t.Errorf("VPCs = %v", vpcs)
+	}
+
+	vpc, err := GetStackVPC("transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vpc != "vpc-hub" {
+		t.Errorf("VPC = %q, want vpc-hub", vpc)
+	}
+}
+
+func TestGetStackVPCSources(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(key string) { VPCTagKey = key }(VPCTagKey)
+	VPCTagKey = "galaxy:vpc"
+
+	// Respond with the given resources, outputs and tags
+	handle := func(resources [][3]string, outputs, tags map[string]string) {
+		s.Handle("ListStackResources", func(url.Values) (int, string) {
+			return http.StatusOK, stackResourcesXML(resources...)
+		})
+
+		s.Handle("DescribeStacks", func(url.Values) (int, string) {
+			members := ""
+			for _, k := range sortedKeys(outputs) {
+				members += fmt.Sprintf("<member><OutputKey>%s</OutputKey><OutputValue>%s</OutputValue></member>", k, outputs[k])
+			}
+			tagMembers := ""
+			for _, k := range sortedKeys(tags) {
+				tagMembers += fmt.Sprintf("<member><Key>%s</Key><Value>%s</Value></member>", k, tags[k])
+			}
+			return http.StatusOK, fmt.Sprintf(`<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>app</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Outputs>%s</Outputs>
+        <Tags>%s</Tags>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`, members, tagMembers)
+		})
+	}
+
+	vpcResource := [][3]string{{"VPC", "vpc-resource", "AWS::EC2::VPC"}}
+	outputs := map[string]string{"VPC": "vpc-output-2", "VpcId": "vpc-output-1"}
+	tags := map[string]string{"galaxy:vpc": "vpc-tag"}
+
+	for _, tc := range []struct {
+		resources     [][3]string
+		outputs, tags map[string]string
+		vpc           string
+	}{
+		{vpcResource, outputs, tags, "vpc-resource"},
+		{nil, outputs, tags, "vpc-output-1"},
+		{nil, nil, tags, "vpc-tag"},
+	} {
+		handle(tc.resources, tc.outputs, tc.tags)
+
+		vpc, err := GetStackVPC("app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vpc != tc.vpc {
+			t.Errorf("VPC = %q, want %q", vpc, tc.vpc)
+		}
+	}
+
+	handle(nil, nil, nil)
+	_, err := GetStackVPC("app")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := "no VPC found in stack app: tried resources of type AWS::EC2::VPC; outputs VpcId, VPCId, VPC; tag galaxy:vpc"
+	if err.Error() != expected {
+		t.Errorf("error = %q, want %q", err, expected)
+	}
+}
+
+func TestExportStack(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	tmpl := `{"Parameters": {"KeyName": {"Type": "String"}, "DBPassword": {"Type": "String", "NoEcho": true}}}`
+	s.Handle("GetTemplate", func(url.Values) (int, string) {
+		return http.StatusOK, `<GetTemplateResponse>
+  <GetTemplateResult><TemplateBody>` + tmpl + `</TemplateBody></GetTemplateResult>
+</GetTemplateResponse>`
+	})
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>web</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>galaxy-key</ParameterValue></member>
+          <member><ParameterKey>DBPassword</ParameterKey><ParameterValue>****</ParameterValue></member>
+        </Parameters>
+        <Tags>
+          <member><Key>Name</Key><Value>web</Value></member>
+          <member><Key>env</Key><Value>prod</Value></member>
+          <member><Key>aws:cloudformation:stack-name</Key><Value>web</Value></member>
+        </Tags>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("web-clone")
+	})
+
+	body, params, tags, noEcho, err := ExportStack("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(noEcho, []string{"DBPassword"}) {
+		t.Errorf("expected DBPassword to be NoEcho, got %v", noEcho)
+	}
+
+	if string(body) != tmpl {
+		t.Errorf("unexpected template: %s", body)
+	}
+	if !reflect.DeepEqual(params, map[string]string{"KeyName": "galaxy-key"}) {
+		t.Errorf("params = %v", params)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"env": "prod"}) {
+		t.Errorf("tags = %v", tags)
+	}
+
+	// supply the NoEcho parameter, and create a copy of the stack
+	options := map[string]string{"DBPassword": "secret"}
+	for k, v := range params {
+		options[k] = v
+	}
+	for k, v := range tags {
+		options["tag."+k] = v
+	}
+
+	if err := ValidateParameters(body, options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create("web-clone", body, options); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("CreateStack")[0]
+	expected := map[string]string{
+		"TemplateBody":                       tmpl,
+		"Parameters.member.1.ParameterKey":   "DBPassword",
+		"Parameters.member.1.ParameterValue": "secret",
+		"Parameters.member.2.ParameterKey":   "KeyName",
+		"Parameters.member.2.ParameterValue": "galaxy-key",
+		"Tags.member.1.Key":                  "Name",
+		"Tags.member.1.Value":                "web-clone",
+		"Tags.member.2.Key":                  "env",
+		"Tags.member.2.Value":                "prod",
+	}
+	for k, v := range expected {
+		if req.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, req.Get(k), v)
+		}
+	}
+
+	// a stack which isn't described is an error, not an empty export
+	if _, _, _, _, err := ExportStack("missing"); err == nil {
+		t.Error("expected an error for a missing stack")
+	}
+}
@@ -0,0 +1,204 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the template sections compared by DiffTemplates
+var diffSections = []string{"Parameters", "Resources"}
+
+// Return a unified diff of the Parameters and Resources of two templates.
+// Each template is normalized before comparison, so differences in key order
+// and formatting are ignored. Each changed parameter or resource is shown as
+// its own hunk, with added and removed entries shown in full. An empty string
+// is returned if there are no differences.
+func DiffTemplates(old, new []byte) (string, error) {
+	oldTmpl, err := parseTemplate(old)
+	if err != nil {
+		return "", fmt.Errorf("old template: %s", err)
+	}
+
+	newTmpl, err := parseTemplate(new)
+	if err != nil {
+		return "", fmt.Errorf("new template: %s", err)
+	}
+
+	out := &bytes.Buffer{}
+	for _, section := range diffSections {
+		oldSection, _ := oldTmpl[section].(map[string]interface{})
+		newSection, _ := newTmpl[section].(map[string]interface{})
+
+		names := []string{}
+		for name := range oldSection {
+			names = append(names, name)
+		}
+		for name := range newSection {
+			if _, ok := oldSection[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			oldLines, err := jsonLines(oldSection[name])
+			if err != nil {
+				return "", err
+			}
+			newLines, err := jsonLines(newSection[name])
+			if err != nil {
+				return "", err
+			}
+
+			hunk := diffLines(oldLines, newLines)
+			if hunk == "" {
+				continue
+			}
+
+			fmt.Fprintf(out, "@@ %s.%s @@\n%s", section, name, hunk)
+		}
+	}
+
+	if out.Len() == 0 {
+		return "", nil
+	}
+
+	return "--- old\n+++ new\n" + out.String(), nil
+}
+
+// Parse a JSON or YAML template into a generic map. The short form of
+// intrinsic functions in YAML, like "!Ref Name" or "!GetAtt ELB.DNSName", is
+// expanded to the long form used in JSON, so that both formats of the same
+// template parse the same way.
+func parseTemplate(body []byte) (map[string]interface{}, error) {
+	tmpl := make(map[string]interface{})
+	if isJSONTemplate(body) {
+		if err := json.Unmarshal(body, &tmpl); err != nil {
+			return nil, err
+		}
+		return tmpl, nil
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(body, doc); err != nil {
+		return nil, err
+	}
+	normalizeYAML(doc)
+
+	if err := doc.Decode(&tmpl); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Check if a template is JSON rather than YAML
+func isJSONTemplate(body []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+// Replace the YAML short form tags of intrinsic functions in n with the
+// equivalent long form mappings, e.g. "!Sub x" with "Fn::Sub: x". Dates, like
+// the AWSTemplateFormatVersion, are kept as strings as they would be in JSON.
+func normalizeYAML(n *yaml.Node) {
+	for _, child := range n.Content {
+		normalizeYAML(child)
+	}
+
+	if n.Tag == "!!timestamp" {
+		n.Tag = "!!str"
+		return
+	}
+
+	if !strings.HasPrefix(n.Tag, "!") || strings.HasPrefix(n.Tag, "!!") {
+		return
+	}
+
+	fn := n.Tag[1:]
+	if fn != "Ref" && fn != "Condition" {
+		fn = "Fn::" + fn
+	}
+
+	arg := *n
+	arg.Tag = ""
+	if fn == "Fn::GetAtt" && arg.Kind == yaml.ScalarNode {
+		// "!GetAtt Resource.Attribute" is short for [Resource, Attribute]
+		parts := strings.SplitN(arg.Value, ".", 2)
+		arg = yaml.Node{Kind: yaml.SequenceNode}
+		for _, part := range parts {
+			arg.Content = append(arg.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: part})
+		}
+	}
+
+	*n = yaml.Node{
+		Kind: yaml.MappingNode,
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: fn},
+			&arg,
+		},
+	}
+}
+
+// Marshal v into indented json lines, with map keys sorted. A nil value
+// returns no lines.
+func jsonLines(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+// Return a line diff of a and b, with each line prefixed by "+", "-", or " ".
+// Returns an empty string if a and b are equal.
+func diffLines(a, b []string) string {
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(out, " %s\n", a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(out, "+%s\n", b[j])
+			changed = true
+			j++
+		default:
+			fmt.Fprintf(out, "-%s\n", a[i])
+			changed = true
+			i++
+		}
+	}
+
+	if !changed {
+		return ""
+	}
+	return out.String()
+}
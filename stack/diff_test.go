@@ -0,0 +1,118 @@
+package stack
+
+import (
+	"strings"
+	"testing"
+)
+
+var diffOldTmpl = []byte(`{
+    "Parameters": {"KeyName": {"Type": "String"}},
+    "Resources": {
+        "lc": {"Type": "AWS::AutoScaling::LaunchConfiguration", "Properties": {"InstanceType": "t2.small"}}
+    }
+}`)
+
+// the same template with different key order and formatting, plus a new
+// security group.
+var diffNewTmpl = []byte(`{"Resources": {
+    "webSG": {"Type": "AWS::EC2::SecurityGroup", "Properties": {"GroupDescription": "web"}},
+    "lc": {"Properties": {"InstanceType": "t2.small"}, "Type": "AWS::AutoScaling::LaunchConfiguration"}},
+ "Parameters": {"KeyName": {"Type": "String"}}}`)
+
+func TestDiffTemplatesNoChange(t *testing.T) {
+	diff, err := DiffTemplates(diffOldTmpl, diffOldTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("expected no diff, got:\n%s", diff)
+	}
+}
+
+func TestDiffTemplatesAddedResource(t *testing.T) {
+	diff, err := DiffTemplates(diffOldTmpl, diffNewTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `--- old
++++ new
+@@ Resources.webSG @@
++{
++    "Properties": {
++        "GroupDescription": "web"
++    },
++    "Type": "AWS::EC2::SecurityGroup"
++}
+`
+	if diff != expected {
+		t.Errorf("expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+}
+
+func TestDiffTemplatesChangedResource(t *testing.T) {
+	changed := []byte(strings.Replace(string(diffOldTmpl), "t2.small", "t2.large", 1))
+
+	diff, err := DiffTemplates(diffOldTmpl, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(diff, "@@ Resources.lc @@\n") ||
+		!strings.Contains(diff, `-        "InstanceType": "t2.small"`) ||
+		!strings.Contains(diff, `+        "InstanceType": "t2.large"`) {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
+
+func TestDiffTemplatesYAML(t *testing.T) {
+	jsonTmpl := []byte(`{
+    "AWSTemplateFormatVersion": "2010-09-09",
+    "Parameters": {"KeyName": {"Type": "String"}},
+    "Resources": {
+        "lc": {"Type": "AWS::AutoScaling::LaunchConfiguration", "Properties": {
+            "KeyName": {"Ref": "KeyName"},
+            "SecurityGroups": [{"Fn::GetAtt": ["webSG", "GroupId"]}],
+            "UserData": {"Fn::Base64": {"Fn::Sub": "${AWS::StackName}"}},
+            "EbsOptimized": true,
+            "BlockDeviceMappings": [{"DeviceName": "/dev/sda1", "Ebs": {"VolumeSize": 20}}]
+        }}
+    }
+}`)
+
+	yamlTmpl := []byte(`AWSTemplateFormatVersion: 2010-09-09
+Parameters:
+  KeyName:
+    Type: String
+Resources:
+  lc:
+    Type: AWS::AutoScaling::LaunchConfiguration
+    Properties:
+      KeyName: !Ref KeyName
+      SecurityGroups:
+        - !GetAtt webSG.GroupId
+      UserData: !Base64
+        Fn::Sub: "${AWS::StackName}"
+      EbsOptimized: true
+      BlockDeviceMappings:
+        - DeviceName: /dev/sda1
+          Ebs:
+            VolumeSize: 20
+`)
+
+	diff, err := DiffTemplates(jsonTmpl, yamlTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("expected no diff between JSON and YAML, got:\n%s", diff)
+	}
+
+	tmpl, err := parseTemplate(yamlTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := tmpl["AWSTemplateFormatVersion"]; v != "2010-09-09" {
+		t.Errorf("expected the version as a string, got %#v", v)
+	}
+}
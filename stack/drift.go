@@ -0,0 +1,130 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// how long to wait for drift detection to complete
+var driftTimeout = 5 * time.Minute
+
+type DetectStackDriftResponse struct {
+	RequestId             string `xml:"ResponseMetadata>RequestId"`
+	StackDriftDetectionId string `xml:"DetectStackDriftResult>StackDriftDetectionId"`
+}
+
+type DescribeStackDriftDetectionStatusResponse struct {
+	RequestId                 string `xml:"ResponseMetadata>RequestId"`
+	StackDriftStatus          string `xml:"DescribeStackDriftDetectionStatusResult>StackDriftStatus"`
+	DetectionStatus           string `xml:"DescribeStackDriftDetectionStatusResult>DetectionStatus"`
+	DetectionStatusReason     string `xml:"DescribeStackDriftDetectionStatusResult>DetectionStatusReason"`
+	DriftedStackResourceCount int    `xml:"DescribeStackDriftDetectionStatusResult>DriftedStackResourceCount"`
+}
+
+type resourceDrift struct {
+	LogicalResourceId        string
+	PhysicalResourceId       string
+	ResourceType             string
+	StackResourceDriftStatus string
+}
+
+type DescribeStackResourceDriftsResponse struct {
+	RequestId string          `xml:"ResponseMetadata>RequestId"`
+	Drifts    []resourceDrift `xml:"DescribeStackResourceDriftsResult>StackResourceDrifts>member"`
+	NextToken string          `xml:"DescribeStackResourceDriftsResult>NextToken"`
+}
+
+// DriftError is returned when a stack's resources have drifted from its
+// template.
+type DriftError struct {
+	Stack string
+	// the drifted resources, as "LogicalResourceId (STATUS)"
+	Resources []string
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("stack %s has drifted: %s", e.Stack, strings.Join(e.Resources, ", "))
+}
+
+// Run drift detection on a stack, and wait for it to complete. A *DriftError
+// listing the drifted resources is returned if the stack has drifted.
+func (c *Client) CheckDrift(name string) error {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return err
+	}
+
+	detectResp := DetectStackDriftResponse{}
+	params := map[string]string{
+		"Action":    "DetectStackDrift",
+		"StackName": name,
+	}
+	if err := query(svc, params, &detectResp); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(driftTimeout)
+	statusResp := DescribeStackDriftDetectionStatusResponse{}
+	for {
+		params := map[string]string{
+			"Action":                "DescribeStackDriftDetectionStatus",
+			"StackDriftDetectionId": detectResp.StackDriftDetectionId,
+		}
+		if err := query(svc, params, &statusResp); err != nil {
+			return err
+		}
+
+		if statusResp.DetectionStatus != "DETECTION_IN_PROGRESS" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		sleep(pollInterval)
+	}
+
+	if statusResp.DetectionStatus == "DETECTION_FAILED" {
+		return fmt.Errorf("drift detection failed for %s: %s", name, statusResp.DetectionStatusReason)
+	}
+
+	if statusResp.StackDriftStatus != "DRIFTED" {
+		return nil
+	}
+
+	driftErr := &DriftError{Stack: name}
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action":    "DescribeStackResourceDrifts",
+			"StackName": name,
+			"StackResourceDriftStatusFilters.member.1": "MODIFIED",
+			"StackResourceDriftStatusFilters.member.2": "DELETED",
+		}
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		driftsResp := DescribeStackResourceDriftsResponse{}
+		if err := query(svc, params, &driftsResp); err != nil {
+			return err
+		}
+
+		for _, drift := range driftsResp.Drifts {
+			driftErr.Resources = append(driftErr.Resources,
+				fmt.Sprintf("%s (%s)", drift.LogicalResourceId, drift.StackResourceDriftStatus))
+		}
+
+		nextToken = driftsResp.NextToken
+		if nextToken == "" {
+			break
+		}
+	}
+
+	return driftErr
+}
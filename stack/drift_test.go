@@ -0,0 +1,96 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// Handle drift detection for a stack with one modified resource
+func handleDrift(s *testServer) {
+	s.Handle("DetectStackDrift", func(url.Values) (int, string) {
+		return http.StatusOK, `<DetectStackDriftResponse>
+  <DetectStackDriftResult><StackDriftDetectionId>detection-1</StackDriftDetectionId></DetectStackDriftResult>
+</DetectStackDriftResponse>`
+	})
+
+	statuses := []string{"DETECTION_IN_PROGRESS", "DETECTION_COMPLETE"}
+	s.Handle("DescribeStackDriftDetectionStatus", func(url.Values) (int, string) {
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return http.StatusOK, `<DescribeStackDriftDetectionStatusResponse>
+  <DescribeStackDriftDetectionStatusResult>
+    <StackDriftStatus>DRIFTED</StackDriftStatus>
+    <DetectionStatus>` + status + `</DetectionStatus>
+    <DriftedStackResourceCount>1</DriftedStackResourceCount>
+  </DescribeStackDriftDetectionStatusResult>
+</DescribeStackDriftDetectionStatusResponse>`
+	})
+
+	s.Handle("DescribeStackResourceDrifts", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStackResourceDriftsResponse>
+  <DescribeStackResourceDriftsResult>
+    <StackResourceDrifts>
+      <member>
+        <LogicalResourceId>webSG</LogicalResourceId>
+        <ResourceType>AWS::EC2::SecurityGroup</ResourceType>
+        <StackResourceDriftStatus>MODIFIED</StackResourceDriftStatus>
+      </member>
+    </StackResourceDrifts>
+  </DescribeStackResourceDriftsResult>
+</DescribeStackResourceDriftsResponse>`
+	})
+
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse><UpdateStackResult><StackId>test</StackId></UpdateStackResult></UpdateStackResponse>`
+	})
+}
+
+func TestUpdateRefusesDrift(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleDrift(s)
+
+	_, err := Update("test", []byte("{}"), map[string]string{"CheckDrift": "true"})
+	driftErr, ok := err.(*DriftError)
+	if !ok {
+		t.Fatalf("expected a *DriftError, got %v", err)
+	}
+
+	if !reflect.DeepEqual(driftErr.Resources, []string{"webSG (MODIFIED)"}) {
+		t.Errorf("unexpected drifted resources: %v", driftErr.Resources)
+	}
+
+	if n := len(s.Requests("DescribeStackDriftDetectionStatus")); n != 2 {
+		t.Errorf("expected 2 detection status requests, got %d", n)
+	}
+	if n := len(s.Requests("UpdateStack")); n != 0 {
+		t.Errorf("expected no UpdateStack requests, got %d", n)
+	}
+}
+
+func TestUpdateAllowDrift(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleDrift(s)
+
+	opts := map[string]string{"CheckDrift": "true", "AllowDrift": "true"}
+	if _, err := Update("test", []byte("{}"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("UpdateStack")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 UpdateStack request, got %d", len(reqs))
+	}
+
+	// the options aren't stack parameters
+	if p := reqs[0].Get("Parameters.member.1.ParameterKey"); p != "" {
+		t.Errorf("unexpected parameter %q", p)
+	}
+}
@@ -0,0 +1,195 @@
+package stack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrExportNotFound is returned by GetExport for an unknown export name.
+var ErrExportNotFound = fmt.Errorf("export not found")
+
+// How long GetExport reuses the list of exports before listing them again
+var exportsCacheTTL = 30 * time.Second
+
+type stackExport struct {
+	ExportingStackId string
+	Name             string
+	Value            string
+}
+
+type ListExportsResponse struct {
+	RequestId string        `xml:"ResponseMetadata>RequestId"`
+	Exports   []stackExport `xml:"ListExportsResult>Exports>member"`
+	NextToken string        `xml:"ListExportsResult>NextToken"`
+}
+
+type ListImportsResponse struct {
+	RequestId string   `xml:"ResponseMetadata>RequestId"`
+	Imports   []string `xml:"ListImportsResult>Imports>member"`
+	NextToken string   `xml:"ListImportsResult>NextToken"`
+}
+
+// ExportInUseError is returned when deleting a stack with exports that are
+// still imported by other stacks.
+type ExportInUseError struct {
+	Stack string
+	// the importing stacks, keyed by export name
+	Imports map[string][]string
+}
+
+func (e *ExportInUseError) Error() string {
+	exports := []string{}
+	for export := range e.Imports {
+		exports = append(exports, export)
+	}
+	sort.Strings(exports)
+
+	msgs := []string{}
+	for _, export := range exports {
+		msgs = append(msgs, fmt.Sprintf("%s is imported by %s", export, strings.Join(e.Imports[export], ", ")))
+	}
+
+	return fmt.Sprintf("stack %s has exports in use: %s", e.Stack, strings.Join(msgs, "; "))
+}
+
+// List the names of all stacks importing the named export.
+func (c *Client) ListImports(exportName string) ([]string, error) {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return nil, err
+	}
+
+	imports := []string{}
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return nil, ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action":     "ListImports",
+			"ExportName": exportName,
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		listResp := ListImportsResponse{}
+		if err := query(svc, params, &listResp); err != nil {
+			// AWS returns an error rather than an empty list
+			if strings.Contains(err.Error(), "is not imported by any stack") {
+				return imports, nil
+			}
+			return nil, err
+		}
+
+		imports = append(imports, listResp.Imports...)
+
+		nextToken = listResp.NextToken
+		if nextToken == "" {
+			return imports, nil
+		}
+	}
+}
+
+// List all exports in the region.
+func (c *Client) ListExports() ([]stackExport, error) {
+	svc, err := c.getService("cf")
+	if err != nil {
+		return nil, err
+	}
+
+	exports := []stackExport{}
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return nil, ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action": "ListExports",
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		listResp := ListExportsResponse{}
+		if err := query(svc, params, &listResp); err != nil {
+			return nil, err
+		}
+
+		exports = append(exports, listResp.Exports...)
+
+		nextToken = listResp.NextToken
+		if nextToken == "" {
+			return exports, nil
+		}
+	}
+}
+
+// Return the value of a single export, or ErrExportNotFound. The exports are
+// listed at most once every exportsCacheTTL, so that resolving several
+// exports doesn't list them all each time.
+func (c *Client) GetExport(name string) (string, error) {
+	c.exportsMu.Lock()
+	defer c.exportsMu.Unlock()
+
+	if c.exports == nil || time.Since(c.exportsListed) > exportsCacheTTL {
+		exports, err := c.ListExports()
+		if err != nil {
+			return "", err
+		}
+
+		c.exports = make(map[string]string)
+		for _, export := range exports {
+			c.exports[export.Name] = export.Value
+		}
+		c.exportsListed = time.Now()
+	}
+
+	value, ok := c.exports[name]
+	if !ok {
+		return "", ErrExportNotFound
+	}
+	return value, nil
+}
+
+// Return an *ExportInUseError if any of the stack's exports are imported by
+// another stack.
+func (c *Client) checkImports(name string) error {
+	descResp, err := c.DescribeStacks(name)
+	if err != nil {
+		return err
+	}
+
+	inUse := &ExportInUseError{
+		Stack:   name,
+		Imports: make(map[string][]string),
+	}
+
+	for _, stack := range descResp.Stacks {
+		if !stack.matches(name) {
+			continue
+		}
+
+		for _, export := range stack.ExportedNames() {
+			imports, err := c.ListImports(export)
+			if err != nil {
+				return err
+			}
+
+			if len(imports) > 0 {
+				inUse.Imports[export] = imports
+			}
+		}
+	}
+
+	if len(inUse.Imports) > 0 {
+		return inUse
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDeleteCheckImports(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>base</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Outputs>
+          <member>
+            <OutputKey>VPC</OutputKey>
+            <OutputValue>vpc-1234</OutputValue>
+            <ExportName>base-VPC</ExportName>
+          </member>
+          <member>
+            <OutputKey>Unused</OutputKey>
+            <OutputValue>unused</OutputValue>
+            <ExportName>base-Unused</ExportName>
+          </member>
+          <member>
+            <OutputKey>NotExported</OutputKey>
+            <OutputValue>value</OutputValue>
+          </member>
+        </Outputs>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`
+	})
+
+	s.Handle("ListImports", func(params url.Values) (int, string) {
+		if params.Get("ExportName") != "base-VPC" {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Export '"+params.Get("ExportName")+"' is not imported by any stack.")
+		}
+		return http.StatusOK, `<ListImportsResponse>
+  <ListImportsResult><Imports><member>pool-web</member></Imports></ListImportsResult>
+</ListImportsResponse>`
+	})
+
+	_, err := DeleteWithOptions("base", map[string]string{"CheckImports": "true"})
+	inUse, ok := err.(*ExportInUseError)
+	if !ok {
+		t.Fatalf("expected *ExportInUseError, got %#v", err)
+	}
+
+	expected := "stack base has exports in use: base-VPC is imported by pool-web"
+	if inUse.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, inUse.Error())
+	}
+
+	if n := len(s.Requests("ListImports")); n != 2 {
+		t.Errorf("expected 2 ListImports requests, got %d", n)
+	}
+
+	if n := len(s.Requests("DeleteStack")); n != 0 {
+		t.Errorf("expected no DeleteStack requests, got %d", n)
+	}
+}
+
+func TestGetExport(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("ListExports", func(params url.Values) (int, string) {
+		if params.Get("NextToken") == "page2" {
+			return http.StatusOK, `<ListExportsResponse>
+  <ListExportsResult>
+    <Exports>
+      <member><ExportingStackId>base</ExportingStackId><Name>base-Subnets</Name><Value>subnet-a,subnet-b</Value></member>
+    </Exports>
+  </ListExportsResult>
+</ListExportsResponse>`
+		}
+		return http.StatusOK, `<ListExportsResponse>
+  <ListExportsResult>
+    <Exports>
+      <member><ExportingStackId>base</ExportingStackId><Name>base-VPC</Name><Value>vpc-1234</Value></member>
+    </Exports>
+    <NextToken>page2</NextToken>
+  </ListExportsResult>
+</ListExportsResponse>`
+	})
+
+	client := NewClient(testRegion)
+
+	for name, expected := range map[string]string{"base-VPC": "vpc-1234", "base-Subnets": "subnet-a,subnet-b"} {
+		value, err := client.GetExport(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != expected {
+			t.Errorf("%s = %q, want %q", name, value, expected)
+		}
+	}
+
+	if _, err := client.GetExport("base-Missing"); err != ErrExportNotFound {
+		t.Errorf("expected ErrExportNotFound, got %v", err)
+	}
+
+	// both pages are listed once, and reused for every lookup
+	if n := len(s.Requests("ListExports")); n != 2 {
+		t.Errorf("expected 2 ListExports requests, got %d", n)
+	}
+
+	defer func(ttl time.Duration) { exportsCacheTTL = ttl }(exportsCacheTTL)
+	exportsCacheTTL = 0
+
+	if _, err := client.GetExport("base-VPC"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Requests("ListExports")); n != 4 {
+		t.Errorf("expected the exports to be listed again after the TTL, got %d requests", n)
+	}
+}
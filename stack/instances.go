@@ -0,0 +1,69 @@
+package stack
+
+import "fmt"
+
+// An EC2 instance, as returned by DescribeInstances
+type Instance struct {
+	ID               string `xml:"instanceId"`
+	State            string `xml:"instanceState>name"`
+	ImageID          string `xml:"imageId"`
+	InstanceType     string `xml:"instanceType"`
+	PrivateIP        string `xml:"privateIpAddress"`
+	SubnetID         string `xml:"subnetId"`
+	VPCID            string `xml:"vpcId"`
+	AvailabilityZone string `xml:"placement>availabilityZone"`
+}
+
+type DescribeInstancesResponse struct {
+	RequestId    string `xml:"requestId"`
+	Reservations []struct {
+		Instances []Instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// Return all instances matching the EC2 filters, e.g. "instance-state-name"
+// set to "running" to leave out stopped and terminated instances, or
+// "tag:aws:cloudformation:stack-name" to find the instances in a stack.
+func (c *Client) DescribeInstances(filters map[string]string) ([]Instance, error) {
+	svc, err := c.getService("ec2")
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	nextToken := ""
+	for pages := 1; ; pages++ {
+		if pages > MaxPages {
+			return nil, ErrMaxPages
+		}
+
+		params := map[string]string{
+			"Action":  "DescribeInstances",
+			"Version": "2014-02-01",
+		}
+
+		for i, name := range sortedKeys(filters) {
+			params[fmt.Sprintf("Filter.%d.Name", i+1)] = name
+			params[fmt.Sprintf("Filter.%d.Value.1", i+1)] = filters[name]
+		}
+
+		if nextToken != "" {
+			params["NextToken"] = nextToken
+		}
+
+		resp := DescribeInstancesResponse{}
+		if err := query(svc, params, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, res := range resp.Reservations {
+			instances = append(instances, res.Instances...)
+		}
+
+		nextToken = resp.NextToken
+		if nextToken == "" {
+			return instances, nil
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package stack
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestDescribeInstancesStateFilter(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	instances := [][2]string{
+		{"i-running", "running"},
+		{"i-terminated", "terminated"},
+	}
+
+	s.Handle("DescribeInstances", func(params url.Values) (int, string) {
+		items := ""
+		for _, inst := range instances {
+			if params.Get("Filter.1.Name") == "instance-state-name" && params.Get("Filter.1.Value.1") != inst[1] {
+				continue
+			}
+			items += fmt.Sprintf(`<item>
+  <instanceId>%s</instanceId>
+  <instanceState><code>16</code><name>%s</name></instanceState>
+  <placement><availabilityZone>galaxy-test-1a</availabilityZone></placement>
+</item>`, inst[0], inst[1])
+		}
+
+		return http.StatusOK, fmt.Sprintf(`<DescribeInstancesResponse>
+  <requestId>instances-request</requestId>
+  <reservationSet>
+    <item><instancesSet>%s</instancesSet></item>
+  </reservationSet>
+</DescribeInstancesResponse>`, items)
+	})
+
+	all, err := DescribeInstances(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[1].State != "terminated" {
+		t.Errorf("unexpected instances: %#v", all)
+	}
+
+	running, err := DescribeInstances(map[string]string{"instance-state-name": "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(running) != 1 || running[0].ID != "i-running" || running[0].State != "running" {
+		t.Errorf("expected only i-running, got %#v", running)
+	}
+
+	if running[0].AvailabilityZone != "galaxy-test-1a" {
+		t.Errorf("unexpected AvailabilityZone: %s", running[0].AvailabilityZone)
+	}
+}
@@ -0,0 +1,203 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// An Intrinsic is a CloudFormation intrinsic function, e.g. {"Ref": "Name"}
+// or {"Fn::GetAtt": ["Name", "Attr"]}, used in place of a literal value.
+type Intrinsic map[string]interface{}
+
+// Check if v is an intrinsic function object
+func isIntrinsic(v interface{}) (Intrinsic, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, false
+	}
+
+	for k := range m {
+		if k == "Ref" || strings.HasPrefix(k, "Fn::") {
+			return Intrinsic(m), true
+		}
+	}
+	return nil, false
+}
+
+// Remove all intrinsic functions from a resource's json, so that it can be
+// decoded into one of our Pool structures. Each intrinsic is replaced with
+// null, and returned keyed by its dotted path within the resource so it can
+// be restored with injectIntrinsics.
+func extractIntrinsics(b []byte) ([]byte, map[string]Intrinsic, error) {
+	var res interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]Intrinsic)
+
+	var walk func(v interface{}, path string) interface{}
+	walk = func(v interface{}, path string) interface{} {
+		if i, ok := isIntrinsic(v); ok && path != "" {
+			found[path] = i
+			return nil
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				v[k] = walk(child, joinPath(path, k))
+			}
+		case []interface{}:
+			for i, child := range v {
+				v[i] = walk(child, joinPath(path, strconv.Itoa(i)))
+			}
+		}
+		return v
+	}
+
+	res = walk(res, "")
+	if len(found) == 0 {
+		return b, nil, nil
+	}
+
+	stripped, err := json.Marshal(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stripped, found, nil
+}
+
+// Restore intrinsic functions removed by extractIntrinsics into the marshaled
+// resource. An intrinsic is only restored if its value is still unset, so
+// that any value explicitly assigned after decoding takes precedence. Setters
+// which may assign an unset-looking value, or which move elements of an
+// array, update the intrinsics with clearIntrinsic or reindexIntrinsics. Any
+// intrinsic whose parent no longer exists is dropped.
+func injectIntrinsics(b []byte, intrinsics map[string]Intrinsic) ([]byte, error) {
+	if len(intrinsics) == 0 {
+		return b, nil
+	}
+
+	var res interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil {
+		return nil, err
+	}
+
+	for path, i := range intrinsics {
+		keys := strings.Split(path, ".")
+		parent := res
+		for _, k := range keys[:len(keys)-1] {
+			parent = child(parent, k)
+		}
+
+		last := keys[len(keys)-1]
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if isZero(p[last]) {
+				p[last] = i
+			}
+		case []interface{}:
+			if idx, err := strconv.Atoi(last); err == nil && idx < len(p) && isZero(p[idx]) {
+				p[idx] = i
+			}
+		}
+	}
+
+	return json.Marshal(res)
+}
+
+// Remove the intrinsic at path, and any within it, after the value at path
+// is set explicitly. Otherwise a value which looks unset, like 0 or false,
+// would be replaced by the intrinsic again when marshaled.
+func clearIntrinsic(intrinsics map[string]Intrinsic, path string) {
+	for key := range intrinsics {
+		if key == path || strings.HasPrefix(key, path+".") {
+			delete(intrinsics, key)
+		}
+	}
+}
+
+// Renumber the intrinsics within the elements of the array at path, after
+// its elements are removed or reordered. index maps each remaining element's
+// old index to its new one, and the intrinsics of any other element are
+// dropped, so they aren't restored into whichever element takes its place.
+func reindexIntrinsics(intrinsics map[string]Intrinsic, path string, index map[int]int) {
+	prefix := path + "."
+	moved := make(map[string]Intrinsic)
+	for key, i := range intrinsics {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		delete(intrinsics, key)
+
+		elem, rest := strings.TrimPrefix(key, prefix), ""
+		if dot := strings.Index(elem, "."); dot >= 0 {
+			elem, rest = elem[:dot], elem[dot:]
+		}
+
+		old, err := strconv.Atoi(elem)
+		if err != nil {
+			continue
+		}
+		if n, ok := index[old]; ok {
+			moved[prefix+strconv.Itoa(n)+rest] = i
+		}
+	}
+
+	for key, i := range moved {
+		intrinsics[key] = i
+	}
+}
+
+// Lookup a child of a decoded json object or array by key or index
+func child(v interface{}, key string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v[key]
+	case []interface{}:
+		if idx, err := strconv.Atoi(key); err == nil && idx < len(v) {
+			return v[idx]
+		}
+	}
+	return nil
+}
+
+// Check if a decoded json value is empty, or only contains empty values.
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		// numbers and bools are often encoded as strings in our templates
+		return v == "" || v == "0" || v == "false"
+	case bool:
+		return !v
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		for _, c := range v {
+			if !isZero(c) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,94 @@
+package stack
+
+// A NAT gateway, as returned by DescribeNatGateways
+type NatGateway struct {
+	ID       string `xml:"natGatewayId"`
+	State    string `xml:"state"`
+	SubnetID string `xml:"subnetId"`
+	VPCID    string `xml:"vpcId"`
+	// why the gateway is in the failed state
+	FailureMessage string `xml:"failureMessage"`
+}
+
+type DescribeNatGatewaysResponse struct {
+	RequestId   string       `xml:"requestId"`
+	NatGateways []NatGateway `xml:"natGatewaySet>item"`
+}
+
+// Describe the NAT gateways in a VPC, or all NAT gateways if vpcID is empty.
+// Pools in private subnets can only reach the internet through an available
+// NAT gateway.
+func (c *Client) DescribeNatGateways(vpcID string) (DescribeNatGatewaysResponse, error) {
+	natResp := DescribeNatGatewaysResponse{}
+
+	svc, err := c.getService("ec2")
+	if err != nil {
+		return natResp, err
+	}
+
+	params := map[string]string{
+		"Action":  "DescribeNatGateways",
+		"Version": "2016-11-15",
+	}
+
+	if vpcID != "" {
+		params["Filter.1.Name"] = "vpc-id"
+		params["Filter.1.Value.1"] = vpcID
+	}
+
+	err = query(svc, params, &natResp)
+	return natResp, err
+}
+
+// A VPC route table, as returned by DescribeRouteTables
+type RouteTable struct {
+	ID           string                  `xml:"routeTableId"`
+	VPCID        string                  `xml:"vpcId"`
+	Associations []RouteTableAssociation `xml:"associationSet>item"`
+	Routes       []Route                 `xml:"routeSet>item"`
+}
+
+type RouteTableAssociation struct {
+	SubnetID string `xml:"subnetId"`
+	// the VPC's main route table is used by subnets without their own
+	Main bool `xml:"main"`
+}
+
+// A route's target is one of GatewayID, e.g. an internet gateway or "local",
+// or NatGatewayID.
+type Route struct {
+	DestinationCIDRBlock string `xml:"destinationCidrBlock"`
+	GatewayID            string `xml:"gatewayId"`
+	NatGatewayID         string `xml:"natGatewayId"`
+	State                string `xml:"state"`
+}
+
+type DescribeRouteTablesResponse struct {
+	RequestId   string       `xml:"requestId"`
+	RouteTables []RouteTable `xml:"routeTableSet>item"`
+}
+
+// Describe the route tables in a VPC, or all route tables if vpcID is empty.
+// A private subnet's route table should send 0.0.0.0/0 to a NAT gateway
+// rather than an internet gateway.
+func (c *Client) DescribeRouteTables(vpcID string) (DescribeRouteTablesResponse, error) {
+	rtResp := DescribeRouteTablesResponse{}
+
+	svc, err := c.getService("ec2")
+	if err != nil {
+		return rtResp, err
+	}
+
+	params := map[string]string{
+		"Action":  "DescribeRouteTables",
+		"Version": "2016-11-15",
+	}
+
+	if vpcID != "" {
+		params["Filter.1.Name"] = "vpc-id"
+		params["Filter.1.Value.1"] = vpcID
+	}
+
+	err = query(svc, params, &rtResp)
+	return rtResp, err
+}
@@ -0,0 +1,104 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDescribeNatGateways(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeNatGateways", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeNatGatewaysResponse>
+  <requestId>nat-request</requestId>
+  <natGatewaySet>
+    <item>
+      <natGatewayId>nat-0a1b2c</natGatewayId>
+      <state>available</state>
+      <subnetId>subnet-public</subnetId>
+      <vpcId>vpc-1234</vpcId>
+      <natGatewayAddressSet>
+        <item><publicIp>203.0.113.10</publicIp></item>
+      </natGatewayAddressSet>
+    </item>
+  </natGatewaySet>
+</DescribeNatGatewaysResponse>`
+	})
+
+	resp, err := DescribeNatGateways("vpc-1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.NatGateways) != 1 {
+		t.Fatalf("expected 1 NAT gateway, got %d", len(resp.NatGateways))
+	}
+
+	expected := NatGateway{ID: "nat-0a1b2c", State: "available", SubnetID: "subnet-public", VPCID: "vpc-1234"}
+	if resp.NatGateways[0] != expected {
+		t.Errorf("NAT gateway = %+v, want %+v", resp.NatGateways[0], expected)
+	}
+
+	reqs := s.Requests("DescribeNatGateways")
+	if len(reqs) != 1 || reqs[0].Get("Filter.1.Name") != "vpc-id" || reqs[0].Get("Filter.1.Value.1") != "vpc-1234" {
+		t.Errorf("unexpected DescribeNatGateways requests: %v", reqs)
+	}
+}
+
+func TestDescribeRouteTables(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeRouteTables", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeRouteTablesResponse>
+  <requestId>route-request</requestId>
+  <routeTableSet>
+    <item>
+      <routeTableId>rtb-private</routeTableId>
+      <vpcId>vpc-1234</vpcId>
+      <routeSet>
+        <item>
+          <destinationCidrBlock>10.0.0.0/16</destinationCidrBlock>
+          <gatewayId>local</gatewayId>
+          <state>active</state>
+        </item>
+        <item>
+          <destinationCidrBlock>0.0.0.0/0</destinationCidrBlock>
+          <natGatewayId>nat-0a1b2c</natGatewayId>
+          <state>active</state>
+        </item>
+      </routeSet>
+      <associationSet>
+        <item>
+          <routeTableAssociationId>rtbassoc-1</routeTableAssociationId>
+          <routeTableId>rtb-private</routeTableId>
+          <subnetId>subnet-private</subnetId>
+          <main>false</main>
+        </item>
+      </associationSet>
+    </item>
+  </routeTableSet>
+</DescribeRouteTablesResponse>`
+	})
+
+	resp, err := DescribeRouteTables("vpc-1234", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RouteTable{{
+		ID:           "rtb-private",
+		VPCID:        "vpc-1234",
+		Associations: []RouteTableAssociation{{SubnetID: "subnet-private"}},
+		Routes: []Route{
+			{DestinationCIDRBlock: "10.0.0.0/16", GatewayID: "local", State: "active"},
+			{DestinationCIDRBlock: "0.0.0.0/0", NatGatewayID: "nat-0a1b2c", State: "active"},
+		},
+	}}
+	if !reflect.DeepEqual(resp.RouteTables, expected) {
+		t.Errorf("RouteTables = %+v, want %+v", resp.RouteTables, expected)
+	}
+}
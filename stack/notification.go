@@ -0,0 +1,103 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Notification is a stack event sent by CloudFormation to a stack's
+// NotificationARNs.
+type Notification struct {
+	StackId              string
+	StackName            string
+	EventId              string
+	LogicalResourceId    string
+	PhysicalResourceId   string
+	Namespace            string
+	PrincipalId          string
+	ResourceProperties   string
+	ResourceStatus       string
+	ResourceStatusReason string
+	ResourceType         string
+	ClientRequestToken   string
+	Timestamp            time.Time
+}
+
+// Parse the body of a CloudFormation notification, which is made up of
+// Key='Value' lines. Quoted values may contain newlines and quotes, and end
+// at a quote followed by a newline or the end of the body.
+func ParseNotification(body string) (Notification, error) {
+	n := Notification{}
+
+	rest := body
+	for {
+		rest = strings.TrimLeft(rest, "\r\n")
+		if rest == "" {
+			break
+		}
+
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return n, fmt.Errorf("invalid notification line: %q", rest)
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+
+		var val string
+		if strings.HasPrefix(rest, "'") {
+			rest = rest[1:]
+			end := strings.Index(rest, "'\n")
+			if end < 0 {
+				if !strings.HasSuffix(strings.TrimRight(rest, "\r\n"), "'") {
+					return n, fmt.Errorf("unterminated value for %s", key)
+				}
+				end = len(strings.TrimRight(rest, "\r\n")) - 1
+			}
+			val = rest[:end]
+			rest = rest[end+1:]
+		} else {
+			end := strings.Index(rest, "\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			val = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+
+		switch key {
+		case "StackId":
+			n.StackId = val
+		case "StackName":
+			n.StackName = val
+		case "EventId":
+			n.EventId = val
+		case "LogicalResourceId":
+			n.LogicalResourceId = val
+		case "PhysicalResourceId":
+			n.PhysicalResourceId = val
+		case "Namespace":
+			n.Namespace = val
+		case "PrincipalId":
+			n.PrincipalId = val
+		case "ResourceProperties":
+			n.ResourceProperties = val
+		case "ResourceStatus":
+			n.ResourceStatus = val
+		case "ResourceStatusReason":
+			n.ResourceStatusReason = val
+		case "ResourceType":
+			n.ResourceType = val
+		case "ClientRequestToken":
+			n.ClientRequestToken = val
+		case "Timestamp":
+			ts, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return n, err
+			}
+			n.Timestamp = ts
+		}
+	}
+
+	return n, nil
+}
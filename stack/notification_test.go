@@ -0,0 +1,56 @@
+package stack
+
+import (
+	"testing"
+	"time"
+)
+
+var notificationBody = `StackId='arn:aws:cloudformation:us-east-1:123456789012:stack/galaxy-pool-web/1'
+Timestamp='2015-06-01T12:00:05.123Z'
+EventId='asg-CREATE_FAILED-2015-06-01T12:00:05.123Z'
+LogicalResourceId='asg'
+Namespace='123456789012'
+PhysicalResourceId='galaxy-pool-web-asg-ABC'
+PrincipalId='AIDAEXAMPLE'
+ResourceProperties='{"MinSize":"1",
+"MaxSize":"2"}
+'
+ResourceStatus='CREATE_FAILED'
+ResourceStatusReason='Received 0 SUCCESS signal(s) out of 1. Unable to satisfy 100% MinSuccessfulInstancesPercent requirement, see 'asg''
+ResourceType='AWS::AutoScaling::AutoScalingGroup'
+StackName='galaxy-pool-web'
+ClientRequestToken='null'
+`
+
+func TestParseNotification(t *testing.T) {
+	n, err := ParseNotification(notificationBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Notification{
+		StackId:              "arn:aws:cloudformation:us-east-1:123456789012:stack/galaxy-pool-web/1",
+		StackName:            "galaxy-pool-web",
+		EventId:              "asg-CREATE_FAILED-2015-06-01T12:00:05.123Z",
+		LogicalResourceId:    "asg",
+		PhysicalResourceId:   "galaxy-pool-web-asg-ABC",
+		Namespace:            "123456789012",
+		PrincipalId:          "AIDAEXAMPLE",
+		ResourceProperties:   "{\"MinSize\":\"1\",\n\"MaxSize\":\"2\"}\n",
+		ResourceStatus:       "CREATE_FAILED",
+		ResourceStatusReason: "Received 0 SUCCESS signal(s) out of 1. Unable to satisfy 100% MinSuccessfulInstancesPercent requirement, see 'asg'",
+		ResourceType:         "AWS::AutoScaling::AutoScalingGroup",
+		ClientRequestToken:   "null",
+		Timestamp:            time.Date(2015, 6, 1, 12, 0, 5, 123000000, time.UTC),
+	}
+
+	if n != expected {
+		t.Errorf("notification = %+v\nwant %+v", n, expected)
+	}
+}
+
+func TestParseNotificationUnterminated(t *testing.T) {
+	if _, err := ParseNotification("StackName='test"); err == nil {
+		t.Error("expected an error for an unterminated value")
+	}
+}
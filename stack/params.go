@@ -0,0 +1,154 @@
+package stack
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The keys of Create and Update options which aren't template parameters
+var nonParameterOptions = map[string]bool{
+	"StackPolicyDuringUpdateBody": true,
+	"StackPolicyBody":             true,
+	"DeleteFailedBeforeCreate":    true,
+	"RetryIAMErrors":              true,
+	"NoDefaultNameTag":            true,
+	"CheckDrift":                  true,
+	"AllowDrift":                  true,
+	"InheritParameters":           true,
+	"RollbackAlarms":              true,
+	"RollbackMonitoringMinutes":   true,
+	"ValidateParameters":          true,
+}
+
+// ParameterError lists the parameters which don't match a template.
+type ParameterError struct {
+	// parameters which aren't declared in the template
+	Unknown []string
+	// parameters without a default which weren't given
+	Missing []string
+}
+
+func (e *ParameterError) Error() string {
+	msgs := []string{}
+	if len(e.Unknown) > 0 {
+		msgs = append(msgs, "unknown parameters: "+strings.Join(e.Unknown, ", "))
+	}
+	if len(e.Missing) > 0 {
+		msgs = append(msgs, "missing required parameters: "+strings.Join(e.Missing, ", "))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Check that the parameters given in the Create options match those declared
+// in the template, returning a *ParameterError listing any which are unknown,
+// and any required parameters (those without a Default) which are missing.
+// Options which aren't parameters, like tags, are ignored.
+func ValidateParameters(body []byte, params map[string]string) error {
+	tmpl, err := parseTemplate(body)
+	if err != nil {
+		return fmt.Errorf("template: %s", err)
+	}
+
+	declared, _ := tmpl["Parameters"].(map[string]interface{})
+
+	paramErr := &ParameterError{}
+	for _, key := range sortedKeys(params) {
+		if nonParameterOptions[key] {
+			continue
+		}
+		if _, ok := tagOption(key); ok {
+			continue
+		}
+
+		if _, ok := declared[key]; !ok {
+			paramErr.Unknown = append(paramErr.Unknown, key)
+		}
+	}
+
+	for name, decl := range declared {
+		if _, ok := params[name]; ok {
+			continue
+		}
+
+		def, _ := decl.(map[string]interface{})
+		if _, ok := def["Default"]; !ok {
+			paramErr.Missing = append(paramErr.Missing, name)
+		}
+	}
+	sort.Strings(paramErr.Missing)
+
+	if len(paramErr.Unknown) > 0 || len(paramErr.Missing) > 0 {
+		return paramErr
+	}
+	return nil
+}
+
+var (
+	subnetIDRe      = regexp.MustCompile(`^subnet-[0-9a-f]+$`)
+	securityGroupRe = regexp.MustCompile(`^sg-[0-9a-f]+$`)
+	serverCertARNRe = regexp.MustCompile(`^arn:aws[-a-z]*:iam::[0-9]+:server-certificate/`)
+)
+
+// Check that every subnet, security group, instance profile and server
+// certificate referenced by literal value in a template exists in the base
+// stack's SharedResources, returning an error for each one that doesn't.
+// References through Ref, Fn::ImportValue and the like can't be checked.
+func ValidateAgainstShared(body []byte, shared SharedResources) []error {
+	tmpl, err := parseTemplate(body)
+	if err != nil {
+		return []error{fmt.Errorf("template: %s", err)}
+	}
+
+	errs := []error{}
+	for _, section := range sortedKeys(mapKeys(tmpl)) {
+		entries, _ := tmpl[section].(map[string]interface{})
+		for _, name := range sortedKeys(mapKeys(entries)) {
+			seen := make(map[string]bool)
+			walkSharedRefs("", entries[name], func(kind, id string, found bool) {
+				if found || seen[id] {
+					return
+				}
+				seen[id] = true
+				errs = append(errs, fmt.Errorf("%s.%s: %s %s not found in the base stack", section, name, kind, id))
+			}, shared)
+		}
+	}
+	return errs
+}
+
+// Call report with each shared resource referenced in v, and whether it was
+// found. key is the name of the property holding v.
+func walkSharedRefs(key string, v interface{}, report func(kind, id string, found bool), shared SharedResources) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(mapKeys(v)) {
+			walkSharedRefs(k, v[k], report, shared)
+		}
+	case []interface{}:
+		for _, item := range v {
+			walkSharedRefs(key, item, report, shared)
+		}
+	case string:
+		switch {
+		case subnetIDRe.MatchString(v):
+			report("subnet", v, shared.HasSubnet(v))
+		case securityGroupRe.MatchString(v):
+			report("security group", v, shared.HasSecurityGroup(v))
+		case serverCertARNRe.MatchString(v):
+			report("server certificate", v, hasValue(shared.ServerCerts, v))
+		case key == "IamInstanceProfile":
+			report("instance profile", v, shared.HasRole(v))
+		}
+	}
+}
+
+// Return a map with the same keys as m, for use with sortedKeys
+func mapKeys(m map[string]interface{}) map[string]string {
+	keys := make(map[string]string, len(m))
+	for k := range m {
+		keys[k] = ""
+	}
+	return keys
+}
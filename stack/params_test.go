@@ -0,0 +1,145 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+var paramsTemplate = []byte(`{
+  "Parameters": {
+    "KeyName": {"Type": "AWS::EC2::KeyPair::KeyName"},
+    "PoolImageId": {"Type": "String"},
+    "PoolInstanceType": {"Type": "String", "Default": "t2.small"}
+  }
+}`)
+
+func TestValidateParameters(t *testing.T) {
+	params := map[string]string{
+		"KeyName":     "galaxy-key",
+		"PoolImageId": "ami-1234",
+		"tag.env":     "dev",
+	}
+
+	if err := ValidateParameters(paramsTemplate, params); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateParametersUnknown(t *testing.T) {
+	params := map[string]string{
+		"KeyNmae":                  "galaxy-key",
+		"KeyName":                  "galaxy-key",
+		"PoolImageId":              "ami-1234",
+		"DeleteFailedBeforeCreate": "true",
+	}
+
+	err := ValidateParameters(paramsTemplate, params)
+	paramErr, ok := err.(*ParameterError)
+	if !ok {
+		t.Fatalf("expected *ParameterError, got %#v", err)
+	}
+
+	if !reflect.DeepEqual(paramErr.Unknown, []string{"KeyNmae"}) || len(paramErr.Missing) != 0 {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestValidateParametersMissing(t *testing.T) {
+	err := ValidateParameters(paramsTemplate, map[string]string{"KeyNmae": "galaxy-key"})
+	paramErr, ok := err.(*ParameterError)
+	if !ok {
+		t.Fatalf("expected *ParameterError, got %#v", err)
+	}
+
+	if !reflect.DeepEqual(paramErr.Missing, []string{"KeyName", "PoolImageId"}) {
+		t.Errorf("unexpected missing parameters: %v", paramErr.Missing)
+	}
+
+	expected := "unknown parameters: KeyNmae; missing required parameters: KeyName, PoolImageId"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err)
+	}
+}
+
+func TestCreateValidateParameters(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("test")
+	})
+
+	// a typo is caught before the stack is created
+	options := map[string]string{
+		"ValidateParameters": "true",
+		"KeyNmae":            "galaxy-key",
+		"PoolImageId":        "ami-1234",
+	}
+	_, err := Create("test", paramsTemplate, options)
+	paramErr, ok := err.(*ParameterError)
+	if !ok {
+		t.Fatalf("expected *ParameterError, got %#v", err)
+	}
+	if !reflect.DeepEqual(paramErr.Unknown, []string{"KeyNmae"}) || !reflect.DeepEqual(paramErr.Missing, []string{"KeyName"}) {
+		t.Errorf("unexpected ParameterError: %+v", paramErr)
+	}
+
+	if n := len(s.Requests("CreateStack")); n != 0 {
+		t.Fatalf("expected no CreateStack requests, got %d", n)
+	}
+
+	delete(options, "KeyNmae")
+	options["KeyName"] = "galaxy-key"
+	if _, err := Create("test", paramsTemplate, options); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests("CreateStack")[0]
+	if req.Get("Parameters.member.3.ParameterKey") != "" {
+		t.Errorf("expected ValidateParameters not to be sent as a parameter, got %v", req)
+	}
+}
+
+func TestValidateAgainstShared(t *testing.T) {
+	tmpl := []byte(`{
+  "AWSTemplateFormatVersion": "2010-09-09",
+  "Resources": {
+    "webLC": {
+      "Type": "AWS::AutoScaling::LaunchConfiguration",
+      "Properties": {
+        "IamInstanceProfile": "galaxy-InstanceProfile-1",
+        "SecurityGroups": ["sg-0a1b", "sg-0dead", {"Ref": "PoolSG"}]
+      }
+    },
+    "webASG": {
+      "Type": "AWS::AutoScaling::AutoScalingGroup",
+      "Properties": {
+        "VPCZoneIdentifier": ["subnet-1234"]
+      }
+    }
+  }
+}`)
+
+	shared := SharedResources{
+		SecurityGroups: map[string]string{"sshSG": "sg-0a1b"},
+		Roles:          map[string]string{"galaxyInstanceProfile": "galaxy-InstanceProfile-1"},
+		Subnets:        []Subnet{{ID: "subnet-1234"}},
+	}
+
+	errs := ValidateAgainstShared(tmpl, shared)
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+
+	expected := "Resources.webLC: security group sg-0dead not found in the base stack"
+	if errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, errs[0])
+	}
+
+	delete(shared.Roles, "galaxyInstanceProfile")
+	if errs := ValidateAgainstShared(tmpl, shared); len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+}
@@ -0,0 +1,73 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The actions allowed in a stack policy statement
+var policyActions = map[string]bool{
+	"Update:Modify":  true,
+	"Update:Replace": true,
+	"Update:Delete":  true,
+	"Update:*":       true,
+}
+
+type policyStatement struct {
+	Effect    string
+	Action    string
+	Principal string
+	Resource  string
+}
+
+// A StackPolicy builds the JSON policy document for SetPolicy, or the
+// StackPolicyDuringUpdateBody option.
+type StackPolicy struct {
+	Statement []policyStatement
+}
+
+func NewStackPolicy() *StackPolicy {
+	return &StackPolicy{}
+}
+
+// Allow an update action, e.g. "Update:*", on a resource. The resource is
+// either "*", or "LogicalResourceId/" followed by a resource's logical ID.
+func (p *StackPolicy) Allow(action, resource string) *StackPolicy {
+	return p.add("Allow", action, resource)
+}
+
+// Deny an update action on a resource, e.g. "Update:Delete" on
+// "LogicalResourceId/MyDB".
+func (p *StackPolicy) Deny(action, resource string) *StackPolicy {
+	return p.add("Deny", action, resource)
+}
+
+func (p *StackPolicy) add(effect, action, resource string) *StackPolicy {
+	p.Statement = append(p.Statement, policyStatement{
+		Effect:    effect,
+		Action:    action,
+		Principal: "*",
+		Resource:  resource,
+	})
+	return p
+}
+
+// Validate the policy statements, and marshal the policy document.
+func (p *StackPolicy) Build() ([]byte, error) {
+	if len(p.Statement) == 0 {
+		return nil, fmt.Errorf("stack policy has no statements")
+	}
+
+	for _, s := range p.Statement {
+		if !policyActions[s.Action] {
+			return nil, fmt.Errorf("invalid stack policy action: %s", s.Action)
+		}
+
+		if s.Resource != "*" && !strings.HasPrefix(s.Resource, "LogicalResourceId/") {
+			return nil, fmt.Errorf("invalid stack policy resource: %s", s.Resource)
+		}
+	}
+
+	return json.Marshal(p)
+}
@@ -0,0 +1,35 @@
+package stack
+
+import "testing"
+
+func TestStackPolicy(t *testing.T) {
+	policy, err := NewStackPolicy().
+		Deny("Update:Delete", "LogicalResourceId/MyDB").
+		Allow("Update:*", "*").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Statement":[` +
+		`{"Effect":"Deny","Action":"Update:Delete","Principal":"*","Resource":"LogicalResourceId/MyDB"},` +
+		`{"Effect":"Allow","Action":"Update:*","Principal":"*","Resource":"*"}]}`
+
+	if string(policy) != expected {
+		t.Errorf("expected policy:\n%s\ngot:\n%s", expected, policy)
+	}
+}
+
+func TestStackPolicyInvalid(t *testing.T) {
+	if _, err := NewStackPolicy().Build(); err == nil {
+		t.Error("expected an error for an empty policy")
+	}
+
+	if _, err := NewStackPolicy().Deny("Delete", "*").Build(); err == nil {
+		t.Error("expected an error for an invalid action")
+	}
+
+	if _, err := NewStackPolicy().Deny("Update:Delete", "MyDB").Build(); err == nil {
+		t.Error("expected an error for an invalid resource")
+	}
+}
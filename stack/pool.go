@@ -3,6 +3,7 @@ package stack
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -87,6 +88,116 @@ func (p *Pool) LC() *lc {
 	return nil
 }
 
+// The number of available IP addresses a shared subnet needs for
+// SetSharedResources to place a pool's instances in it
+var PoolSubnetMinFreeIPs = 8
+
+// Fill in any unset values in the pool's resources from a base stack's
+// SharedResources:
+//   - the LC's ImageId, InstanceType and KeyName from the PoolImageId,
+//     PoolInstanceType and KeyName parameters
+//   - the LC's IamInstanceProfile from the galaxyInstanceProfile role
+//   - the LC's SecurityGroups from sshSG and defaultSG
+//   - the ASG's subnets and availability zones from the shared subnets with
+//     at least PoolSubnetMinFreeIPs available addresses, or from all shared
+//     subnets if none have that many
+//   - the ELB's subnets from the ASG, and SecurityGroups from webSG and
+//     defaultSG
+//   - any ELB listener SSLCertificateId which names a server certificate is
+//     replaced with the certificate's ARN
+func (p *Pool) SetSharedResources(shared SharedResources) {
+	if lc := p.LC(); lc != nil {
+		props := &lc.Properties
+		if props.ImageId == "" {
+			props.ImageId = shared.Parameters["PoolImageId"]
+		}
+		if props.InstanceType == "" {
+			props.InstanceType = shared.Parameters["PoolInstanceType"]
+		}
+		if props.KeyName == "" {
+			props.KeyName = shared.Parameters["KeyName"]
+		}
+		if props.IamInstanceProfile == "" {
+			props.IamInstanceProfile = shared.Roles["galaxyInstanceProfile"]
+		}
+		if len(props.SecurityGroups) == 0 {
+			props.SecurityGroups = nonEmpty(shared.SecurityGroups["sshSG"], shared.SecurityGroups["defaultSG"])
+		}
+	}
+
+	asg := p.ASG()
+	if asg != nil && len(asg.Properties.VPCZoneIdentifier) == 0 {
+		subnets := subnetsWithFreeIPs(shared.Subnets, PoolSubnetMinFreeIPs)
+		if len(subnets) == 0 {
+			subnets = shared.Subnets
+		}
+
+		for _, sn := range subnets {
+			asg.Properties.VPCZoneIdentifier = append(asg.Properties.VPCZoneIdentifier, sn.ID)
+			asg.Properties.AvailabilityZones = append(asg.Properties.AvailabilityZones, sn.AvailabilityZone)
+		}
+	}
+
+	if elb := p.ELB(); elb != nil {
+		props := &elb.Properties
+		if len(props.Subnets) == 0 && asg != nil {
+			props.Subnets = asg.Properties.VPCZoneIdentifier
+		}
+		if len(props.SecurityGroups) == 0 {
+			props.SecurityGroups = nonEmpty(shared.SecurityGroups["webSG"], shared.SecurityGroups["defaultSG"])
+		}
+		for i, l := range props.Listeners {
+			if arn, ok := shared.ServerCerts[l.SSLCertificateId]; ok {
+				props.Listeners[i].SSLCertificateId = arn
+			}
+		}
+	}
+}
+
+// Check that every subnet, security group and instance profile referenced by
+// the pool's resources exists in the base stack's SharedResources. The
+// returned error lists all missing IDs.
+func (p *Pool) ValidateSharedResources(shared SharedResources) error {
+	missing := []string{}
+	check := func(ids []string, has func(string) bool) {
+		for _, id := range ids {
+			if id != "" && !has(id) {
+				missing = append(missing, id)
+			}
+		}
+	}
+
+	if asg := p.ASG(); asg != nil {
+		check(asg.Properties.VPCZoneIdentifier, shared.HasSubnet)
+	}
+
+	if elb := p.ELB(); elb != nil {
+		check(elb.Properties.Subnets, shared.HasSubnet)
+		check(elb.Properties.SecurityGroups, shared.HasSecurityGroup)
+	}
+
+	if lc := p.LC(); lc != nil {
+		check(lc.Properties.SecurityGroups, shared.HasSecurityGroup)
+		check([]string{lc.Properties.IamInstanceProfile}, shared.HasRole)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("resources not found in the base stack: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// return the non-empty strings from vals
+func nonEmpty(vals ...string) []string {
+	res := []string{}
+	for _, v := range vals {
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 func (p *Pool) UnmarshalJSON(b []byte) error {
 	base := make(map[string]json.RawMessage)
 
@@ -129,23 +240,24 @@ func (p *Pool) UnmarshalJSON(b []byte) error {
 			return err
 
 		}
+
 		switch t {
 		case asgType:
 			res := &asg{}
 			p.Resources[name] = res
-			if err := json.Unmarshal(rawRes, res); err != nil {
+			if err := unmarshalResource(rawRes, res, &res.Intrinsics); err != nil {
 				return err
 			}
 		case elbType:
 			res := &elb{}
 			p.Resources[name] = res
-			if err := json.Unmarshal(rawRes, res); err != nil {
+			if err := unmarshalResource(rawRes, res, &res.Intrinsics); err != nil {
 				return err
 			}
 		case lcType:
 			res := &lc{}
 			p.Resources[name] = res
-			if err := json.Unmarshal(rawRes, res); err != nil {
+			if err := unmarshalResource(rawRes, res, &res.Intrinsics); err != nil {
 				return err
 			}
 		}
@@ -154,11 +266,69 @@ func (p *Pool) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Unmarshal a resource into one of our structs. If the resource contains
+// intrinsic functions where we expect literal values, they are removed before
+// decoding and stored in intrinsics, to be restored when the resource is
+// marshaled.
+func unmarshalResource(b []byte, res interface{}, intrinsics *map[string]Intrinsic) error {
+	err := json.Unmarshal(b, res)
+	if err == nil {
+		return nil
+	}
+
+	stripped, found, e := extractIntrinsics(b)
+	if e != nil {
+		return e
+	}
+
+	if len(found) == 0 {
+		return err
+	}
+
+	// start over with a clean value, in case the first attempt was partially
+	// decoded.
+	v := reflect.ValueOf(res).Elem()
+	v.Set(reflect.Zero(v.Type()))
+
+	*intrinsics = found
+	return json.Unmarshal(stripped, res)
+}
+
 type asg struct {
 	Name         string `json:"-"`
 	Type         string
 	Properties   asgProp
 	UpdatePolicy *asgUpdatePolicy `json:",omitempty"`
+
+	// Intrinsic functions found when decoding an existing template, keyed by
+	// their path within the resource, e.g. "Properties.MinSize".
+	Intrinsics map[string]Intrinsic `json:"-"`
+}
+
+func (a *asg) MarshalJSON() ([]byte, error) {
+	type plain asg
+	b, err := json.Marshal((*plain)(a))
+	if err != nil {
+		return nil, err
+	}
+	return injectIntrinsics(b, a.Intrinsics)
+}
+
+// Set the ASG's sizes, replacing any intrinsic functions they were defined
+// with, even when set to 0.
+func (a *asg) SetDesiredCapacity(n int) {
+	a.Properties.DesiredCapacity = n
+	clearIntrinsic(a.Intrinsics, "Properties.DesiredCapacity")
+}
+
+func (a *asg) SetMinSize(n int) {
+	a.Properties.MinSize = n
+	clearIntrinsic(a.Intrinsics, "Properties.MinSize")
+}
+
+func (a *asg) SetMaxSize(n int) {
+	a.Properties.MaxSize = n
+	clearIntrinsic(a.Intrinsics, "Properties.MaxSize")
 }
 
 func (a *asg) AddLoadBalancer(name string) {
@@ -219,20 +389,38 @@ type elb struct {
 	Name       string `json:"-"`
 	Type       string
 	Properties elbProp
+
+	// Intrinsic functions found when decoding an existing template
+	Intrinsics map[string]Intrinsic `json:"-"`
+}
+
+func (e *elb) MarshalJSON() ([]byte, error) {
+	type plain elb
+	b, err := json.Marshal((*plain)(e))
+	if err != nil {
+		return nil, err
+	}
+	return injectIntrinsics(b, e.Intrinsics)
 }
 
 // Add a listener, replacing an existing listener with the same port
 func (e *elb) AddListener(port int, proto string, instancePort int, instanceProto string, sslCert string, policyNames []string) {
 	// take our current listeners
 	current := []listener{}
+	// the new index of each listener kept
+	index := make(map[int]int)
 
-	for _, l := range e.Properties.Listeners {
+	for i, l := range e.Properties.Listeners {
 		// skip this one if the port matches what we're setting
 		if l.LoadBalancerPort != port {
+			index[i] = len(current)
 			current = append(current, l)
 		}
 	}
 
+	// keep the intrinsics, like a Ref to a cert, with their listeners
+	reindexIntrinsics(e.Intrinsics, "Properties.Listeners", index)
+
 	proto = strings.ToUpper(proto)
 	instanceProto = strings.ToUpper(instanceProto)
 
@@ -278,6 +466,18 @@ type lc struct {
 	Name       string `json:"-"`
 	Type       string
 	Properties lcProp
+
+	// Intrinsic functions found when decoding an existing template
+	Intrinsics map[string]Intrinsic `json:"-"`
+}
+
+func (c *lc) MarshalJSON() ([]byte, error) {
+	type plain lc
+	b, err := json.Marshal((*plain)(c))
+	if err != nil {
+		return nil, err
+	}
+	return injectIntrinsics(b, c.Intrinsics)
 }
 
 func (c *lc) SetVolumeSize(size int) {
@@ -1,7 +1,479 @@
 package stack
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestPoolTemplate(t *testing.T) {
 	t.Log("NO TESTS")
 }
+
+var intrinsicPoolTmpl = []byte(`{
+    "AWSTemplateFormatVersion": "2010-09-09",
+    "Description": "Pool with intrinsics",
+    "Resources": {
+        "asg": {
+            "Properties": {
+                "AvailabilityZones": {"Fn::GetAZs": ""},
+                "LaunchConfigurationName": {"Ref": "lc"},
+                "MinSize": {"Ref": "MinSize"},
+                "MaxSize": "2",
+                "Tags": [],
+                "VPCZoneIdentifier": ["subnet-1"]
+            },
+            "Type": "AWS::AutoScaling::AutoScalingGroup"
+        },
+        "lc": {
+            "Properties": {
+                "InstanceType": "t2.medium",
+                "KeyName": {"Ref": "KeyName"},
+                "SecurityGroups": [{"Ref": "WebSG"}, "sg-1234"]
+            },
+            "Type": "AWS::AutoScaling::LaunchConfiguration"
+        }
+    }
+}`)
+
+func TestPoolIntrinsics(t *testing.T) {
+	pool := &Pool{}
+	if err := json.Unmarshal(intrinsicPoolTmpl, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	asg := pool.ASG()
+	if asg == nil {
+		t.Fatal("missing ASG")
+	}
+
+	if asg.Properties.MaxSize != 2 {
+		t.Errorf("MaxSize = %d, want 2", asg.Properties.MaxSize)
+	}
+
+	if ref := asg.Intrinsics["Properties.MinSize"]["Ref"]; ref != "MinSize" {
+		t.Errorf("MinSize intrinsic = %v, want Ref MinSize", asg.Intrinsics["Properties.MinSize"])
+	}
+
+	lc := pool.LC()
+	if lc == nil {
+		t.Fatal("missing LC")
+	}
+
+	if len(lc.Properties.SecurityGroups) != 2 || lc.Properties.SecurityGroups[1] != "sg-1234" {
+		t.Errorf("unexpected SecurityGroups: %v", lc.Properties.SecurityGroups)
+	}
+
+	// change a value that was an intrinsic, and make sure the rest are
+	// restored when marshaled.
+	lc.Properties.KeyName = "mykey"
+
+	b, err := json.Marshal(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &struct {
+		Resources map[string]struct {
+			Properties map[string]interface{}
+		}
+	}{}
+	if err := json.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+
+	asgProps := out.Resources["asg"].Properties
+	if !reflect.DeepEqual(asgProps["MinSize"], map[string]interface{}{"Ref": "MinSize"}) {
+		t.Errorf("MinSize = %v, want Ref", asgProps["MinSize"])
+	}
+	if !reflect.DeepEqual(asgProps["AvailabilityZones"], map[string]interface{}{"Fn::GetAZs": ""}) {
+		t.Errorf("AvailabilityZones = %v, want Fn::GetAZs", asgProps["AvailabilityZones"])
+	}
+	if !reflect.DeepEqual(asgProps["LaunchConfigurationName"], map[string]interface{}{"Ref": "lc"}) {
+		t.Errorf("LaunchConfigurationName = %v, want Ref", asgProps["LaunchConfigurationName"])
+	}
+
+	lcProps := out.Resources["lc"].Properties
+	if lcProps["KeyName"] != "mykey" {
+		t.Errorf("KeyName = %v, want mykey", lcProps["KeyName"])
+	}
+
+	sgs := []interface{}{map[string]interface{}{"Ref": "WebSG"}, "sg-1234"}
+	if !reflect.DeepEqual(lcProps["SecurityGroups"], sgs) {
+		t.Errorf("SecurityGroups = %v, want %v", lcProps["SecurityGroups"], sgs)
+	}
+}
+
+func TestPoolIntrinsicsSetZero(t *testing.T) {
+	pool := &Pool{}
+	if err := json.Unmarshal(intrinsicPoolTmpl, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 is set explicitly, and not replaced by the Ref
+	asg := pool.ASG()
+	asg.SetMinSize(0)
+
+	b, err := json.Marshal(asg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	props := struct {
+		Properties map[string]interface{}
+	}{}
+	if err := json.Unmarshal(b, &props); err != nil {
+		t.Fatal(err)
+	}
+
+	if props.Properties["MinSize"] != "0" {
+		t.Errorf("MinSize = %v, want 0", props.Properties["MinSize"])
+	}
+	if !reflect.DeepEqual(props.Properties["LaunchConfigurationName"], map[string]interface{}{"Ref": "lc"}) {
+		t.Errorf("LaunchConfigurationName = %v, want Ref", props.Properties["LaunchConfigurationName"])
+	}
+}
+
+func TestPoolIntrinsicsListeners(t *testing.T) {
+	tmpl := []byte(`{
+    "AWSTemplateFormatVersion": "2010-09-09",
+    "Description": "Pool with a cert Ref",
+    "Resources": {
+        "elb": {
+            "Properties": {
+                "Listeners": [
+                    {"InstancePort": "8080", "LoadBalancerPort": "8080", "Protocol": "HTTP", "InstanceProtocol": "HTTP"},
+                    {"InstancePort": "80", "LoadBalancerPort": "443", "Protocol": "HTTPS", "InstanceProtocol": "HTTP",
+                     "SSLCertificateId": {"Ref": "Cert"}},
+                    {"InstancePort": "80", "LoadBalancerPort": "80", "Protocol": "HTTP", "InstanceProtocol": "HTTP"}
+                ]
+            },
+            "Type": "AWS::ElasticLoadBalancing::LoadBalancer"
+        }
+    }
+}`)
+
+	pool := &Pool{}
+	if err := json.Unmarshal(tmpl, pool); err != nil {
+		t.Fatal(err)
+	}
+	elb := pool.ELB()
+
+	// Return the cert of each listener, by port
+	certs := func() map[string]interface{} {
+		b, err := json.Marshal(elb)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := struct {
+			Properties struct {
+				Listeners []map[string]interface{}
+			}
+		}{}
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		certs := make(map[string]interface{})
+		for _, l := range out.Properties.Listeners {
+			certs[l["LoadBalancerPort"].(string)] = l["SSLCertificateId"]
+		}
+		return certs
+	}
+
+	// the HTTPS listener moves to the front, and keeps its cert
+	elb.AddListener(8080, "HTTP", 8080, "HTTP", "", nil)
+	expected := map[string]interface{}{
+		"443":  map[string]interface{}{"Ref": "Cert"},
+		"80":   nil,
+		"8080": nil,
+	}
+	if c := certs(); !reflect.DeepEqual(c, expected) {
+		t.Errorf("certs = %v, want %v", c, expected)
+	}
+
+	// replacing the HTTPS listener drops its cert, rather than moving it to
+	// the listener now in its place
+	elb.AddListener(443, "HTTPS", 80, "HTTP", "arn:cert", nil)
+	expected = map[string]interface{}{
+		"443":  "arn:cert",
+		"80":   nil,
+		"8080": nil,
+	}
+	if c := certs(); !reflect.DeepEqual(c, expected) {
+		t.Errorf("certs = %v, want %v", c, expected)
+	}
+}
+
+func TestUpdatePool(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("GetTemplate", func(url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<GetTemplateResponse>
+  <GetTemplateResult><TemplateBody>%s</TemplateBody></GetTemplateResult>
+</GetTemplateResponse>`, intrinsicPoolTmpl)
+	})
+	s.Handle("UpdateStack", func(url.Values) (int, string) {
+		return http.StatusOK, `<UpdateStackResponse>
+  <UpdateStackResult><StackId>arn:aws:cloudformation:test:stack/test/1</StackId></UpdateStackResult>
+</UpdateStackResponse>`
+	})
+
+	pool, err := GetPool("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.ASG().Properties.MaxSize = 5
+
+	if _, err := UpdatePool("test", pool, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("UpdateStack")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 UpdateStack request, got %d", len(reqs))
+	}
+
+	updated := &Pool{}
+	if err := json.Unmarshal([]byte(reqs[0].Get("TemplateBody")), updated); err != nil {
+		t.Fatal(err)
+	}
+
+	asg := updated.ASG()
+	if asg.Properties.MaxSize != 5 {
+		t.Errorf("MaxSize = %d, want 5", asg.Properties.MaxSize)
+	}
+	if ref := asg.Intrinsics["Properties.MinSize"]["Ref"]; ref != "MinSize" {
+		t.Errorf("MinSize intrinsic = %v, want Ref MinSize", asg.Intrinsics["Properties.MinSize"])
+	}
+}
+
+// Return a ListStackResources response with the logical ID, physical ID and
+// type of each resource.
+func stackResourcesXML(resources ...[3]string) string {
+	members := ""
+	for _, r := range resources {
+		members += fmt.Sprintf(`<member>
+  <LogicalResourceId>%s</LogicalResourceId>
+  <PhysicalResourceId>%s</PhysicalResourceId>
+  <ResourceStatus>CREATE_COMPLETE</ResourceStatus>
+  <ResourceType>%s</ResourceType>
+</member>`, r[0], r[1], r[2])
+	}
+	return fmt.Sprintf(`<ListStackResourcesResponse>
+  <ListStackResourcesResult>
+    <StackResourceSummaries>%s</StackResourceSummaries>
+  </ListStackResourcesResult>
+</ListStackResourcesResponse>`, members)
+}
+
+// Handle the requests made by GetSharedResources for a base stack with a VPC,
+// two subnets, the galaxy security groups and instance profile, and one
+// server certificate.
+func handleSharedResources(s *testServer, name string) {
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, fmt.Sprintf(`<DescribeStacksResponse>
+  <DescribeStacksResult>
+    <Stacks>
+      <member>
+        <StackName>%s</StackName>
+        <StackStatus>CREATE_COMPLETE</StackStatus>
+        <Parameters>
+          <member><ParameterKey>KeyName</ParameterKey><ParameterValue>galaxy-key</ParameterValue></member>
+          <member><ParameterKey>PoolImageId</ParameterKey><ParameterValue>ami-1234</ParameterValue></member>
+          <member><ParameterKey>PoolInstanceType</ParameterKey><ParameterValue>t2.small</ParameterValue></member>
+        </Parameters>
+      </member>
+    </Stacks>
+  </DescribeStacksResult>
+</DescribeStacksResponse>`, name)
+	})
+
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		return http.StatusOK, stackResourcesXML(
+			[3]string{"vpc", "vpc-1234", "AWS::EC2::VPC"},
+			[3]string{"sshSG", "sg-ssh", "AWS::EC2::SecurityGroup"},
+			[3]string{"defaultSG", "sg-default", "AWS::EC2::SecurityGroup"},
+			[3]string{"webSG", "sg-web", "AWS::EC2::SecurityGroup"},
+			[3]string{"galaxyInstanceProfile", "galaxy-profile", "AWS::IAM::InstanceProfile"},
+		)
+	})
+
+	s.Handle("DescribeSubnets", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeSubnetsResponse>
+  <subnetSet>
+    <item><subnetId>subnet-a</subnetId><vpcId>vpc-1234</vpcId><availabilityZone>galaxy-test-1a</availabilityZone></item>
+    <item><subnetId>subnet-b</subnetId><vpcId>vpc-1234</vpcId><availabilityZone>galaxy-test-1b</availabilityZone></item>
+  </subnetSet>
+</DescribeSubnetsResponse>`
+	})
+
+	s.Handle("ListServerCertificates", func(url.Values) (int, string) {
+		return http.StatusOK, `<ListServerCertificatesResponse>
+  <ListServerCertificatesResult>
+    <ServerCertificateMetadataList>
+      <member>
+        <ServerCertificateName>galaxy-cert</ServerCertificateName>
+        <Arn>arn:aws:iam::123456789012:server-certificate/galaxy-cert</Arn>
+      </member>
+    </ServerCertificateMetadataList>
+  </ListServerCertificatesResult>
+</ListServerCertificatesResponse>`
+	})
+}
+
+func TestCreatePool(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("pool")
+	})
+
+	pool := NewPool()
+	pool.Resources["lc"] = pool.LCTemplate
+	pool.Resources["asg"] = pool.ASGTemplate
+	pool.Resources["elb"] = pool.ELBTemplate
+	pool.ASGTemplate.SetLaunchConfiguration("lc")
+	pool.ELBTemplate.AddListener(443, "HTTPS", 80, "HTTP", "galaxy-cert", nil)
+
+	// explicitly set values are kept
+	pool.LCTemplate.Properties.InstanceType = "m3.large"
+
+	if _, err := CreatePool("base", "pool", pool, map[string]string{"tag.galaxy": "pool"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("CreateStack")
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 CreateStack request, got %d", len(reqs))
+	}
+	if reqs[0].Get("StackName") != "pool" {
+		t.Errorf("StackName = %q, want pool", reqs[0].Get("StackName"))
+	}
+
+	created := &Pool{}
+	if err := json.Unmarshal([]byte(reqs[0].Get("TemplateBody")), created); err != nil {
+		t.Fatal(err)
+	}
+
+	lc := created.LC().Properties
+	if lc.ImageId != "ami-1234" || lc.KeyName != "galaxy-key" || lc.IamInstanceProfile != "galaxy-profile" {
+		t.Errorf("shared parameters not set on the LC: %+v", lc)
+	}
+	if lc.InstanceType != "m3.large" {
+		t.Errorf("InstanceType = %q, want m3.large", lc.InstanceType)
+	}
+	if !reflect.DeepEqual(lc.SecurityGroups, []string{"sg-ssh", "sg-default"}) {
+		t.Errorf("LC SecurityGroups = %v", lc.SecurityGroups)
+	}
+
+	asg := created.ASG().Properties
+	if !reflect.DeepEqual(asg.VPCZoneIdentifier, []string{"subnet-a", "subnet-b"}) {
+		t.Errorf("VPCZoneIdentifier = %v", asg.VPCZoneIdentifier)
+	}
+	if !reflect.DeepEqual(asg.AvailabilityZones, []string{"galaxy-test-1a", "galaxy-test-1b"}) {
+		t.Errorf("AvailabilityZones = %v", asg.AvailabilityZones)
+	}
+
+	elb := created.ELB().Properties
+	if !reflect.DeepEqual(elb.Subnets, []string{"subnet-a", "subnet-b"}) {
+		t.Errorf("ELB Subnets = %v", elb.Subnets)
+	}
+	if !reflect.DeepEqual(elb.SecurityGroups, []string{"sg-web", "sg-default"}) {
+		t.Errorf("ELB SecurityGroups = %v", elb.SecurityGroups)
+	}
+
+	certARN := ""
+	for _, l := range elb.Listeners {
+		if l.LoadBalancerPort == 443 {
+			certARN = l.SSLCertificateId
+		}
+	}
+	if certARN != "arn:aws:iam::123456789012:server-certificate/galaxy-cert" {
+		t.Errorf("SSLCertificateId = %q, want the cert ARN", certARN)
+	}
+}
+
+func TestCreatePoolMissingSubnet(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleSharedResources(s, "base")
+	s.Handle("CreateStack", func(url.Values) (int, string) {
+		return http.StatusOK, createStackXML("pool")
+	})
+
+	pool := NewPool()
+	pool.Resources["lc"] = pool.LCTemplate
+	pool.Resources["asg"] = pool.ASGTemplate
+	pool.ASGTemplate.Properties.VPCZoneIdentifier = []string{"subnet-a", "subnet-typo"}
+	pool.LCTemplate.Properties.SecurityGroups = []string{"sg-default", "sg-gone"}
+
+	_, err := CreatePool("base", "pool", pool, nil)
+	if err == nil {
+		t.Fatal("expected an error for the missing resources")
+	}
+	if !strings.Contains(err.Error(), "subnet-typo, sg-gone") {
+		t.Errorf("error doesn't list the missing resources: %s", err)
+	}
+
+	if n := len(s.Requests("CreateStack")); n != 0 {
+		t.Errorf("expected no CreateStack requests, got %d", n)
+	}
+}
+
+func TestSharedResourcesHasSubnet(t *testing.T) {
+	shared := SharedResources{
+		Subnets: []Subnet{{ID: "subnet-a"}, {ID: "subnet-b"}},
+	}
+
+	if !shared.HasSubnet("subnet-b") {
+		t.Error("expected subnet-b to be found")
+	}
+	if shared.HasSubnet("subnet-c") {
+		t.Error("expected subnet-c to be missing")
+	}
+}
+
+func TestSubnetsWithFreeIPs(t *testing.T) {
+	resp := DescribeSubnetsResponse{Subnets: []Subnet{
+		{ID: "subnet-full", AvailableIPAddressesCount: 0},
+		{ID: "subnet-low", AvailableIPAddressesCount: 4},
+		{ID: "subnet-exact", AvailableIPAddressesCount: 8},
+		{ID: "subnet-roomy", AvailableIPAddressesCount: 250},
+	}}
+
+	ids := func(subnets []Subnet) []string {
+		ids := []string{}
+		for _, sn := range subnets {
+			ids = append(ids, sn.ID)
+		}
+		return ids
+	}
+
+	if free := ids(resp.WithAtLeastFreeIPs(8)); !reflect.DeepEqual(free, []string{"subnet-exact", "subnet-roomy"}) {
+		t.Errorf("WithAtLeastFreeIPs(8) = %v", free)
+	}
+	if free := ids(resp.WithAtLeastFreeIPs(1000)); len(free) != 0 {
+		t.Errorf("WithAtLeastFreeIPs(1000) = %v", free)
+	}
+
+	// pools are placed in the subnets with room
+	pool := NewPool()
+	pool.Resources["asg"] = pool.ASGTemplate
+	pool.SetSharedResources(SharedResources{Subnets: resp.Subnets})
+
+	placed := pool.ASG().Properties.VPCZoneIdentifier
+	if !reflect.DeepEqual(placed, []string{"subnet-exact", "subnet-roomy"}) {
+		t.Errorf("VPCZoneIdentifier = %v", placed)
+	}
+}
@@ -0,0 +1,73 @@
+package stack
+
+import (
+	"fmt"
+
+	"github.com/goamz/goamz/aws"
+)
+
+// The reasons a Preflight check can fail
+const (
+	PreflightNoCredentials      = "no credentials"
+	PreflightExpiredCredentials = "expired credentials"
+	PreflightInvalidCredentials = "invalid credentials"
+	PreflightAccessDenied       = "missing permissions"
+	PreflightWrongRegion        = "wrong region"
+)
+
+// PreflightError is returned by Preflight, with one of the Preflight reasons
+// when the cause is known.
+type PreflightError struct {
+	Region string
+	Reason string
+	Err    error
+}
+
+func (e *PreflightError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("preflight check failed in %s: %s", e.Region, e.Err)
+	}
+	return fmt.Sprintf("preflight check failed in %s: %s: %s", e.Region, e.Reason, e.Err)
+}
+
+// Check that the client has working credentials, and is allowed to use
+// CloudFormation in its region, by making a single cheap request. Any failure
+// is returned as a *PreflightError.
+func (c *Client) Preflight() error {
+	region := c.Region
+	fail := func(reason string, err error) error {
+		return &PreflightError{Region: region, Reason: reason, Err: err}
+	}
+
+	reg, err := c.awsRegion()
+	if err != nil {
+		return fail(PreflightWrongRegion, err)
+	}
+	region = reg.Name
+
+	if _, err := c.getAuth(); err != nil {
+		return fail(PreflightNoCredentials, err)
+	}
+
+	_, err = c.DescribeStacks("")
+	if err == nil {
+		return nil
+	}
+
+	awsErr, ok := err.(*aws.Error)
+	if !ok {
+		// the endpoint couldn't be reached
+		return fail(PreflightWrongRegion, err)
+	}
+
+	switch awsErr.Code {
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+		return fail(PreflightExpiredCredentials, err)
+	case "InvalidClientTokenId", "SignatureDoesNotMatch", "UnrecognizedClientException",
+		"MissingAuthenticationToken", "IncompleteSignature", "AuthFailure":
+		return fail(PreflightInvalidCredentials, err)
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+		return fail(PreflightAccessDenied, err)
+	}
+	return fail("", err)
+}
@@ -0,0 +1,60 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, describeStackXML("test-stack", "CREATE_COMPLETE", "")
+	})
+
+	if err := Preflight(testRegion); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreflightAuthFailure(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	for code, reason := range map[string]string{
+		"ExpiredToken":          PreflightExpiredCredentials,
+		"InvalidClientTokenId":  PreflightInvalidCredentials,
+		"SignatureDoesNotMatch": PreflightInvalidCredentials,
+		"AccessDenied":          PreflightAccessDenied,
+	} {
+		code := code
+		s.Handle("DescribeStacks", func(url.Values) (int, string) {
+			return http.StatusForbidden, errorResponse(code, "request failed")
+		})
+
+		err := Preflight(testRegion)
+		preErr, ok := err.(*PreflightError)
+		if !ok {
+			t.Fatalf("%s: expected a *PreflightError, got %#v", code, err)
+		}
+		if preErr.Reason != reason {
+			t.Errorf("%s: expected reason %q, got %q", code, reason, preErr.Reason)
+		}
+		if preErr.Region != testRegion {
+			t.Errorf("%s: expected region %s, got %s", code, testRegion, preErr.Region)
+		}
+	}
+}
+
+func TestPreflightWrongRegion(t *testing.T) {
+	err := Preflight("galaxy-nowhere-1")
+	preErr, ok := err.(*PreflightError)
+	if !ok {
+		t.Fatalf("expected a *PreflightError, got %#v", err)
+	}
+	if preErr.Reason != PreflightWrongRegion {
+		t.Errorf("expected reason %q, got %q", PreflightWrongRegion, preErr.Reason)
+	}
+}
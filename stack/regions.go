@@ -0,0 +1,94 @@
+package stack
+
+import (
+	"fmt"
+	"time"
+)
+
+// Validate all regions against the live list from DescribeRegions, in
+// addition to the static list compiled into goamz.
+var StrictRegions = false
+
+type RegionInfo struct {
+	Name        string `xml:"regionName"`
+	Endpoint    string `xml:"regionEndpoint"`
+	OptInStatus string `xml:"optInStatus"`
+}
+
+type DescribeRegionsResponse struct {
+	RequestId string       `xml:"requestId"`
+	Regions   []RegionInfo `xml:"regionInfo>item"`
+}
+
+// How long ValidateRegionLive reuses the list of regions
+var liveRegionsTTL = time.Hour
+
+// List the regions enabled for this account from EC2.
+func (c *Client) DescribeRegions() (DescribeRegionsResponse, error) {
+	return c.describeRegions(false)
+}
+
+// List all regions from EC2, including those which are not enabled for
+// this account.
+func (c *Client) DescribeAllRegions() (DescribeRegionsResponse, error) {
+	return c.describeRegions(true)
+}
+
+func (c *Client) describeRegions(all bool) (DescribeRegionsResponse, error) {
+	regResp := DescribeRegionsResponse{}
+
+	// Use the static region lookup, since the endpoint has to be found
+	// before we can validate anything. With StrictRegions, a region which
+	// isn't in the static list is asked about itself.
+	reg, err := lookupRegion(c.Region)
+	if err != nil && StrictRegions {
+		reg = newRegion(regionName(c.Region))
+	} else if err != nil {
+		return regResp, err
+	}
+
+	service, err := c.regionService("ec2", reg)
+	if err != nil {
+		return regResp, err
+	}
+
+	params := map[string]string{
+		"Action":  "DescribeRegions",
+		"Version": "2016-11-15",
+	}
+
+	if all {
+		params["AllRegions"] = "true"
+	}
+
+	if err := queryMethod(service, "GET", "/", params, &regResp); err != nil {
+		return regResp, err
+	}
+	return regResp, nil
+}
+
+// Verify that region exists in the live list of regions enabled for the
+// client's account, from DescribeRegions. The list is reused for
+// liveRegionsTTL.
+func (c *Client) ValidateRegionLive(region string) error {
+	c.regionsMu.Lock()
+	defer c.regionsMu.Unlock()
+
+	if c.regions == nil || time.Since(c.regionsListed) >= liveRegionsTTL {
+		resp, err := c.DescribeRegions()
+		if err != nil {
+			return err
+		}
+
+		c.regions = make(map[string]bool)
+		for _, r := range resp.Regions {
+			c.regions[r.Name] = true
+		}
+		c.regionsListed = time.Now()
+	}
+
+	if !c.regions[region] {
+		return fmt.Errorf("region %s not found", region)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package stack
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+)
+
+func TestValidateRegionLive(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeRegions", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeRegionsResponse>
+  <requestId>regions-request</requestId>
+  <regionInfo>
+    <item><regionName>us-east-1</regionName></item>
+    <item><regionName>ap-future-1</regionName></item>
+  </regionInfo>
+</DescribeRegionsResponse>`
+	})
+
+	defaultClient.regions = nil
+	defer func() { defaultClient.regions = nil }()
+
+	// not in the static list from goamz
+	if _, err := lookupRegion("ap-future-1"); err == nil {
+		t.Fatal("expected ap-future-1 to be missing from the static regions")
+	}
+
+	if err := ValidateRegionLive("ap-future-1"); err != nil {
+		t.Errorf("expected ap-future-1 to be valid, got %s", err)
+	}
+
+	if err := ValidateRegionLive("us-nowhere-1"); err == nil {
+		t.Error("expected us-nowhere-1 to be invalid")
+	}
+
+	if n := len(s.Requests("DescribeRegions")); n != 1 {
+		t.Errorf("expected 1 cached DescribeRegions request, got %d", n)
+	}
+
+	// the list is fetched again once it's stale
+	defaultClient.regionsListed = defaultClient.regionsListed.Add(-liveRegionsTTL)
+	if err := ValidateRegionLive("ap-future-1"); err != nil {
+		t.Errorf("expected ap-future-1 to be valid, got %s", err)
+	}
+	if n := len(s.Requests("DescribeRegions")); n != 2 {
+		t.Errorf("expected the stale list to be fetched again, got %d DescribeRegions requests", n)
+	}
+}
+
+func TestStrictRegionsLive(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	defer func(strict bool) { StrictRegions = strict }(StrictRegions)
+	StrictRegions = true
+
+	// a region missing from goamz gets its endpoints from regionEndpoint
+	defer func(f func(string, string) string) { regionEndpoint = f }(regionEndpoint)
+	regionEndpoint = func(service, region string) string {
+		return s.URL
+	}
+
+	s.Handle("DescribeRegions", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeRegionsResponse><regionInfo>
+  <item><regionName>galaxy-test-1</regionName></item>
+  <item><regionName>ap-future-1</regionName></item>
+</regionInfo></DescribeRegionsResponse>`
+	})
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		return http.StatusOK, describeStackXML("test", "CREATE_COMPLETE", "")
+	})
+
+	provider := &staticCredentials{auth: aws.Auth{AccessKey: "AKIDVAULT", SecretKey: "vault-secret"}}
+	c := &Client{Region: "ap-future-1", Credentials: provider}
+	if _, err := c.DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DescribeStacks("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the live list is fetched once, with the client's own credentials
+	reqs := s.Requests("DescribeRegions")
+	if len(reqs) != 1 || reqs[0].Get("AWSAccessKeyId") != "AKIDVAULT" {
+		t.Errorf("unexpected DescribeRegions requests: %v", reqs)
+	}
+
+	c = &Client{Region: "us-nowhere-1", Credentials: provider}
+	if _, err := c.DescribeStacks("test"); err == nil {
+		t.Error("expected us-nowhere-1 to be invalid")
+	}
+}
+
+func TestDescribeRegions(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("DescribeRegions", func(url.Values) (int, string) {
+		return http.StatusOK, `<DescribeRegionsResponse>
+  <requestId>regions-request</requestId>
+  <regionInfo>
+    <item>
+      <regionName>us-east-1</regionName>
+      <regionEndpoint>ec2.us-east-1.amazonaws.com</regionEndpoint>
+      <optInStatus>opt-in-not-required</optInStatus>
+    </item>
+    <item>
+      <regionName>eu-west-1</regionName>
+      <regionEndpoint>ec2.eu-west-1.amazonaws.com</regionEndpoint>
+      <optInStatus>opt-in-not-required</optInStatus>
+    </item>
+    <item>
+      <regionName>af-south-1</regionName>
+      <regionEndpoint>ec2.af-south-1.amazonaws.com</regionEndpoint>
+      <optInStatus>not-opted-in</optInStatus>
+    </item>
+  </regionInfo>
+</DescribeRegionsResponse>`
+	})
+
+	resp, err := DescribeAllRegions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RegionInfo{
+		{"us-east-1", "ec2.us-east-1.amazonaws.com", "opt-in-not-required"},
+		{"eu-west-1", "ec2.eu-west-1.amazonaws.com", "opt-in-not-required"},
+		{"af-south-1", "ec2.af-south-1.amazonaws.com", "not-opted-in"},
+	}
+
+	if !reflect.DeepEqual(resp.Regions, expected) {
+		t.Errorf("expected regions %v, got %v", expected, resp.Regions)
+	}
+
+	if resp.RequestId != "regions-request" {
+		t.Errorf("unexpected RequestId: %s", resp.RequestId)
+	}
+
+	if _, err := DescribeRegions(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.Requests("DescribeRegions")
+	if reqs[0].Get("AllRegions") != "true" {
+		t.Error("expected AllRegions=true")
+	}
+	// the 2014-02-01 API version has neither AllRegions nor optInStatus
+	if reqs[0].Get("Version") != "2016-11-15" {
+		t.Errorf("unexpected API version: %s", reqs[0].Get("Version"))
+	}
+	if _, ok := reqs[1]["AllRegions"]; ok {
+		t.Error("expected no AllRegions parameter")
+	}
+}
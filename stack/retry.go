@@ -0,0 +1,113 @@
+package stack
+
+import (
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+)
+
+// A RetryPolicy decides which failed requests are retried, and how long to
+// sleep before each retry. The delay starts at BaseDelay and doubles with
+// each retry, up to MaxDelay.
+type RetryPolicy struct {
+	// The most attempts made, including the first. Zero means no limit.
+	MaxAttempts int
+
+	BaseDelay time.Duration
+	// The longest delay between attempts. Zero means no limit.
+	MaxDelay time.Duration
+
+	// Each delay is randomly adjusted by up to this fraction of itself, e.g.
+	// 0.2 for +/-20%, so that concurrent callers don't retry in lockstep.
+	Jitter float64
+
+	// Check if an error is worth retrying. If nil, every error is retried.
+	Retryable func(error) bool
+}
+
+// Return the policy used by a Client without its own RetryPolicy: up to 5
+// attempts at throttled requests, server errors, and connection errors,
+// backing off from the stack poll interval to a minute.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   pollInterval,
+		MaxDelay:    maxErrorBackoff,
+		Retryable:   isTransient,
+	}
+}
+
+// Return the delay before the given retry, counting from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry; i++ {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Check if a request which failed with err on the given attempt, counting
+// from 1, should be tried again.
+func (p RetryPolicy) ShouldRetry(attempt int, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return false
+	}
+
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// Call f until it succeeds or the policy gives up, sleeping between attempts.
+// The last error is returned.
+func (p RetryPolicy) Do(f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !p.ShouldRetry(attempt, err) {
+			return err
+		}
+
+		sleep(p.Delay(attempt))
+	}
+}
+
+// Return the client's RetryPolicy, or the default.
+func (c *Client) retryPolicy() RetryPolicy {
+	if c.RetryPolicy != nil {
+		return *c.RetryPolicy
+	}
+	return DefaultRetryPolicy()
+}
+
+// Check if a request failed for a reason which may clear up on its own:
+// throttling, a server error, or an error reaching AWS at all. Anything else,
+// like an unknown region, missing credentials, or a response which can't be
+// decoded, would only fail again.
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case *aws.Error:
+		return isThrottled(err) || err.StatusCode >= 500
+	case *s3.Error:
+		return err.Code == "SlowDown" || err.StatusCode >= 500
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
+}
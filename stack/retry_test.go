@@ -0,0 +1,143 @@
+package stack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if d := p.Delay(i + 1); d != want {
+			t.Errorf("retry %d: expected delay %s, got %s", i+1, want, d)
+		}
+	}
+
+	// without a MaxDelay the delay keeps doubling
+	p.MaxDelay = 0
+	if d := p.Delay(6); d != 32*time.Second {
+		t.Errorf("expected uncapped delay of 32s, got %s", d)
+	}
+
+	p.MaxDelay = 5 * time.Second
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		if d < time.Second || d > 3*time.Second {
+			t.Fatalf("jittered delay %s outside of 1s-3s", d)
+		}
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	p := DefaultRetryPolicy()
+
+	for _, tc := range []struct {
+		err   error
+		retry bool
+	}{
+		{nil, false},
+		{&aws.Error{StatusCode: http.StatusBadRequest, Code: "Throttling"}, true},
+		{&aws.Error{StatusCode: http.StatusBadRequest, Code: "ThrottlingException"}, true},
+		{&aws.Error{StatusCode: http.StatusServiceUnavailable, Code: "ServiceUnavailable"}, true},
+		{&aws.Error{StatusCode: http.StatusBadRequest, Code: "ValidationError"}, false},
+		{&s3.Error{StatusCode: http.StatusInternalServerError}, true},
+		{&s3.Error{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, false},
+		{&url.Error{Op: "Post", URL: "https://cloudformation.amazonaws.com/", Err: fmt.Errorf("connection reset by peer")}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}, true},
+		{&xml.SyntaxError{Msg: "unexpected EOF", Line: 1}, false},
+		{ErrMaxPages, false},
+		{fmt.Errorf("unknown region"), false},
+	} {
+		if retry := p.ShouldRetry(1, tc.err); retry != tc.retry {
+			t.Errorf("ShouldRetry(%v) = %t, want %t", tc.err, retry, tc.retry)
+		}
+	}
+
+	throttled := &aws.Error{StatusCode: http.StatusBadRequest, Code: "Throttling"}
+	if !p.ShouldRetry(p.MaxAttempts-1, throttled) {
+		t.Error("expected a retry before MaxAttempts")
+	}
+	if p.ShouldRetry(p.MaxAttempts, throttled) {
+		t.Error("expected no retry after MaxAttempts")
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	p := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}
+	calls := 0
+	err := p.Do(func() error {
+		calls++
+		return fmt.Errorf("attempt %d failed", calls)
+	})
+
+	if err == nil || err.Error() != "attempt 3 failed" {
+		t.Errorf("expected the last error, got %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	if len(delays) != 2 || delays[0] != time.Second || delays[1] != 2*time.Second {
+		t.Errorf("unexpected delays: %v", delays)
+	}
+}
+
+func TestRetryPolicyConfigError(t *testing.T) {
+	sleeps := 0
+	sleep = func(time.Duration) { sleeps++ }
+	defer func() { sleep = time.Sleep }()
+
+	// a bad region can't be fixed by waiting
+	c := &Client{Region: "nowhere-1"}
+	calls := 0
+	err := c.retryPolicy().Do(func() error {
+		calls++
+		_, err := c.getService("cf")
+		return err
+	})
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown region")
+	}
+	if calls != 1 || sleeps != 0 {
+		t.Errorf("expected no retries, got %d attempts and %d sleeps", calls, sleeps)
+	}
+}
+
+func TestClientRetryPolicy(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("ListStackResources", func(url.Values) (int, string) {
+		return http.StatusOK, listResourcesXML("CREATE_COMPLETE")
+	})
+	s.Handle("DescribeStackResource", func(url.Values) (int, string) {
+		return http.StatusBadRequest, errorResponse("Throttling", "Rate exceeded")
+	})
+
+	// a single attempt means no retries
+	c := &Client{RetryPolicy: &RetryPolicy{MaxAttempts: 1}}
+	if _, err := c.AllResourcesDetailed("test"); err == nil {
+		t.Fatal("expected a throttling error")
+	}
+
+	if n := len(s.Requests("DescribeStackResource")); n != 1 {
+		t.Errorf("expected 1 DescribeStackResource request, got %d", n)
+	}
+}
@@ -0,0 +1,35 @@
+package stack
+
+import (
+	"github.com/goamz/goamz/s3"
+)
+
+// Upload a template to S3, and return its URL for use as a TemplateURL.
+// Server errors are retried according to the client's RetryPolicy.
+func (c *Client) UploadTemplate(bucket, key string, body []byte) (string, error) {
+	reg, err := c.awsRegion()
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := c.getAuth()
+	if err != nil {
+		return "", err
+	}
+
+	// YAML templates, or any other text, are still accepted
+	contentType := "application/json"
+	if _, err := parseTemplate(body); err != nil || !isJSONTemplate(body) {
+		contentType = "text/plain"
+	}
+
+	b := s3.New(auth, *reg).Bucket(bucket)
+	err = c.retryPolicy().Do(func() error {
+		return b.Put(key, body, contentType, s3.Private, s3.Options{})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return b.URL(key), nil
+}
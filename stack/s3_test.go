@@ -0,0 +1,54 @@
+package stack
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+)
+
+func TestUploadTemplate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	type put struct {
+		method, path, contentType, body string
+	}
+	puts := []put{}
+
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		puts = append(puts, put{r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(body)})
+
+		// fail the first attempt with a server error
+		if len(puts) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer s3Server.Close()
+
+	reg := aws.Regions[testRegion]
+	reg.S3Endpoint = s3Server.URL
+	aws.Regions[testRegion] = reg
+
+	url, err := UploadTemplate("templates", "pools/web.json", []byte(`{"Resources": {}}`), testRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != s3Server.URL+"/templates/pools/web.json" {
+		t.Errorf("unexpected template URL: %s", url)
+	}
+
+	if len(puts) != 2 {
+		t.Fatalf("expected 2 PUT attempts, got %d", len(puts))
+	}
+
+	expected := put{"PUT", "/templates/pools/web.json", "application/json", `{"Resources": {}}`}
+	if puts[1] != expected {
+		t.Errorf("PUT = %+v, want %+v", puts[1], expected)
+	}
+}
@@ -0,0 +1,131 @@
+package stack
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/litl/galaxy/log"
+)
+
+// How long WaitViaSQS waits for the first notification about a stack before
+// falling back to polling with Wait.
+var sqsGracePeriod = 2 * time.Minute
+
+// How far a notification's timestamp may be before WaitViaSQS started and
+// still count, to allow for clock skew. Older notifications were left in the
+// queue by an earlier operation on the stack.
+var sqsClockSkew = 30 * time.Second
+
+type sqsMessage struct {
+	MessageId     string
+	ReceiptHandle string
+	Body          string
+}
+
+type ReceiveMessageResponse struct {
+	RequestId string       `xml:"ResponseMetadata>RequestId"`
+	Messages  []sqsMessage `xml:"ReceiveMessageResult>Message"`
+}
+
+// the SNS envelope around a message delivered to an SQS queue
+type snsMessage struct {
+	Type    string
+	Subject string
+	Message string
+}
+
+// Parse the body of an SQS message containing an SNS CloudFormation
+// notification.
+func parseSQSNotification(body string) (Notification, error) {
+	msg := snsMessage{}
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return Notification{}, err
+	}
+
+	return ParseNotification(msg.Message)
+}
+
+// Wait for a stack to complete, like Wait, using the stack's notifications
+// delivered to an SQS queue through SNS rather than polling DescribeStacks.
+// Messages about other stacks are left in the queue, and those about the stack
+// from before the wait started are deleted and ignored. If no notification for
+// the stack arrives within a grace period, fall back to Wait for the remainder
+// of the timeout.
+func (c *Client) WaitViaSQS(queueURL string, stackName string, timeout time.Duration) error {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return err
+	}
+
+	svc, err := c.getService("sqs")
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	heard := false
+
+	for {
+		now := time.Now()
+		if now.After(deadline) {
+			return ErrTimeout
+		}
+
+		if !heard && now.After(start.Add(sqsGracePeriod)) {
+			log.Debugf("no notifications for %s, polling instead", stackName)
+			return c.Wait(stackName, deadline.Sub(now))
+		}
+
+		params := map[string]string{
+			"Action":              "ReceiveMessage",
+			"Version":             "2012-11-05",
+			"MaxNumberOfMessages": "10",
+			"WaitTimeSeconds":     "20",
+		}
+
+		recvResp := ReceiveMessageResponse{}
+		if err := queryPath(svc, u.Path, params, &recvResp); err != nil {
+			return err
+		}
+
+		for _, msg := range recvResp.Messages {
+			n, err := parseSQSNotification(msg.Body)
+			if err != nil || n.StackName != stackName {
+				continue
+			}
+
+			stale := !n.Timestamp.IsZero() && n.Timestamp.Before(start.Add(-sqsClockSkew))
+			if !stale {
+				heard = true
+			}
+
+			params := map[string]string{
+				"Action":        "DeleteMessage",
+				"Version":       "2012-11-05",
+				"ReceiptHandle": msg.ReceiptHandle,
+			}
+			if err := queryPath(svc, u.Path, params, &struct{}{}); err != nil {
+				log.Debugf("DeleteMessage: %s", err)
+			}
+
+			// only the stack's own events tell us when it's done
+			if stale || n.ResourceType != "AWS::CloudFormation::Stack" || n.LogicalResourceId != stackName {
+				continue
+			}
+
+			switch n.ResourceStatus {
+			case "CREATE_COMPLETE", "UPDATE_COMPLETE", "UPDATE_COMPLETE_CLEANUP_IN_PROGRESS", "DELETE_COMPLETE":
+				return nil
+			case "ROLLBACK_COMPLETE", "ROLLBACK_FAILED", "UPDATE_ROLLBACK_COMPLETE", "UPDATE_ROLLBACK_FAILED", "DELETE_FAILED":
+				stack := stackDescription{
+					Name:         stackName,
+					Status:       n.ResourceStatus,
+					StatusReason: n.ResourceStatusReason,
+				}
+				return c.stackFailure(stackName, stack, start)
+			}
+		}
+	}
+}
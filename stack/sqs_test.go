@@ -0,0 +1,138 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Return the body of an SQS message with a CloudFormation notification for a
+// resource in stack, sent now.
+func cfNotification(stack, logicalID, resourceType, status string) string {
+	return cfNotificationAt(time.Now(), stack, logicalID, resourceType, status)
+}
+
+// Return the body of an SQS message with a CloudFormation notification sent at
+// ts.
+func cfNotificationAt(ts time.Time, stack, logicalID, resourceType, status string) string {
+	msg := fmt.Sprintf(`StackId='arn:aws:cloudformation:galaxy-test-1:123456789012:stack/%s/1'
+Timestamp='%s'
+EventId='%s-%s'
+LogicalResourceId='%s'
+Namespace='123456789012'
+PrincipalId='AIDAEXAMPLE'
+ResourceProperties='null'
+ResourceStatus='%s'
+ResourceStatusReason=''
+ResourceType='%s'
+StackName='%s'
+`, stack, ts.UTC().Format("2006-01-02T15:04:05.000Z"), logicalID, status, logicalID, status, resourceType, stack)
+
+	body, _ := json.Marshal(map[string]string{
+		"Type":     "Notification",
+		"TopicArn": "arn:aws:sns:galaxy-test-1:123456789012:stacks",
+		"Subject":  "AWS CloudFormation Notification",
+		"Message":  msg,
+	})
+	return string(body)
+}
+
+// Return a ReceiveMessage response containing each message body
+func receiveMessageXML(bodies ...string) string {
+	members := ""
+	for i, body := range bodies {
+		escaped := &bytes.Buffer{}
+		xml.EscapeText(escaped, []byte(body))
+		members += fmt.Sprintf(`<Message><MessageId>msg-%d</MessageId><ReceiptHandle>receipt-%d</ReceiptHandle><Body>%s</Body></Message>`, i, i, escaped)
+	}
+	return fmt.Sprintf(`<ReceiveMessageResponse><ReceiveMessageResult>%s</ReceiveMessageResult></ReceiveMessageResponse>`, members)
+}
+
+func TestParseSQSNotification(t *testing.T) {
+	n, err := parseSQSNotification(cfNotification("test", "test", "AWS::CloudFormation::Stack", "CREATE_COMPLETE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.StackName != "test" || n.ResourceType != "AWS::CloudFormation::Stack" || n.ResourceStatus != "CREATE_COMPLETE" {
+		t.Errorf("unexpected notification: %+v", n)
+	}
+}
+
+func TestWaitViaSQS(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	receives := []string{
+		receiveMessageXML(
+			cfNotification("other", "other", "AWS::CloudFormation::Stack", "CREATE_COMPLETE"),
+			cfNotification("test", "asg", "AWS::AutoScaling::AutoScalingGroup", "CREATE_COMPLETE"),
+		),
+		receiveMessageXML(),
+		receiveMessageXML(cfNotification("test", "test", "AWS::CloudFormation::Stack", "CREATE_COMPLETE")),
+	}
+	s.Handle("ReceiveMessage", func(url.Values) (int, string) {
+		resp := receives[0]
+		receives = receives[1:]
+		return http.StatusOK, resp
+	})
+	s.Handle("DeleteMessage", func(url.Values) (int, string) {
+		return http.StatusOK, `<DeleteMessageResponse/>`
+	})
+
+	if err := WaitViaSQS(s.URL+"/123456789012/stacks", "test", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.Requests("ReceiveMessage")); n != 3 {
+		t.Errorf("expected 3 ReceiveMessage requests, got %d", n)
+	}
+
+	// the other stack's message is left in the queue
+	deletes := s.Requests("DeleteMessage")
+	if len(deletes) != 2 || deletes[0].Get("ReceiptHandle") != "receipt-1" {
+		t.Errorf("unexpected DeleteMessage requests: %v", deletes)
+	}
+
+	if n := len(s.Requests("DescribeStacks")); n != 0 {
+		t.Errorf("expected no DescribeStacks requests, got %d", n)
+	}
+}
+
+func TestWaitViaSQSStale(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// an earlier update's notification is still in the queue
+	receives := []string{
+		receiveMessageXML(cfNotificationAt(time.Now().Add(-time.Hour), "test", "test", "AWS::CloudFormation::Stack", "UPDATE_COMPLETE")),
+		receiveMessageXML(cfNotification("test", "test", "AWS::CloudFormation::Stack", "UPDATE_IN_PROGRESS")),
+		receiveMessageXML(cfNotification("test", "test", "AWS::CloudFormation::Stack", "UPDATE_COMPLETE")),
+	}
+	s.Handle("ReceiveMessage", func(url.Values) (int, string) {
+		resp := receives[0]
+		receives = receives[1:]
+		return http.StatusOK, resp
+	})
+	s.Handle("DeleteMessage", func(url.Values) (int, string) {
+		return http.StatusOK, `<DeleteMessageResponse/>`
+	})
+
+	if err := WaitViaSQS(s.URL+"/123456789012/stacks", "test", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.Requests("ReceiveMessage")); n != 3 {
+		t.Errorf("expected to wait past the stale notification, got %d ReceiveMessage requests", n)
+	}
+
+	// the stale message is removed from the queue too
+	if n := len(s.Requests("DeleteMessage")); n != 3 {
+		t.Errorf("expected 3 DeleteMessage requests, got %d", n)
+	}
+}
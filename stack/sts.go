@@ -0,0 +1,32 @@
+package stack
+
+type GetCallerIdentityResponse struct {
+	RequestId string         `xml:"ResponseMetadata>RequestId"`
+	Identity  CallerIdentity `xml:"GetCallerIdentityResult"`
+}
+
+// CallerIdentity is the AWS account and principal making requests.
+type CallerIdentity struct {
+	Account string `xml:"Account"`
+	Arn     string `xml:"Arn"`
+	UserId  string `xml:"UserId"`
+}
+
+// Return the identity of the credentials used by the client.
+func (c *Client) GetCallerIdentity() (CallerIdentity, error) {
+	svc, err := c.getService("sts")
+	if err != nil {
+		return CallerIdentity{}, err
+	}
+
+	params := map[string]string{
+		"Action":  "GetCallerIdentity",
+		"Version": "2011-06-15",
+	}
+
+	resp := GetCallerIdentityResponse{}
+	if err := query(svc, params, &resp); err != nil {
+		return CallerIdentity{}, err
+	}
+	return resp.Identity, nil
+}
@@ -0,0 +1,43 @@
+package stack
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Return a GetCallerIdentity response for a user in account
+func callerIdentityXML(account string) string {
+	return fmt.Sprintf(`<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::%s:user/deployer</Arn>
+    <UserId>AIDACKCEVSQ6C2EXAMPLE</UserId>
+    <Account>%s</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>sts-request</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`, account, account)
+}
+
+func TestGetCallerIdentity(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Handle("GetCallerIdentity", func(url.Values) (int, string) {
+		return http.StatusOK, callerIdentityXML("123456789012")
+	})
+
+	identity, err := GetCallerIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CallerIdentity{
+		Account: "123456789012",
+		Arn:     "arn:aws:iam::123456789012:user/deployer",
+		UserId:  "AIDACKCEVSQ6C2EXAMPLE",
+	}
+	if identity != expected {
+		t.Errorf("expected %#v, got %#v", expected, identity)
+	}
+}
@@ -0,0 +1,86 @@
+package stack
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Follow a stack's events, polling every interval. Events are sent oldest
+// first, starting with the stack's existing events, and each event is only
+// sent once. Both channels are closed once the stack reaches a state which
+// isn't _IN_PROGRESS, or ctx is done. An error polling the stack is sent
+// before the channels are closed. The stack is followed by its ID once it's
+// found, so that the events of a delete are sent up to DELETE_COMPLETE.
+func (c *Client) TailEvents(ctx context.Context, name string, interval time.Duration) (<-chan stackEvent, <-chan error) {
+	events := make(chan stackEvent)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+
+		seen := make(map[string]bool)
+		lastEventID := ""
+		for {
+			// check the status before listing events, so that the events
+			// leading to a final status are always sent
+			desc, err := c.describeStacks(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			done := false
+			for _, stack := range desc.Stacks {
+				if !stack.matches(name) {
+					continue
+				}
+
+				// a deleted stack can only be described by its ID
+				if stack.Id != "" {
+					name = stack.Id
+				}
+				if !strings.HasSuffix(stack.Status, "_IN_PROGRESS") {
+					done = true
+				}
+			}
+
+			newEvents, err := c.StackEventsSince(name, lastEventID)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for i := len(newEvents) - 1; i >= 0; i-- {
+				event := newEvents[i]
+				if seen[event.EventId] {
+					continue
+				}
+				seen[event.EventId] = true
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(newEvents) > 0 {
+				lastEventID = newEvents[0].EventId
+			}
+
+			if done {
+				return
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, errs
+}
@@ -0,0 +1,154 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTailEvents(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	start := time.Now().UTC().Truncate(time.Second)
+	event := func(id string, n int) string {
+		return fmt.Sprintf(`<member><EventId>%s</EventId><ResourceStatus>%s</ResourceStatus><Timestamp>%s</Timestamp></member>`,
+			id, id, start.Add(time.Duration(n)*time.Second).Format(time.RFC3339))
+	}
+
+	// each poll sees the stack's status, and its full event history
+	polls := []struct {
+		status string
+		events string
+	}{
+		{"CREATE_IN_PROGRESS", event("CREATE_IN_PROGRESS", 0)},
+		{"CREATE_IN_PROGRESS", event("RESOURCE_COMPLETE", 1) + event("CREATE_IN_PROGRESS", 0)},
+		{"CREATE_COMPLETE", event("CREATE_COMPLETE", 2) + event("RESOURCE_COMPLETE", 1) + event("CREATE_IN_PROGRESS", 0)},
+	}
+
+	var mu sync.Mutex
+	poll := 0
+	s.Handle("DescribeStacks", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return http.StatusOK, describeStackXML("test", polls[poll].status, "")
+	})
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events := polls[poll].events
+		if poll < len(polls)-1 {
+			poll++
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult><StackEvents>%s</StackEvents></DescribeStackEventsResult>
+</DescribeStackEventsResponse>`, events)
+	})
+
+	events, errs := TailEvents(context.Background(), "test", time.Millisecond)
+
+	ids := []string{}
+	for e := range events {
+		ids = append(ids, e.EventId)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"CREATE_IN_PROGRESS", "RESOURCE_COMPLETE", "CREATE_COMPLETE"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("events = %v, want %v", ids, expected)
+	}
+}
+
+func TestTailEventsDelete(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	id := "arn:aws:cloudformation:" + testRegion + ":123456789012:stack/test/1"
+	start := time.Now().UTC().Truncate(time.Second)
+	event := func(status string, n int) string {
+		return fmt.Sprintf(`<member><EventId>%s</EventId><ResourceStatus>%s</ResourceStatus><Timestamp>%s</Timestamp></member>`,
+			status, status, start.Add(time.Duration(n)*time.Second).Format(time.RFC3339))
+	}
+
+	polls := []struct {
+		status string
+		events string
+	}{
+		{"DELETE_IN_PROGRESS", event("DELETE_IN_PROGRESS", 0)},
+		{"DELETE_COMPLETE", event("DELETE_COMPLETE", 1) + event("DELETE_IN_PROGRESS", 0)},
+	}
+
+	// once the first poll is done, the stack is deleted and can only be
+	// found by its ID
+	var mu sync.Mutex
+	poll := 0
+	s.Handle("DescribeStacks", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if poll > 0 && params.Get("StackName") != id {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id test does not exist")
+		}
+		return http.StatusOK, describeStackXML("test", polls[poll].status, "")
+	})
+	s.Handle("DescribeStackEvents", func(params url.Values) (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if poll > 0 && params.Get("StackName") != id {
+			return http.StatusBadRequest, errorResponse("ValidationError", "Stack with id test does not exist")
+		}
+		events := polls[poll].events
+		if poll < len(polls)-1 {
+			poll++
+		}
+		return http.StatusOK, fmt.Sprintf(`<DescribeStackEventsResponse>
+  <DescribeStackEventsResult><StackEvents>%s</StackEvents></DescribeStackEventsResult>
+</DescribeStackEventsResponse>`, events)
+	})
+
+	events, errs := TailEvents(context.Background(), "test", time.Millisecond)
+
+	ids := []string{}
+	for e := range events {
+		ids = append(ids, e.EventId)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"DELETE_IN_PROGRESS", "DELETE_COMPLETE"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("events = %v, want %v", ids, expected)
+	}
+}
+
+func TestTailEventsCanceled(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	handleStatuses(s, "test", "UPDATE_IN_PROGRESS")
+	s.Handle("DescribeStackEvents", func(url.Values) (int, string) {
+		return http.StatusOK, stackEventsXML(time.Now())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, _ := TailEvents(ctx, "test", time.Millisecond)
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed after cancel")
+	}
+}
@@ -144,7 +144,7 @@ func getInitOpts(c *cli.Context) *stack.GalaxyTmplParams {
 
 	subnets := []*stack.SubnetTmplParams{}
 
-	for i, az := range azResp.AvailabilityZones {
+	for i, az := range azResp.StandardZones() {
 		s := &stack.SubnetTmplParams{
 			Name:   fmt.Sprintf("%sSubnet%d", name, i+1),
 			Subnet: fmt.Sprintf("10.24.%d.0/24", i+1),
@@ -215,7 +215,7 @@ func stackInit(c *cli.Context) {
 	}
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	exists, err := stack.Exists(stackName)
@@ -258,7 +258,7 @@ func stackUpdate(c *cli.Context) {
 	}
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	params := make(map[string]string)
@@ -327,7 +327,7 @@ func stackUpdate(c *cli.Context) {
 func stackTemplate(c *cli.Context) {
 	stackName := c.Args().First()
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	if stackName == "" {
@@ -336,7 +336,7 @@ func stackTemplate(c *cli.Context) {
 	}
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	stackTmpl, err := stack.GetTemplate(stackName)
@@ -405,7 +405,7 @@ func stackCreatePool(c *cli.Context) {
 	ensurePoolArg(c)
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	poolName := utils.GalaxyPool(c)
@@ -622,7 +622,7 @@ func stackUpdatePool(c *cli.Context) {
 	ensurePoolArg(c)
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	poolName := utils.GalaxyPool(c)
@@ -654,15 +654,15 @@ func stackUpdatePool(c *cli.Context) {
 	}
 
 	if c.Int("desired-size") > 0 {
-		asg.Properties.DesiredCapacity = c.Int("desired-size")
+		asg.SetDesiredCapacity(c.Int("desired-size"))
 	}
 
 	if c.Int("min-size") > 0 {
-		asg.Properties.MinSize = c.Int("min-size")
+		asg.SetMinSize(c.Int("min-size"))
 	}
 
 	if c.Int("max-size") > 0 {
-		asg.Properties.MaxSize = c.Int("max-size")
+		asg.SetMaxSize(c.Int("max-size"))
 	}
 
 	if c.Bool("auto-update") {
@@ -785,7 +785,7 @@ func stackDeletePool(c *cli.Context) {
 	ensurePoolArg(c)
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	baseStack := getBase(c)
@@ -816,7 +816,7 @@ func stackDelete(c *cli.Context) {
 	}
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	waitAndDelete(stackName)
@@ -824,7 +824,7 @@ func stackDelete(c *cli.Context) {
 
 func stackList(c *cli.Context) {
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	descResp, err := stack.DescribeStacks("")
@@ -852,7 +852,7 @@ func stackListEvents(c *cli.Context) {
 	}
 
 	if c.String("region") != "" {
-		stack.Region = c.String("region")
+		stack.SetRegion(c.String("region"))
 	}
 
 	resp, err := stack.DescribeStackEvents(stackName)